@@ -0,0 +1,253 @@
+// beanstalkd package implements beanstalkd tubes as reprow.Queue.
+// Producers should put json encoded payloads to one of the watched tubes.
+//
+// Reserved jobs are deleted when they end, released with their priority and retry after as delay when they are aborted,
+// and buried when they are rejected. Jobs are touched while running so that long running jobs do not exceed their ttr.
+package beanstalkd
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/kr/beanstalk"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	reprow.RegisterQueue("beanstalkd", &BeanstalkdBuilder{})
+}
+
+type BeanstalkdBuilder struct{}
+
+func (b *BeanstalkdBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewBeanstalkd(config, logger)
+}
+
+func NewBeanstalkd(config map[string]interface{}, logger seelog.LoggerInterface) (*Beanstalkd, error) {
+	b := Beanstalkd{}
+	err := b.configure(config, logger)
+	return &b, err
+}
+
+// Beanstalkd implements beanstalkd as reprow.Queue.
+// Reserved jobs can only be deleted or released by the connection that reserved them,
+// so each job holds a connection until it is finished like q4m holds a transaction.
+type Beanstalkd struct {
+	logger         seelog.LoggerInterface
+	config         Config
+	reserveTimeout time.Duration
+	idle           chan *beanstalk.Conn
+	wantDown       chan bool
+	running        bool
+	wg             sync.WaitGroup
+}
+
+type Config struct {
+	Address        string   `valid:"required"`
+	Tubes          []string `valid:"-"`
+	ReserveTimeout string   `valid:"-" mapstructure:"reserve_timeout"`
+}
+
+func (b *Beanstalkd) Start(outChannel chan reprow.Job) error {
+	if b.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		b.running = true
+		b.wantDown = make(chan bool)
+		b.wg.Add(1)
+		go b.run(outChannel)
+		return nil
+	}
+}
+
+func (b *Beanstalkd) run(outChannel chan reprow.Job) {
+	defer b.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: b,
+		}
+		select {
+		case outChannel <- &job:
+		case <-b.wantDown:
+			return
+		}
+		b.wg.Add(1)
+		go func(job *Job) {
+			defer job.finalize()
+			defer b.wg.Done()
+
+			conn, err := b.getConn()
+			if err != nil {
+				b.logger.Errorf("reprow/beanstalkd: failed to connect e=%s", err.Error())
+				time.Sleep(time.Second)
+				return
+			}
+
+			id, body, err := beanstalk.NewTubeSet(conn, b.config.Tubes...).Reserve(b.reserveTimeout)
+			if cerr, ok := err.(beanstalk.ConnError); ok && (cerr.Err == beanstalk.ErrTimeout || cerr.Err == beanstalk.ErrDeadline) {
+				b.putConn(conn)
+				b.logger.Debugf("no queue retrieved")
+				return
+			}
+			if err != nil {
+				conn.Close()
+				b.logger.Errorf("reprow/beanstalkd: failed to reserve e=%s", err.Error())
+				time.Sleep(time.Second)
+				return
+			}
+
+			job.id = id
+			job.conn = conn
+			job.stats, err = conn.StatsJob(id)
+			if err != nil {
+				b.logger.Errorf("reprow/beanstalkd: failed to get stats id=%d e=%s", id, err.Error())
+			}
+
+			err = json.Unmarshal(body, &job.payload)
+			if err != nil {
+				b.logger.Errorf("reprow/beanstalkd: failed to deserialize job. burying id=%d err=%s", id, err.Error())
+				b.Reject(job, "failed to deserialize")
+				job.payload = nil
+				return
+			}
+			job.touching = make(chan bool)
+			go b.touch(job)
+		}(&job)
+	}
+}
+
+// touch keeps ttr of job alive until it is finished
+func (b *Beanstalkd) touch(job *Job) {
+	ttr, _ := strconv.Atoi(job.stats["ttr"])
+	if ttr < 2 {
+		// Touching more often than every second would not help
+		return
+	}
+	ticker := time.NewTicker(time.Duration(ttr) * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.touching:
+			return
+		case <-ticker.C:
+			job.mu.Lock()
+			if job.conn != nil {
+				err := job.conn.Touch(job.id)
+				if err != nil {
+					b.logger.Errorf("reprow/beanstalkd: touch failed id=%d e=%s", job.id, err.Error())
+				}
+			}
+			job.mu.Unlock()
+		}
+	}
+}
+
+func (b *Beanstalkd) Stop() error {
+	b.logger.Infof("stopping queue")
+	if b.running == false {
+		return errors.New("not running")
+	} else {
+		close(b.wantDown)
+		b.wg.Wait()
+		b.running = false
+		return nil
+	}
+}
+
+func (b *Beanstalkd) Abort(job *Job, retryAfter int) {
+	b.finish(job, func(conn *beanstalk.Conn) error {
+		return conn.Release(job.id, job.priority(), time.Duration(retryAfter)*time.Second)
+	})
+}
+
+func (b *Beanstalkd) End(job *Job) {
+	b.finish(job, func(conn *beanstalk.Conn) error {
+		return conn.Delete(job.id)
+	})
+}
+
+func (b *Beanstalkd) Reject(job *Job, reason string) {
+	b.logger.Errorf("reprow/beanstalkd: job rejected id=%d reason=%s", job.id, reason)
+	b.finish(job, func(conn *beanstalk.Conn) error {
+		return conn.Bury(job.id, job.priority())
+	})
+}
+
+// finish runs command for job and gives its connection back
+func (b *Beanstalkd) finish(job *Job, command func(*beanstalk.Conn) error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.conn == nil {
+		b.logger.Errorf("reprow/beanstalkd: job already finished id=%d", job.id)
+		return
+	}
+	if job.touching != nil {
+		close(job.touching)
+	}
+
+	err := command(job.conn)
+	if err != nil {
+		// Closing connection releases the job when it is still reserved
+		b.logger.Errorf("reprow/beanstalkd: failed to finish job id=%d e=%s", job.id, err.Error())
+		job.conn.Close()
+	} else {
+		b.putConn(job.conn)
+	}
+	job.conn = nil
+}
+
+func (b *Beanstalkd) getConn() (*beanstalk.Conn, error) {
+	select {
+	case conn := <-b.idle:
+		return conn, nil
+	default:
+		return beanstalk.Dial("tcp", b.config.Address)
+	}
+}
+
+func (b *Beanstalkd) putConn(conn *beanstalk.Conn) {
+	select {
+	case b.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (b *Beanstalkd) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	b.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Tubes) == 0 {
+		config.Tubes = []string{"default"}
+	}
+	b.reserveTimeout, err = reprow.ParseDuration(config.ReserveTimeout, "1s")
+	if err != nil {
+		return errors.New("reserve_timeout failed to parse: " + err.Error())
+	}
+
+	b.config = config
+	b.idle = make(chan *beanstalk.Conn, 10)
+
+	conn, err := b.getConn()
+	if err != nil {
+		return err
+	}
+	b.putConn(conn)
+	return nil
+}
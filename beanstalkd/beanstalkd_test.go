@@ -0,0 +1,140 @@
+package beanstalkd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cihub/seelog"
+	"github.com/kr/beanstalk"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+// testTube returns address given by REPROW_TEST_BEANSTALKD_ADDRESS and a tube name unique to the test
+func testTube(t *testing.T) (string, string) {
+	address := os.Getenv("REPROW_TEST_BEANSTALKD_ADDRESS")
+	if address == "" {
+		t.Skip("REPROW_TEST_BEANSTALKD_ADDRESS is not set")
+	}
+	return address, fmt.Sprintf("reprow_test_%d", time.Now().UnixNano())
+}
+
+func newTestBeanstalkd(t *testing.T, address string, tube string) *Beanstalkd {
+	queue, err := NewBeanstalkd(map[string]interface{}{
+		"address": address,
+		"tubes":   []string{tube},
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make beanstalkd queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func mustPut(t *testing.T, address string, tube string, payload map[string]interface{}) {
+	conn, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to connect e=%s", err.Error())
+	}
+	defer conn.Close()
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	_, err = (&beanstalk.Tube{Conn: conn, Name: tube}).Put(b, 100, 0, 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to put e=%s", err.Error())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	var address, tube string
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			address, tube = testTube(t)
+			return newTestBeanstalkd(t, address, tube)
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustPut(t, address, tube, payload)
+		},
+	}.Run(t)
+}
+
+func TestReleaseAndBury(t *testing.T) {
+	address, tube := testTube(t)
+	queue := newTestBeanstalkd(t, address, tube)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPut(t, address, tube, map[string]interface{}{"id": "delayed"})
+	started := time.Now()
+	mustReceive(t, stream).Abort(1)
+
+	job := mustReceive(t, stream)
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	metadata := reprow.JobMetadata(job)
+	if metadata["Priority"] != uint32(100) || metadata["Releases"] != "1" {
+		t.Errorf("priority should be kept on release got=%v", metadata)
+	}
+	job.(reprow.Rejecter).Reject("invalid")
+
+	conn, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to connect e=%s", err.Error())
+	}
+	defer conn.Close()
+	stats, err := conn.StatsJob(metadata["Id"].(uint64))
+	if err != nil {
+		t.Fatalf("failed to get stats e=%s", err.Error())
+	}
+	if stats["state"] != "buried" {
+		t.Errorf("rejected job should be buried got=%s", stats["state"])
+	}
+}
+
+func TestTouch(t *testing.T) {
+	address, tube := testTube(t)
+	queue := newTestBeanstalkd(t, address, tube)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	// ttr of the job is 2 seconds
+	mustPut(t, address, tube, map[string]interface{}{"id": "long"})
+	job := mustReceive(t, stream)
+	time.Sleep(3 * time.Second)
+
+	conn, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to connect e=%s", err.Error())
+	}
+	defer conn.Close()
+	stats, err := conn.StatsJob(reprow.JobMetadata(job)["Id"].(uint64))
+	if err != nil {
+		t.Fatalf("failed to get stats e=%s", err.Error())
+	}
+	if stats["state"] != "reserved" || stats["timeouts"] != "0" {
+		t.Errorf("running job should be kept reserved got=%v", stats)
+	}
+	job.End()
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
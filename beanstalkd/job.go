@@ -0,0 +1,66 @@
+package beanstalkd
+
+import (
+	"github.com/kr/beanstalk"
+	"strconv"
+	"sync"
+)
+
+type Job struct {
+	payload  map[string]interface{}
+	id       uint64
+	stats    map[string]string
+	conn     *beanstalk.Conn
+	touching chan bool
+	mu       sync.Mutex
+	queue    *Beanstalkd
+	ready    chan bool
+}
+
+func (j *Job) Queue() *Beanstalkd {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns id, tube and stats of the job
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Id":       j.id,
+		"Tube":     j.stats["tube"],
+		"Priority": j.priority(),
+		"Reserves": j.stats["reserves"],
+		"Releases": j.stats["releases"],
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	j.ready <- j.payload != nil
+}
+
+// priority returns priority the job was put with. Default priority of beanstalkd is used when it is unknown
+func (j *Job) priority() uint32 {
+	pri, err := strconv.ParseUint(j.stats["pri"], 10, 32)
+	if err != nil {
+		return 1024
+	}
+	return uint32(pri)
+}
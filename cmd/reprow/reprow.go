@@ -1,16 +1,34 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/maedama/reprow"
+	_ "github.com/maedama/reprow/beanstalkd"
+	_ "github.com/maedama/reprow/cron"
 	_ "github.com/maedama/reprow/fifo"
 	_ "github.com/maedama/reprow/http_proxy"
+	_ "github.com/maedama/reprow/kafka"
+	_ "github.com/maedama/reprow/memory"
+	_ "github.com/maedama/reprow/mqtt"
+	_ "github.com/maedama/reprow/mysql"
+	_ "github.com/maedama/reprow/nats"
+	_ "github.com/maedama/reprow/postgres"
 	_ "github.com/maedama/reprow/q4m"
+	_ "github.com/maedama/reprow/redis"
+	_ "github.com/maedama/reprow/redis_streams"
+	_ "github.com/maedama/reprow/router"
+	_ "github.com/maedama/reprow/sidekiq"
+	_ "github.com/maedama/reprow/spool"
+	_ "github.com/maedama/reprow/sqlite"
 	_ "github.com/maedama/reprow/sqs"
+	_ "github.com/maedama/reprow/webhook"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 type CLIOptions struct {
@@ -52,6 +70,23 @@ func main() {
 		os.Exit(1)
 	}
 
-	exitCode := server.Run()
-	os.Exit(exitCode)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(
+			sigCh,
+			syscall.SIGHUP,
+			syscall.SIGINT,
+			syscall.SIGTERM,
+			syscall.SIGQUIT)
+		<-sigCh
+		cancel()
+	}()
+
+	err = server.Run(ctx)
+	if err != nil && err != context.Canceled {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
 }
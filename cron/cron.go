@@ -0,0 +1,339 @@
+// cron package implements scheduled jobs as reprow.Queue.
+// Each schedule emits a job with its static payload at every tick of its cron expression,
+// so that crontabs calling application can be replaced with runner with retries.
+//
+// A tick is skipped when the job of previous tick is still in flight, including while it is waiting for retry.
+// When lock_file or lock_dsn is given, only the process holding the lock fires schedules.
+// The lock is kept until the queue is stopped, and other processes try to take it over at each tick.
+package cron
+
+import (
+	"errors"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	robfig "github.com/robfig/cron/v3"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+func init() {
+	reprow.RegisterQueue("cron", &CronBuilder{})
+}
+
+type CronBuilder struct{}
+
+func (b *CronBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewCron(config, logger)
+}
+
+func NewCron(config map[string]interface{}, logger seelog.LoggerInterface) (*Cron, error) {
+	c := Cron{}
+	err := c.configure(config, logger)
+	return &c, err
+}
+
+// Cron implements scheduled jobs as reprow.Queue
+type Cron struct {
+	logger    seelog.LoggerInterface
+	config    Config
+	location  *time.Location
+	schedules []*schedule
+	lock      locker
+	mu        sync.Mutex
+	ready     []*Job
+	notify    chan bool
+	wantDown  chan bool
+	done      chan bool
+	wg        sync.WaitGroup
+}
+
+type Config struct {
+	Schedules []ScheduleConfig `valid:"-"`
+	TimeZone  string           `valid:"-" mapstructure:"time_zone"`
+	Jitter    string           `valid:"-"`
+	LockFile  string           `valid:"-" mapstructure:"lock_file"`
+	LockDsn   string           `valid:"-" mapstructure:"lock_dsn"`
+	LockName  string           `valid:"-" mapstructure:"lock_name"`
+}
+
+// ScheduleConfig is a schedule. Spec is a standard cron expression or descriptor such as @hourly and @every 10m.
+// Jitter overrides jitter of the queue.
+type ScheduleConfig struct {
+	Name    string                 `valid:"required"`
+	Spec    string                 `valid:"required"`
+	Payload map[string]interface{} `valid:"-"`
+	Jitter  string                 `valid:"-"`
+}
+
+type schedule struct {
+	name     string
+	schedule robfig.Schedule
+	payload  map[string]interface{}
+	jitter   time.Duration
+	inFlight bool
+}
+
+func (c *Cron) Start(outChannel chan reprow.Job) error {
+	if c.done != nil {
+		return errors.New("Start called twice")
+	} else {
+		c.wantDown = make(chan bool)
+		c.done = make(chan bool)
+		for _, s := range c.schedules {
+			c.wg.Add(1)
+			go c.tick(s)
+		}
+		go func() {
+			c.run(outChannel)
+			close(c.done)
+		}()
+		return nil
+	}
+}
+
+func (c *Cron) run(outChannel chan reprow.Job) {
+	for {
+		c.mu.Lock()
+		var job *Job
+		if len(c.ready) > 0 {
+			job = c.ready[0]
+		}
+		c.mu.Unlock()
+
+		if job != nil {
+			select {
+			case outChannel <- job:
+				c.mu.Lock()
+				// Only run loop removes jobs from ready, so head of ready is still the job
+				c.ready = c.ready[1:]
+				c.mu.Unlock()
+			case <-c.wantDown:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-c.notify:
+		case <-c.wantDown:
+			return
+		}
+	}
+}
+
+// tick fires schedule at each time it is activated until queue is stopped
+func (c *Cron) tick(s *schedule) {
+	defer c.wg.Done()
+	for {
+		now := time.Now().In(c.location)
+		next := s.schedule.Next(now)
+		if next.IsZero() {
+			c.logger.Errorf("reprow/cron: schedule will never be activated schedule=%s", s.name)
+			return
+		}
+		delay := next.Sub(now)
+		if s.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(s.jitter)))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			c.fire(s, next)
+		case <-c.wantDown:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (c *Cron) fire(s *schedule, scheduledAt time.Time) {
+	if c.lock != nil {
+		held, err := c.lock.acquire()
+		if err != nil {
+			c.logger.Errorf("reprow/cron: failed to acquire lock schedule=%s e=%s", s.name, err.Error())
+			return
+		}
+		if !held {
+			c.logger.Debugf("lock is held by another process schedule=%s", s.name)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.inFlight {
+		c.logger.Warnf("reprow/cron: previous run is still in flight. skipping schedule=%s", s.name)
+		return
+	}
+	s.inFlight = true
+	c.ready = append(c.ready, &Job{
+		payload:     normalize(s.payload).(map[string]interface{}),
+		schedule:    s,
+		scheduledAt: scheduledAt,
+		queue:       c,
+	})
+	c.wakeup()
+}
+
+func (c *Cron) Stop() error {
+	if c.done == nil {
+		return errors.New("not running")
+	} else {
+		close(c.wantDown)
+		c.wg.Wait()
+		<-c.done
+		c.done = nil
+		if c.lock != nil {
+			err := c.lock.release()
+			if err != nil {
+				c.logger.Errorf("reprow/cron: failed to release lock e=%s", err.Error())
+			}
+		}
+		return nil
+	}
+}
+
+// Abort fires the job again after retry after. Schedule is kept in flight until then
+func (c *Cron) Abort(job *Job, retryAfter int) {
+	requeued := &Job{
+		payload:     job.payload,
+		schedule:    job.schedule,
+		scheduledAt: job.scheduledAt,
+		attempts:    job.attempts + 1,
+		queue:       c,
+	}
+	time.AfterFunc(time.Duration(retryAfter)*time.Second, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ready = append(c.ready, requeued)
+		c.wakeup()
+	})
+}
+
+func (c *Cron) End(job *Job) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job.schedule.inFlight = false
+}
+
+func (c *Cron) Reject(job *Job, reason string) {
+	c.logger.Errorf("reprow/cron: job rejected schedule=%s reason=%s", job.schedule.name, reason)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job.schedule.inFlight = false
+}
+
+// wakeup notifies run loop that ready jobs have changed. It should be called with lock held.
+func (c *Cron) wakeup() {
+	select {
+	case c.notify <- true:
+	default:
+	}
+}
+
+func (c *Cron) configure(m map[string]interface{}, logger seelog.LoggerInterface) error {
+	c.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(m, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+	if len(config.Schedules) == 0 {
+		return errors.New("schedules is required")
+	}
+
+	c.location = time.Local
+	if config.TimeZone != "" {
+		c.location, err = time.LoadLocation(config.TimeZone)
+		if err != nil {
+			return errors.New("time_zone failed to load: " + err.Error())
+		}
+	}
+	jitter, err := reprow.ParseDuration(config.Jitter, "0s")
+	if err != nil {
+		return errors.New("jitter failed to parse: " + err.Error())
+	}
+
+	names := make(map[string]bool)
+	for _, sc := range config.Schedules {
+		_, err = govalidator.ValidateStruct(sc)
+		if err != nil {
+			return err
+		}
+		if names[sc.Name] {
+			return errors.New("schedule name is duplicated name=" + sc.Name)
+		}
+		names[sc.Name] = true
+
+		s := schedule{name: sc.Name, payload: sc.Payload}
+		s.schedule, err = robfig.ParseStandard(sc.Spec)
+		if err != nil {
+			return errors.New("spec failed to parse name=" + sc.Name + ": " + err.Error())
+		}
+		s.jitter, err = reprow.ParseDuration(sc.Jitter, jitter.String())
+		if err != nil {
+			return errors.New("jitter failed to parse name=" + sc.Name + ": " + err.Error())
+		}
+		if s.payload == nil {
+			s.payload = map[string]interface{}{}
+		}
+		c.schedules = append(c.schedules, &s)
+	}
+
+	if config.LockName == "" {
+		config.LockName = "reprow_cron"
+	}
+	switch {
+	case config.LockFile != "" && config.LockDsn != "":
+		return errors.New("only one of lock_file and lock_dsn can be given")
+	case config.LockFile != "":
+		c.lock = &fileLock{path: config.LockFile}
+	case config.LockDsn != "":
+		c.lock, err = newMySQLLock(config.LockDsn, config.LockName)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.config = config
+	c.notify = make(chan bool, 1)
+	return nil
+}
+
+// normalize converts maps decoded from yaml to map[string]interface{} so that payload can be encoded as json.
+// It always returns a copy so that runners modifying payload do not affect later runs.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = normalize(value)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if s, ok := key.(string); ok {
+				m[s] = normalize(value)
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, value := range v {
+			l[i] = normalize(value)
+		}
+		return l
+	default:
+		return v
+	}
+}
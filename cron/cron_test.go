@@ -0,0 +1,158 @@
+package cron
+
+import (
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func newTestCron(t *testing.T, config map[string]interface{}) *Cron {
+	c := map[string]interface{}{
+		"schedules": []interface{}{
+			map[interface{}]interface{}{
+				"name": "every",
+				"spec": "@every 1s",
+				"payload": map[interface{}]interface{}{
+					"path": "/tick",
+					"user": map[interface{}]interface{}{"id": 1},
+				},
+			},
+		},
+	}
+	for key, value := range config {
+		c[key] = value
+	}
+	queue, err := NewCron(c, logger)
+	if err != nil {
+		t.Fatalf("failed to make cron queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func TestStart(t *testing.T) {
+	queue := newTestCron(t, map[string]interface{}{"time_zone": "Asia/Tokyo"})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	if job.Payload()["path"] != "/tick" {
+		t.Errorf("static payload should be emitted got=%v", job.Payload())
+	}
+	if _, ok := job.Payload()["user"].(map[string]interface{}); !ok {
+		t.Errorf("nested payload should be normalized got=%T", job.Payload()["user"])
+	}
+	metadata := reprow.JobMetadata(job)
+	if metadata["Schedule"] != "every" || metadata["Attempts"] != 0 {
+		t.Errorf("metadata not match got=%v", metadata)
+	}
+	job.End()
+
+	job = mustReceive(t, stream)
+	job.End()
+}
+
+func TestSkipOverlap(t *testing.T) {
+	queue := newTestCron(t, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	select {
+	case <-stream:
+		t.Errorf("tick should be skipped while previous run is in flight")
+	case <-time.After(2500 * time.Millisecond):
+	}
+	job.End()
+	mustReceive(t, stream).End()
+}
+
+func TestAbortRetries(t *testing.T) {
+	queue := newTestCron(t, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	scheduledAt := reprow.JobMetadata(job)["ScheduledAt"]
+	job.Abort(2)
+
+	job = mustReceive(t, stream)
+	metadata := reprow.JobMetadata(job)
+	if metadata["Attempts"] != 1 || metadata["ScheduledAt"] != scheduledAt {
+		t.Errorf("aborted job should be retried before next tick got=%v", metadata)
+	}
+	job.End()
+}
+
+func TestLockFile(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "cron.lock")
+	first := newTestCron(t, map[string]interface{}{"lock_file": lockFile})
+	second := newTestCron(t, map[string]interface{}{"lock_file": lockFile})
+
+	firstStream := make(chan reprow.Job)
+	secondStream := make(chan reprow.Job)
+	first.Start(firstStream)
+	second.Start(secondStream)
+	defer second.Stop()
+
+	received := map[chan reprow.Job]int{}
+	deadline := time.After(3500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case job := <-firstStream:
+			received[firstStream]++
+			job.End()
+		case job := <-secondStream:
+			received[secondStream]++
+			job.End()
+		case <-deadline:
+			done = true
+		}
+	}
+	if received[firstStream] > 0 && received[secondStream] > 0 {
+		t.Errorf("only one process should fire schedules got=%d,%d", received[firstStream], received[secondStream])
+	}
+
+	// lock is taken over once the holder stops
+	var holder, other chan reprow.Job = firstStream, secondStream
+	if received[firstStream] == 0 {
+		holder, other = secondStream, firstStream
+	}
+	if holder == firstStream {
+		first.Stop()
+	} else {
+		second.Stop()
+		defer first.Stop()
+	}
+	mustReceive(t, other).End()
+}
+
+func TestConfigure(t *testing.T) {
+	_, err := NewCron(map[string]interface{}{
+		"schedules": []interface{}{map[string]interface{}{"name": "invalid", "spec": "* *"}},
+	}, logger)
+	if err == nil {
+		t.Errorf("invalid spec should be error")
+	}
+	_, err = NewCron(map[string]interface{}{}, logger)
+	if err == nil {
+		t.Errorf("schedules should be required")
+	}
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	select {
+	case job := <-stream:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout reading stream")
+	}
+	return nil
+}
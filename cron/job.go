@@ -0,0 +1,46 @@
+package cron
+
+import (
+	"time"
+)
+
+type Job struct {
+	payload     map[string]interface{}
+	schedule    *schedule
+	scheduledAt time.Time
+	attempts    int
+	queue       *Cron
+}
+
+func (j *Job) Queue() *Cron {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns name of the schedule, time of the tick and how many times the job was aborted
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Schedule":    j.schedule.name,
+		"ScheduledAt": j.scheduledAt,
+		"Attempts":    j.attempts,
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return true
+}
@@ -0,0 +1,111 @@
+package cron
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/go-sql-driver/mysql"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// locker is a lock shared among reprow processes. Once acquired, it is kept until released.
+type locker interface {
+	acquire() (bool, error)
+	release() error
+}
+
+// fileLock locks a file with flock, so it only works among processes on the same host
+type fileLock struct {
+	path string
+	file *os.File
+	mu   sync.Mutex
+}
+
+func (l *fileLock) acquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return false, nil
+	} else if err != nil {
+		file.Close()
+		return false, err
+	}
+	l.file = file
+	return true, nil
+}
+
+func (l *fileLock) release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	defer func() { l.file = nil }()
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	return err
+}
+
+// mysqlLock locks with GET_LOCK. The lock belongs to the connection, so the connection is kept while lock is held
+// and the lock is lost when the connection is.
+type mysqlLock struct {
+	db   *sql.DB
+	name string
+	conn *sql.Conn
+	mu   sync.Mutex
+}
+
+func newMySQLLock(dsn string, name string) (*mysqlLock, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlLock{db: db, name: name}, nil
+}
+
+func (l *mysqlLock) acquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ctx := context.Background()
+
+	if l.conn == nil {
+		conn, err := l.db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		l.conn = conn
+	}
+
+	// GET_LOCK is not called when the lock is already held by this connection, as it would nest the lock
+	var held sql.NullInt64
+	err := l.conn.QueryRowContext(ctx, "SELECT IF(IS_USED_LOCK(?) = CONNECTION_ID(), 1, GET_LOCK(?, 0))", l.name, l.name).Scan(&held)
+	if err != nil {
+		l.conn.Close()
+		l.conn = nil
+		return false, err
+	}
+	return held.Valid && held.Int64 == 1, nil
+}
+
+func (l *mysqlLock) release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	defer func() { l.conn = nil }()
+	_, err := l.conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", l.name)
+	l.conn.Close()
+	return err
+}
@@ -0,0 +1,13 @@
+package reprow
+
+import (
+	"time"
+)
+
+// ParseDuration parses duration in config such as "1s", using defaultValue when s is empty
+func ParseDuration(s string, defaultValue string) (time.Duration, error) {
+	if s == "" {
+		s = defaultValue
+	}
+	return time.ParseDuration(s)
+}
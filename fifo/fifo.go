@@ -1,21 +1,33 @@
 // Fifo package implements queue as linux named pipe.
 // Such an fifo can be created as follows(Depends on environment)
+//
 //	mkfifo /tmp/queue
-// This is a feature mainly targeted for development, because when ever the host machine goes down, all queue might get lost
+//
+// Each line written to the pipe is a json encoded payload.
+//
+// The pipe is read directly while the queue holds its own write end open, so writers can come and go
+// without the reader seeing EOF.
+// Aborted jobs are requeued in process after retry after.
+// Payloads read from the pipe are journaled to a sidecar file until their jobs are ended, and replayed on startup,
+// so jobs are not lost when reprow is restarted. Still, this is a feature mainly targeted for development,
+// because the journal is not synced and when ever the host machine goes down, queue might get lost.
 package fifo
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/ActiveState/tail"
 	"github.com/asaskevich/govalidator"
 	"github.com/cihub/seelog"
 	"github.com/maedama/reprow"
 	"github.com/mitchellh/mapstructure"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 func init() {
@@ -34,15 +46,28 @@ func NewFifo(config map[string]interface{}, logger seelog.LoggerInterface) (*Fif
 	return &fifo, err
 }
 
+// Fifo implements named pipe as reprow.Queue.
+// The pipe is read from when it is created until Close is called, regardless of whether it is started.
 type Fifo struct {
-	logger   seelog.LoggerInterface
-	config   Config
-	wantDown chan bool
-	done     chan bool
+	logger     seelog.LoggerInterface
+	config     Config
+	journal    *journal
+	lines      chan *Job
+	mu         sync.Mutex
+	ready      []*Job
+	file       *os.File
+	keepalive  *os.File
+	reads      uint64
+	notify     chan bool
+	closing    chan bool
+	readerDone chan bool
+	wantDown   chan bool
+	done       chan bool
 }
 
 type Config struct {
-	Path string `valid:"string,required"`
+	Path    string `valid:"required"`
+	Journal string `valid:"-"`
 }
 
 func (f *Fifo) Start(outChannel chan reprow.Job) error {
@@ -53,32 +78,99 @@ func (f *Fifo) Start(outChannel chan reprow.Job) error {
 		f.done = make(chan bool)
 		go func() {
 			f.run(outChannel)
-			f.done <- true
+			close(f.done)
 		}()
 		return nil
 	}
 }
 
 func (f *Fifo) run(outChannel chan reprow.Job) {
-	t, err := tail.TailFile(f.config.Path, tail.Config{Follow: true})
-	if err != nil {
-		panic("failed to tail file")
-	}
-	go func() {
-		<-f.wantDown
-		close(t.Lines)
-	}()
+	for {
+		// Requeued jobs are preferred to new lines
+		f.mu.Lock()
+		var job *Job
+		if len(f.ready) > 0 {
+			job = f.ready[0]
+			f.ready = f.ready[1:]
+		}
+		f.mu.Unlock()
 
-	for line := range t.Lines {
-		job := Job{
-			queue: f,
+		if job == nil {
+			select {
+			case job = <-f.lines:
+			case <-f.notify:
+				continue
+			case <-f.wantDown:
+				return
+			}
 		}
-		err := json.Unmarshal([]byte(line.Text), &job.payload)
+
+		select {
+		case outChannel <- job:
+		case <-f.wantDown:
+			f.mu.Lock()
+			f.ready = append([]*Job{job}, f.ready...)
+			f.mu.Unlock()
+			return
+		}
+	}
+}
+
+// read reads lines from the pipe until Close is called.
+// Reads block until data arrives as the write end held by the queue keeps the pipe from reaching EOF.
+func (f *Fifo) read() {
+	defer close(f.readerDone)
+	reader := bufio.NewReader(f.file)
+	var partial []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		atomic.AddUint64(&f.reads, 1)
+		// Line written without newline is kept, as rest of the line might be written by next writer
+		partial = append(partial, line...)
 		if err != nil {
-			f.logger.Errorf("failed to deserialize queue. skipping queue=%s err=%s", line.Text, err.Error())
-		} else {
-			outChannel <- &job
+			select {
+			case <-f.closing:
+				return
+			default:
+			}
+			f.logger.Errorf("reprow/fifo: failed to read fifo e=%s", err.Error())
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-f.closing:
+				return
+			}
+		}
+		if !f.handle(partial) {
+			return
 		}
+		partial = nil
+	}
+}
+
+// handle passes job of line to run loop. false is returned when the queue is closed
+func (f *Fifo) handle(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return true
+	}
+	job := Job{queue: f}
+	err := json.Unmarshal(line, &job.payload)
+	if err != nil {
+		f.logger.Errorf("failed to deserialize queue. skipping queue=%s err=%s", line, err.Error())
+		return true
+	}
+	job.id, err = f.journal.add(line)
+	if err != nil {
+		f.logger.Errorf("reprow/fifo: failed to journal e=%s", err.Error())
+	}
+
+	select {
+	case f.lines <- &job:
+		return true
+	case <-f.closing:
+		// journaled job is replayed on next startup
+		return false
 	}
 }
 
@@ -86,62 +178,94 @@ func (f *Fifo) Stop() error {
 	if f.done == nil {
 		return errors.New("not running")
 	} else {
-		f.wantDown <- true
+		close(f.wantDown)
 		<-f.done
+		f.done = nil
 		return nil
 	}
 }
 
-func (f *Fifo) openFifo() error {
+// Close stops reading the pipe. Jobs not yet ended are replayed when the queue is made again
+func (f *Fifo) Close() error {
+	close(f.closing)
+	// closing the file interrupts read blocked in poller
+	f.file.Close()
+	<-f.readerDone
+	f.keepalive.Close()
+	return f.journal.close()
+}
 
+// openFifo opens reading end of the pipe, and a write end kept open so that reading never sees EOF
+func (f *Fifo) openFifo() error {
+	// Opened without blocking for a writer, and read through poller so that Close can interrupt reading
 	file, err := os.OpenFile(f.config.Path, syscall.O_RDONLY|syscall.O_NONBLOCK, 0644)
-	defer file.Close()
 	if err != nil {
 		return err
 	}
 
 	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return err
 	}
 
 	if stat.Mode()&os.ModeNamedPipe == 0 {
+		file.Close()
 		return errors.New("file is not a named pipe. use mkfifo to make file")
 	}
-	return nil
-}
-
-func (f *Fifo) Abort(job *Job) {
-	fifo_w, err := os.OpenFile(f.config.Path, syscall.O_WRONLY|syscall.O_NONBLOCK, 0644)
 
+	// Opening write end without blocking succeeds as the reading end is already open
+	keepalive, err := os.OpenFile(f.config.Path, syscall.O_WRONLY|syscall.O_NONBLOCK, 0644)
 	if err != nil {
-		f.logger.Errorf("Failed to open file e=%s", err.Error())
+		file.Close()
+		return err
 	}
-	w := bufio.NewWriter(fifo_w)
-	jsonText, err := json.Marshal(job)
-	if err != nil {
-		f.logger.Errorf("Failed to serialize to json e=%s", err.Error())
-	} else {
-		_, err := w.Write(jsonText)
-		if err != nil {
-			f.logger.Errorf("Failed to write json e=%s", err.Error())
-		}
-
-		_, err = w.WriteString("\n")
-		if err != nil {
-			f.logger.Errorf("Failed to write e=%s", err.Error())
-		}
+	f.file = file
+	f.keepalive = keepalive
+	return nil
+}
 
-		err = w.Flush()
-		if err != nil {
-			f.logger.Errorf("Failed to flush  e=%s", err.Error())
-		}
+// Abort requeues job after retry after. The job stays in the journal until then
+func (f *Fifo) Abort(job *Job, retryAfter int) {
+	requeued := &Job{
+		payload:  job.payload,
+		id:       job.id,
+		attempts: job.attempts + 1,
+		queue:    f,
 	}
+	time.AfterFunc(time.Duration(retryAfter)*time.Second, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.ready = append(f.ready, requeued)
+		f.wakeup()
+	})
 }
 
 func (f *Fifo) End(j *Job) {
 	jsonText, _ := json.Marshal(j.payload)
 	f.logger.Debugf("end job payload=%s", jsonText)
+	f.finish(j)
+}
+
+func (f *Fifo) Reject(j *Job, reason string) {
+	jsonText, _ := json.Marshal(j.payload)
+	f.logger.Errorf("reprow/fifo: job rejected payload=%s reason=%s", jsonText, reason)
+	f.finish(j)
+}
+
+func (f *Fifo) finish(j *Job) {
+	err := f.journal.remove(j.id)
+	if err != nil {
+		f.logger.Errorf("reprow/fifo: failed to journal e=%s", err.Error())
+	}
+}
+
+// wakeup notifies run loop that ready jobs have changed. It should be called with lock held.
+func (f *Fifo) wakeup() {
+	select {
+	case f.notify <- true:
+	default:
+	}
 }
 
 func (f *Fifo) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
@@ -156,11 +280,40 @@ func (f *Fifo) configure(c map[string]interface{}, logger seelog.LoggerInterface
 	if err != nil {
 		return err
 	}
+	if config.Journal == "" {
+		config.Journal = config.Path + ".journal"
+	}
 	f.config = config
 
+	var replayed []journalEntry
+	f.journal, replayed, err = openJournal(config.Journal)
+	if err != nil {
+		return errors.New("failed to open journal: " + err.Error())
+	}
+
 	err = f.openFifo()
 	if err != nil {
+		f.journal.close()
 		return errors.New(fmt.Sprintf("fifo with path %s invalid by %s", f.config.Path, err.Error()))
 	}
+	for _, entry := range replayed {
+		job := Job{id: entry.id, queue: f}
+		err := json.Unmarshal(entry.line, &job.payload)
+		if err != nil {
+			f.logger.Errorf("reprow/fifo: failed to deserialize journaled job. skipping e=%s", err.Error())
+			f.journal.remove(entry.id)
+			continue
+		}
+		f.ready = append(f.ready, &job)
+	}
+	if len(f.ready) > 0 {
+		f.logger.Infof("replayed journaled jobs count=%d", len(f.ready))
+	}
+
+	f.lines = make(chan *Job)
+	f.notify = make(chan bool, 1)
+	f.closing = make(chan bool)
+	f.readerDone = make(chan bool)
+	go f.read()
 	return nil
 }
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"github.com/cihub/seelog"
 	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -48,11 +51,11 @@ func TestStart(t *testing.T) {
 	}
 	err = ioutil.WriteFile(fifoPath, bytes, 0644)
 	if err != nil {
-		t.Fatalf("unable to write file e=" + err.Error())
+		t.Fatalf("unable to write file e=%s", err.Error())
 	}
 	err = ioutil.WriteFile(fifoPath, []byte("\n"), 0644)
 	if err != nil {
-		t.Fatalf("unable to write file e=" + err.Error())
+		t.Fatalf("unable to write file e=%s", err.Error())
 	}
 
 	select {
@@ -66,6 +69,189 @@ func TestStart(t *testing.T) {
 
 }
 
+func newTestFifo(t *testing.T, fifoPath string) *Fifo {
+	queue, err := NewFifo(map[string]interface{}{
+		"path": fifoPath,
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make fifo queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func mkfifo(t *testing.T) string {
+	fifoPath := filepath.Join(t.TempDir(), "queue")
+	err := syscall.Mkfifo(fifoPath, syscall.S_IFIFO|0666)
+	if err != nil {
+		t.Skip("skipping test because it failed to create fifo")
+	}
+	return fifoPath
+}
+
+func mustWrite(t *testing.T, fifoPath string, payload map[string]interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("unable to marshal %s", err.Error())
+	}
+	err = ioutil.WriteFile(fifoPath, append(b, '\n'), 0644)
+	if err != nil {
+		t.Fatalf("unable to write file e=%s", err.Error())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			queue := newTestFifo(t, mkfifo(t))
+			t.Cleanup(func() { queue.Close() })
+			return queue
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustWrite(t, queue.(*Fifo).config.Path, payload)
+		},
+	}.Run(t)
+}
+
+func TestRetryAfter(t *testing.T) {
+	fifoPath := mkfifo(t)
+	queue := newTestFifo(t, fifoPath)
+	defer queue.Close()
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustWrite(t, fifoPath, map[string]interface{}{"id": "delayed"})
+	started := time.Now()
+	mustReceive(t, stream).Abort(1)
+
+	job := mustReceive(t, stream)
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	if job.Payload()["id"] != "delayed" || reprow.JobMetadata(job)["Attempts"] != 1 {
+		t.Errorf("aborted job should be redelivered got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func TestJournalReplay(t *testing.T) {
+	fifoPath := mkfifo(t)
+	queue := newTestFifo(t, fifoPath)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+
+	mustWrite(t, fifoPath, map[string]interface{}{"id": "ended"})
+	mustWrite(t, fifoPath, map[string]interface{}{"id": "running"})
+	mustReceive(t, stream).End()
+	mustReceive(t, stream)
+	// process exits while the job is running
+	queue.Stop()
+	queue.Close()
+
+	queue = newTestFifo(t, fifoPath)
+	defer queue.Close()
+	stream = make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "running" {
+		t.Errorf("running job should be replayed got=%v", job.Payload())
+	}
+	job.End()
+	select {
+	case job := <-stream:
+		t.Errorf("ended job should not be replayed got=%v", job.Payload())
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if stat, err := os.Stat(fifoPath + ".journal"); err != nil || stat.Size() != 0 {
+		t.Errorf("journal should be truncated when no job is left")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	fifoPath := mkfifo(t)
+	queue := newTestFifo(t, fifoPath)
+	defer queue.Close()
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	// Line is split between writers
+	ioutil.WriteFile(fifoPath, []byte(`{"id":`), 0644)
+	ioutil.WriteFile(fifoPath, []byte(`"split"}`+"\n"), 0644)
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "split" {
+		t.Errorf("line written by multiple writers should be read got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func TestIdle(t *testing.T) {
+	fifoPath := mkfifo(t)
+	queue := newTestFifo(t, fifoPath)
+	defer queue.Close()
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	// pipe is left without writers before and after a writer comes and goes
+	time.Sleep(200 * time.Millisecond)
+	mustWrite(t, fifoPath, map[string]interface{}{"id": "idle"})
+	mustReceive(t, stream).End()
+	before := atomic.LoadUint64(&queue.reads)
+	time.Sleep(500 * time.Millisecond)
+	if reads := atomic.LoadUint64(&queue.reads) - before; reads > 2 {
+		t.Errorf("idle pipe should not be read repeatedly reads=%d", reads)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	defer func(threshold int) { compactThreshold = threshold }(compactThreshold)
+	compactThreshold = 10
+
+	path := filepath.Join(t.TempDir(), "queue.journal")
+	j, _, err := openJournal(path)
+	if err != nil {
+		t.Fatalf("failed to open journal e=%s", err.Error())
+	}
+
+	running, _ := j.add([]byte(`{"id":"running"}`))
+	for i := 0; i < 100; i++ {
+		id, err := j.add([]byte(`{"id":"ended"}`))
+		if err == nil {
+			err = j.remove(id)
+		}
+		if err != nil {
+			t.Fatalf("failed to journal e=%s", err.Error())
+		}
+	}
+	if j.records > 2*compactThreshold {
+		t.Errorf("journal should be compacted while a job is running records=%d", j.records)
+	}
+
+	j.close()
+	j, entries, err := openJournal(path)
+	if err != nil {
+		t.Fatalf("failed to open journal e=%s", err.Error())
+	}
+	defer j.close()
+	if len(entries) != 1 || entries[0].id != running {
+		t.Errorf("compacted journal should keep running job got=%v", entries)
+	}
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	select {
+	case job := <-stream:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout reading stream")
+	}
+	return nil
+}
+
 // This might return filename that exists. But It should not matter very much
 func tempnam() string {
 	b := make([]byte, 8)
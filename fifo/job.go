@@ -1,8 +1,10 @@
 package fifo
 
 type Job struct {
-	payload map[string]interface{}
-	queue   *Fifo
+	payload  map[string]interface{}
+	id       uint64
+	attempts int
+	queue    *Fifo
 }
 
 func (j *Job) Queue() *Fifo {
@@ -13,17 +15,25 @@ func (j *Job) Payload() map[string]interface{} {
 	return j.payload
 }
 
-func (j *Job) Abort(retryAfter int) {
-	if retryAfter > 0 {
-		j.queue.logger.Errorf("Retry after is not supported for this queue backend")
+// Metadata returns how many times the job was aborted
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Attempts": j.attempts,
 	}
-	j.queue.Abort(j)
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
 }
 
 func (j *Job) End() {
 	j.queue.End(j)
 }
 
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
 func (j *Job) WaitFinalize() bool {
 	return true
 }
@@ -0,0 +1,162 @@
+package fifo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// journal records lines read from the pipe until their jobs are finished.
+// A line is recorded as "+<id> <line>" and its removal as "-<id>".
+// The file is compacted on open and whenever removed records outnumber live ones,
+// and truncated whenever no job is left.
+type journal struct {
+	path    string
+	file    *os.File
+	live    map[uint64][]byte
+	records int
+	seq     uint64
+	mu      sync.Mutex
+}
+
+// compactThreshold is number of records below which journal is not compacted while running
+var compactThreshold = 1024
+
+type journalEntry struct {
+	id   uint64
+	line []byte
+}
+
+// openJournal opens journal at path and returns entries not yet removed in order they were added
+func openJournal(path string) (*journal, []journalEntry, error) {
+	j := &journal{path: path, live: make(map[uint64][]byte)}
+	entries, err := j.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = j.compact(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	return j, entries, nil
+}
+
+func (j *journal) replay() ([]journalEntry, error) {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make(map[uint64][]byte)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		record := scanner.Bytes()
+		if len(record) < 2 {
+			continue
+		}
+		fields := bytes.SplitN(record[1:], []byte(" "), 2)
+		id, err := strconv.ParseUint(string(fields[0]), 10, 64)
+		if err != nil {
+			// partially written record left by a crash
+			continue
+		}
+		if id > j.seq {
+			j.seq = id
+		}
+		switch {
+		case record[0] == '+' && len(fields) == 2:
+			lines[id] = append([]byte{}, fields[1]...)
+		case record[0] == '-':
+			delete(lines, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+	for id, line := range lines {
+		entries = append(entries, journalEntry{id: id, line: line})
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].id < entries[b].id })
+	return entries, nil
+}
+
+// compact rewrites journal only with entries, and opens it for appending
+func (j *journal) compact(entries []journalEntry) error {
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "+%d %s\n", entry.id, entry.line)
+		j.live[entry.id] = entry.line
+	}
+	j.records = len(entries)
+	err = w.Flush()
+	file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, j.path)
+	if err != nil {
+		return err
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// add records line and returns its id
+func (j *journal) add(line []byte) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	j.live[j.seq] = append([]byte{}, line...)
+	j.records++
+	_, err := fmt.Fprintf(j.file, "+%d %s\n", j.seq, line)
+	return j.seq, err
+}
+
+func (j *journal) remove(id uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.live[id]; !ok {
+		return nil
+	}
+	delete(j.live, id)
+	if len(j.live) == 0 {
+		j.records = 0
+		return j.file.Truncate(0)
+	}
+	if j.records > compactThreshold && j.records > 2*len(j.live) {
+		entries := make([]journalEntry, 0, len(j.live))
+		for id, line := range j.live {
+			entries = append(entries, journalEntry{id: id, line: line})
+		}
+		sort.Slice(entries, func(a, b int) bool { return entries[a].id < entries[b].id })
+		return j.compact(entries)
+	}
+	j.records++
+	_, err := fmt.Fprintf(j.file, "-%d\n", id)
+	return err
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
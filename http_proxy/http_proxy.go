@@ -1,7 +1,6 @@
 package http_proxy
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/asaskevich/govalidator"
 	"github.com/cihub/seelog"
@@ -32,27 +31,35 @@ type HttpProxy struct {
 	logger  seelog.LoggerInterface
 	config  Config
 	timeout time.Duration
+	mapping *requestMapping
 }
 
 type Config struct {
-	Url               string `valid:"requri,required"`
-	Concurrency       int    `valid:"int,required"`
-	Timeout           string `valid:"required"`
-	DefaultRetryAfter int    `valid:"int" mapstructure:"default_retry_after"`
+	Url               string            `valid:"requri,required"`
+	Concurrency       int               `valid:"int,required"`
+	Timeout           string            `valid:"required"`
+	DefaultRetryAfter int               `valid:"int" mapstructure:"default_retry_after"`
+	Method            string            `valid:"-"`
+	Path              string            `valid:"-"`
+	Query             map[string]string `valid:"-"`
+	Headers           map[string]string `valid:"-"`
+	Body              BodyConfig        `valid:"-"`
 }
 
 func (h *HttpProxy) MaximumConcurrency() int { return h.config.Concurrency }
 
 func (h *HttpProxy) Run(job reprow.Job) error {
-	byte, _ := json.Marshal(job.Payload())
-	resp, _, err := gorequest.New().Post(h.config.Url).
-		Timeout(h.timeout).
-		Set("Authorization", "Bearer Test").
-		Send(string(byte)).
-		End()
-
+	req, err := h.mapping.build(job.Payload())
 	if err != nil {
-		h.logger.Errorf("backend response not retrieved:%s", err)
+		h.logger.Errorf("failed to build request from payload. rejecting job e=%s", err.Error())
+		reprow.RejectJob(job, "failed to build request: "+err.Error())
+		return err
+	}
+
+	resp, _, errs := h.newAgent(req).End()
+
+	if errs != nil {
+		h.logger.Errorf("backend response not retrieved:%s", errs)
 		job.Abort(h.config.DefaultRetryAfter)
 		return errors.New("backend response not retrieved")
 	} else {
@@ -82,6 +89,46 @@ func (h *HttpProxy) Run(job reprow.Job) error {
 	}
 }
 
+func (h *HttpProxy) newAgent(req *request) *gorequest.SuperAgent {
+	agent := gorequest.New()
+	switch req.method {
+	case "GET":
+		agent.Get(req.url)
+	case "PUT":
+		agent.Put(req.url)
+	case "PATCH":
+		agent.Patch(req.url)
+	case "DELETE":
+		agent.Delete(req.url)
+	case "HEAD":
+		agent.Head(req.url)
+	default:
+		agent.Post(req.url)
+	}
+
+	agent.Timeout(h.timeout).
+		Set("Authorization", "Bearer Test")
+
+	switch req.encoding {
+	case "form":
+		agent.Type("form").Send(req.body)
+	case "raw":
+		// Raw body should be sent as is, even when it looks like json or form
+		agent.BounceToRawString = true
+		agent.Type("text").Send(req.body)
+	default:
+		agent.Type("json").Send(req.body)
+	}
+
+	if len(req.query) > 0 {
+		agent.Query(req.query.Encode())
+	}
+	for name, value := range req.headers {
+		agent.Set(name, value)
+	}
+	return agent
+}
+
 func (h *HttpProxy) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
 	h.logger = logger
 	var config Config
@@ -100,6 +147,11 @@ func (h *HttpProxy) configure(c map[string]interface{}, logger seelog.LoggerInte
 		return errors.New("timeout failed to parse: " + err.Error())
 	}
 
+	h.mapping, err = newRequestMapping(config)
+	if err != nil {
+		return err
+	}
+
 	h.config = config
 	return nil
 }
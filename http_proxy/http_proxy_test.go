@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 type TestJob struct {
@@ -44,13 +45,13 @@ func testRunProxyPayload(t *testing.T) {
 		"default_retry_after": 1,
 	}, logger)
 	if err != nil {
-		t.Fatalf("backed not configured e=" + err.Error())
+		t.Fatalf("backed not configured e=%s", err.Error())
 	}
 	job := TestJob{}
 	go func() {
 		err = runner.Run(&job)
 		if err != nil {
-			t.Fatalf(err.Error())
+			t.Errorf("failed to run job e=%s", err.Error())
 		}
 	}()
 	req := <-reqCh
@@ -79,22 +80,25 @@ func testRunResponseHandling(t *testing.T) {
 			"default_retry_after": 1,
 		}, logger)
 		if err != nil {
-			t.Fatalf("backed not configured e=" + err.Error())
+			t.Errorf("backed not configured e=%s", err.Error())
+			return
 		}
 
 		job := TestJob{}
 		err = runner.Run(&job)
 		if err != nil {
-			t.Fatalf(err.Error())
+			t.Errorf("failed to run job e=%s", err.Error())
+			return
 		}
 		if job.status != "completed" {
-			t.Fatalf("Job not completed")
+			t.Errorf("Job not completed")
 		}
 
 	}()
 
 	go func() {
 		ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusInternalServerError)
 			rw.Write([]byte("HTTP/1.0 500 OK\r\nConnection: close\r\n\r\nHello."))
 		}))
 		defer ts.Close()
@@ -105,17 +109,94 @@ func testRunResponseHandling(t *testing.T) {
 			"default_retry_after": 1,
 		}, logger)
 		if err != nil {
-			t.Fatalf("backed not configured e=" + err.Error())
+			t.Errorf("backed not configured e=%s", err.Error())
+			return
 		}
 
 		job := TestJob{}
-		err = runner.Run(&job)
-		if err != nil {
-			t.Fatalf(err.Error())
-		}
+		// error is returned for status other than 200
+		runner.Run(&job)
 		if job.status != "aborted" {
-			t.Fatalf("Job not completed")
+			t.Errorf("Job not completed")
 		}
 	}()
 
 }
+
+func TestRunResponseStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		expect string
+	}{
+		{http.StatusOK, "completed"},
+		{http.StatusInternalServerError, "aborted"},
+	}
+	for _, c := range cases {
+		ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(c.status)
+			rw.Write([]byte("Hello."))
+		}))
+		runner, err := NewRunner(map[string]interface{}{
+			"url":                 ts.URL,
+			"concurrency":         1,
+			"timeout":             "1s",
+			"default_retry_after": 1,
+		}, logger)
+		if err != nil {
+			t.Fatalf("backed not configured e=%s", err.Error())
+		}
+
+		job := TestJob{}
+		err = runner.Run(&job)
+		if (err == nil) != (c.status == http.StatusOK) {
+			t.Errorf("run result does not match status=%d e=%v", c.status, err)
+		}
+		if job.status != c.expect {
+			t.Errorf("job status does not match status=%d got=%s expect=%s", c.status, job.status, c.expect)
+		}
+		ts.Close()
+	}
+}
+
+func TestNewAgentBody(t *testing.T) {
+	type received struct {
+		method      string
+		contentType string
+		body        string
+	}
+	receivedCh := make(chan received, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		receivedCh <- received{req.Method, req.Header.Get("Content-Type"), string(body)}
+	}))
+	defer ts.Close()
+
+	h := &HttpProxy{timeout: time.Second}
+	cases := []struct {
+		req         request
+		contentType string
+		body        string
+	}{
+		{request{method: "POST", encoding: "json", body: `{"id":1}`}, "application/json", `{"id":1}`},
+		{request{method: "PUT", encoding: "form", body: "id=1&name=foo+bar"}, "application/x-www-form-urlencoded", "id=1&name=foo+bar"},
+		// raw body is sent as is even when it looks like json
+		{request{method: "PATCH", encoding: "raw", body: `{"id": 1}`}, "text/plain", `{"id": 1}`},
+	}
+	for _, c := range cases {
+		c.req.url = ts.URL
+		_, _, errs := h.newAgent(&c.req).End()
+		if errs != nil {
+			t.Fatalf("failed to send request errs=%v", errs)
+		}
+		got := <-receivedCh
+		if got.method != c.req.method {
+			t.Errorf("method does not match encoding=%s got=%s", c.req.encoding, got.method)
+		}
+		if got.contentType != c.contentType {
+			t.Errorf("content type does not match encoding=%s got=%s expect=%s", c.req.encoding, got.contentType, c.contentType)
+		}
+		if got.body != c.body {
+			t.Errorf("body does not match encoding=%s got=%s expect=%s", c.req.encoding, got.body, c.body)
+		}
+	}
+}
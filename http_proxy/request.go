@@ -0,0 +1,238 @@
+package http_proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/maedama/reprow"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+var (
+	methods   = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"}
+	encodings = []string{"json", "form", "raw"}
+
+	templateFuncs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"pathescape": url.PathEscape,
+	}
+)
+
+// BodyConfig describes how request body is made from payload.
+// Field is dot separated path of payload field used as body. Whole payload is used when it is empty.
+type BodyConfig struct {
+	Encoding string `mapstructure:"encoding"`
+	Field    string `mapstructure:"field"`
+}
+
+// request is http request made from a job payload
+type request struct {
+	method   string
+	url      string
+	query    url.Values
+	headers  map[string]string
+	encoding string
+	body     string
+}
+
+// requestMapping builds requests from payloads.
+// Path, query and headers are go templates (text/template) executed with payload as data.
+// Method is a template too when it contains "{{", and is checked when request is built.
+type requestMapping struct {
+	method         string
+	methodTemplate *template.Template
+	url            string
+	path           *template.Template
+	query          map[string]*template.Template
+	headers        map[string]*template.Template
+	body           BodyConfig
+}
+
+func newRequestMapping(config Config) (*requestMapping, error) {
+	m := &requestMapping{
+		method:  strings.ToUpper(config.Method),
+		url:     config.Url,
+		query:   make(map[string]*template.Template),
+		headers: make(map[string]*template.Template),
+		body:    config.Body,
+	}
+
+	var err error
+	if m.method == "" {
+		m.method = "POST"
+	}
+	if strings.Contains(config.Method, "{{") {
+		// config.Method is used as upper casing would break template
+		m.methodTemplate, err = parseTemplate("method", config.Method)
+		if err != nil {
+			return nil, err
+		}
+	} else if !contains(methods, m.method) {
+		return nil, errors.New("unsupported method " + m.method)
+	}
+
+	if m.body.Encoding == "" {
+		m.body.Encoding = "json"
+	}
+	if !contains(encodings, m.body.Encoding) {
+		return nil, errors.New("unsupported body encoding " + m.body.Encoding)
+	}
+
+	m.path, err = parseTemplate("path", config.Path)
+	if err != nil {
+		return nil, err
+	}
+	for name, text := range config.Query {
+		m.query[name], err = parseTemplate("query "+name, text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name, text := range config.Headers {
+		m.headers[name], err = parseTemplate("header "+name, text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *requestMapping) build(payload map[string]interface{}) (*request, error) {
+	path, err := execute(m.path, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	method := m.method
+	if m.methodTemplate != nil {
+		method, err = execute(m.methodTemplate, payload)
+		if err != nil {
+			return nil, err
+		}
+		method = strings.ToUpper(method)
+		if !contains(methods, method) {
+			return nil, errors.New("unsupported method " + method)
+		}
+	}
+
+	req := &request{
+		method:   method,
+		url:      m.url + path,
+		query:    url.Values{},
+		headers:  make(map[string]string),
+		encoding: m.body.Encoding,
+	}
+
+	for name, t := range m.query {
+		value, err := execute(t, payload)
+		if err != nil {
+			return nil, err
+		}
+		req.query.Set(name, value)
+	}
+	for name, t := range m.headers {
+		req.headers[name], err = execute(t, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var body interface{} = payload
+	if m.body.Field != "" {
+		var found bool
+		body, found = reprow.LookupField(payload, m.body.Field)
+		if !found {
+			return nil, errors.New("body field not found field=" + m.body.Field)
+		}
+	}
+
+	switch m.body.Encoding {
+	case "json":
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		req.body = string(b)
+	case "form":
+		fields, ok := body.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("form body must be an object")
+		}
+		req.body = formEncode(fields)
+	case "raw":
+		switch v := body.(type) {
+		case string:
+			req.body = v
+		case []byte:
+			req.body = string(v)
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			req.body = string(b)
+		}
+	}
+	return req, nil
+}
+
+func formEncode(fields map[string]interface{}) string {
+	values := url.Values{}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		switch v := fields[k].(type) {
+		case nil:
+			values.Add(k, "")
+		case string:
+			values.Add(k, v)
+		case []interface{}:
+			for _, e := range v {
+				values.Add(k, fmt.Sprint(e))
+			}
+		case map[string]interface{}:
+			b, _ := json.Marshal(v)
+			values.Add(k, string(b))
+		default:
+			values.Add(k, fmt.Sprint(v))
+		}
+	}
+	return values.Encode()
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to parse %s template e=%s", name, err.Error()))
+	}
+	return t, nil
+}
+
+func execute(t *template.Template, payload map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, payload)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
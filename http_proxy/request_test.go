@@ -0,0 +1,122 @@
+package http_proxy
+
+import (
+	"testing"
+)
+
+func TestRequestMapping(t *testing.T) {
+	mapping, err := newRequestMapping(Config{
+		Url:    "http://127.0.0.1:5000",
+		Method: "put",
+		Path:   "/users/{{.user.id}}/sync",
+		Query: map[string]string{
+			"source": "{{.source}}",
+		},
+		Headers: map[string]string{
+			"X-Request-Id": "{{.request_id}}",
+		},
+		Body: BodyConfig{
+			Encoding: "form",
+			Field:    "user",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to make mapping e=%s", err.Error())
+	}
+
+	req, err := mapping.build(map[string]interface{}{
+		"source":     "batch",
+		"request_id": "abc",
+		"user": map[string]interface{}{
+			"id":   10,
+			"name": "foo bar",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to build request e=%s", err.Error())
+	}
+
+	if req.method != "PUT" {
+		t.Errorf("method not match got=%s", req.method)
+	}
+	if req.url != "http://127.0.0.1:5000/users/10/sync" {
+		t.Errorf("url not match got=%s", req.url)
+	}
+	if req.query.Encode() != "source=batch" {
+		t.Errorf("query not match got=%s", req.query.Encode())
+	}
+	if req.headers["X-Request-Id"] != "abc" {
+		t.Errorf("header not match got=%s", req.headers["X-Request-Id"])
+	}
+	if req.body != "id=10&name=foo+bar" {
+		t.Errorf("body not match got=%s", req.body)
+	}
+
+	_, err = mapping.build(map[string]interface{}{"source": "batch"})
+	if err == nil {
+		t.Errorf("missing payload field should be error")
+	}
+}
+
+func TestRequestMappingRawBody(t *testing.T) {
+	mapping, err := newRequestMapping(Config{
+		Url:  "http://127.0.0.1:5000",
+		Body: BodyConfig{Encoding: "raw", Field: "data"},
+	})
+	if err != nil {
+		t.Fatalf("failed to make mapping e=%s", err.Error())
+	}
+
+	req, err := mapping.build(map[string]interface{}{"data": "<xml/>"})
+	if err != nil {
+		t.Fatalf("failed to build request e=%s", err.Error())
+	}
+	if req.method != "POST" || req.url != "http://127.0.0.1:5000" {
+		t.Errorf("default request not match method=%s url=%s", req.method, req.url)
+	}
+	if req.body != "<xml/>" {
+		t.Errorf("body not match got=%s", req.body)
+	}
+}
+
+func TestRequestMappingMethodTemplate(t *testing.T) {
+	mapping, err := newRequestMapping(Config{
+		Url:    "http://127.0.0.1:5000",
+		Method: "{{.method}}",
+	})
+	if err != nil {
+		t.Fatalf("failed to make mapping e=%s", err.Error())
+	}
+
+	req, err := mapping.build(map[string]interface{}{"method": "delete"})
+	if err != nil {
+		t.Fatalf("failed to build request e=%s", err.Error())
+	}
+	if req.method != "DELETE" {
+		t.Errorf("method not match got=%s", req.method)
+	}
+
+	_, err = mapping.build(map[string]interface{}{"method": "CONNECT"})
+	if err == nil {
+		t.Errorf("unsupported method in payload should be error")
+	}
+	_, err = mapping.build(map[string]interface{}{})
+	if err == nil {
+		t.Errorf("missing method field should be error")
+	}
+}
+
+func TestRequestMappingConfig(t *testing.T) {
+	_, err := newRequestMapping(Config{Url: "http://127.0.0.1:5000", Method: "CONNECT"})
+	if err == nil {
+		t.Errorf("unsupported method should be error")
+	}
+	_, err = newRequestMapping(Config{Url: "http://127.0.0.1:5000", Body: BodyConfig{Encoding: "xml"}})
+	if err == nil {
+		t.Errorf("unsupported encoding should be error")
+	}
+	_, err = newRequestMapping(Config{Url: "http://127.0.0.1:5000", Path: "{{.id"})
+	if err == nil {
+		t.Errorf("malformed template should be error")
+	}
+}
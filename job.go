@@ -9,3 +9,32 @@ type Job interface {
 	End()                            // It should complete a job
 	WaitFinalize() bool              // For conccurrency control. Allows making sure runner is available before executing job initialization
 }
+
+// Rejecter is optionally implemented by Jobs whose backend can set aside jobs that should never be retried.
+// For example, backends with dead letter queues may move the job there with reason.
+type Rejecter interface {
+	Reject(reason string)
+}
+
+// RejectJob rejects job if it implements Rejecter. Otherwise job is ended so that it would not be retried.
+func RejectJob(job Job, reason string) {
+	if r, ok := job.(Rejecter); ok {
+		r.Reject(reason)
+	} else {
+		job.End()
+	}
+}
+
+// MetadataJob is optionally implemented by Jobs that carry backend specific information beside payload.
+// For example message ids, delivery counts or message attributes.
+type MetadataJob interface {
+	Metadata() map[string]interface{}
+}
+
+// JobMetadata returns metadata of job. nil is returned when job does not implement MetadataJob.
+func JobMetadata(job Job) map[string]interface{} {
+	if m, ok := job.(MetadataJob); ok {
+		return m.Metadata()
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package kafka
+
+type Job struct {
+	payload   map[string]interface{}
+	partition *partition
+	entry     *entry
+	queue     *Kafka
+	ready     chan bool
+}
+
+func (j *Job) Queue() *Kafka {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns topic, partition, offset and key of the record and how many times it was aborted
+func (j *Job) Metadata() map[string]interface{} {
+	record := j.entry.record
+	return map[string]interface{}{
+		"Topic":     record.Topic,
+		"Partition": record.Partition,
+		"Offset":    record.Offset,
+		"Key":       string(record.Key),
+		"Attempts":  Attempts(record),
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	j.ready <- j.payload != nil
+}
@@ -0,0 +1,476 @@
+// kafka package implements kafka consumer group as reprow.Queue.
+// Producers should produce json encoded payloads to one of the topics.
+//
+// Records of each partition are dispatched in offset order with at most partition_concurrency records running at a time,
+// and offset is committed only up to the lowest unfinished record of the partition.
+// Aborted records are produced to retry topic and rejected records to dead topic, so that a failed record does not block its partition.
+// The retry topic is consumed along with the topics and can not be one of them,
+// as records waiting for retry at there block their partition.
+// Fetching from a partition is paused while its next record waits for retry at, and its records are not counted in buffer_size,
+// so that delayed records do not keep other partitions from being fetched.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AttemptsHeader = "reprow-attempts"
+	RetryAtHeader  = "reprow-retry-at"
+	ReasonHeader   = "reprow-reason"
+	TopicHeader    = "reprow-topic"
+)
+
+func init() {
+	reprow.RegisterQueue("kafka", &KafkaBuilder{})
+}
+
+type KafkaBuilder struct{}
+
+func (b *KafkaBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewKafka(config, logger)
+}
+
+func NewKafka(config map[string]interface{}, logger seelog.LoggerInterface) (*Kafka, error) {
+	k := Kafka{}
+	err := k.configure(config, logger)
+	return &k, err
+}
+
+// Kafka implements kafka consumer group as reprow.Queue
+type Kafka struct {
+	Client       *kgo.Client
+	logger       seelog.LoggerInterface
+	config       Config
+	fetchTimeout time.Duration
+	mu           sync.Mutex
+	partitions   map[topicPartition]*partition
+	wakeup       chan bool
+	wantDown     chan bool
+	cancel       context.CancelFunc
+	running      bool
+	wg           sync.WaitGroup
+}
+
+type Config struct {
+	Brokers              []string `valid:"-"`
+	Topics               []string `valid:"-"`
+	Group                string   `valid:"required"`
+	PartitionConcurrency int      `valid:"-" mapstructure:"partition_concurrency"`
+	RetryTopic           string   `valid:"-" mapstructure:"retry_topic"`
+	DeadTopic            string   `valid:"-" mapstructure:"dead_topic"`
+	MaxAttempts          int      `valid:"-" mapstructure:"max_attempts"`
+	BufferSize           int      `valid:"-" mapstructure:"buffer_size"`
+	FetchTimeout         string   `valid:"-" mapstructure:"fetch_timeout"`
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func (k *Kafka) Start(outChannel chan reprow.Job) error {
+	if k.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		k.running = true
+		k.wantDown = make(chan bool)
+		ctx, cancel := context.WithCancel(context.Background())
+		k.cancel = cancel
+		k.wg.Add(2)
+		go k.poll(ctx)
+		go k.run(outChannel)
+		return nil
+	}
+}
+
+// poll fetches records into partitions until buffer is full
+func (k *Kafka) poll(ctx context.Context) {
+	defer k.wg.Done()
+	for {
+		k.mu.Lock()
+		room := k.config.BufferSize - k.buffered()
+		wakeup := k.wakeup
+		k.mu.Unlock()
+		if room <= 0 {
+			select {
+			case <-wakeup:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		fetches := k.Client.PollRecords(ctx, room)
+		if fetches.IsClientClosed() || ctx.Err() != nil {
+			return
+		}
+		for _, err := range fetches.Errors() {
+			k.logger.Errorf("reprow/kafka: failed to fetch topic=%s partition=%d e=%s", err.Topic, err.Partition, err.Err.Error())
+		}
+
+		k.mu.Lock()
+		fetches.EachRecord(func(record *kgo.Record) {
+			tp := topicPartition{record.Topic, record.Partition}
+			p, found := k.partitions[tp]
+			if !found {
+				p = &partition{}
+				k.partitions[tp] = p
+			}
+			p.pending = append(p.pending, record)
+		})
+		k.notify()
+		k.mu.Unlock()
+	}
+}
+
+func (k *Kafka) run(outChannel chan reprow.Job) {
+	defer k.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: k,
+		}
+		select {
+		case outChannel <- &job:
+		case <-k.wantDown:
+			return
+		}
+		k.wg.Add(1)
+		go func(job *Job) {
+			defer job.finalize()
+			defer k.wg.Done()
+
+			job.partition, job.entry = k.next()
+			if job.entry == nil {
+				k.logger.Debugf("no queue retrieved")
+				return
+			}
+
+			err := json.Unmarshal(job.entry.record.Value, &job.payload)
+			if err != nil {
+				k.logger.Errorf("reprow/kafka: failed to deserialize record. rejecting %s err=%s", describe(job.entry.record), err.Error())
+				k.Reject(job, "failed to deserialize")
+				job.payload = nil
+			}
+		}(&job)
+	}
+}
+
+// next waits for a record that can be dispatched until fetch timeout
+func (k *Kafka) next() (*partition, *entry) {
+	deadline := time.After(k.fetchTimeout)
+	for {
+		k.mu.Lock()
+		var wait time.Duration
+		now := time.Now()
+		for tp, p := range k.partitions {
+			ok, until := p.dispatchable(k.config.PartitionConcurrency, now)
+			if ok {
+				e := p.dispatch()
+				if p.paused && !p.delayed(now) {
+					k.resume(tp, p)
+				}
+				k.notify()
+				k.mu.Unlock()
+				return p, e
+			}
+			if until > 0 && !p.paused {
+				k.pause(tp, p)
+			}
+			if until > 0 && (wait == 0 || until < wait) {
+				wait = until
+			}
+		}
+		wakeup := k.wakeup
+		k.mu.Unlock()
+
+		var retry <-chan time.Time
+		if wait > 0 {
+			retry = time.After(wait)
+		}
+		select {
+		case <-wakeup:
+		case <-retry:
+		case <-deadline:
+			return nil, nil
+		case <-k.wantDown:
+			return nil, nil
+		}
+	}
+}
+
+// notify wakes up goroutines waiting for records or buffer. It should be called with lock held
+func (k *Kafka) notify() {
+	close(k.wakeup)
+	k.wakeup = make(chan bool)
+}
+
+// buffered returns number of pending records counted in buffer_size. It should be called with lock held
+func (k *Kafka) buffered() int {
+	n := 0
+	for _, p := range k.partitions {
+		if !p.paused {
+			n += len(p.pending)
+		}
+	}
+	return n
+}
+
+// pause stops fetching from partition whose next record waits for retry at. It should be called with lock held
+func (k *Kafka) pause(tp topicPartition, p *partition) {
+	k.Client.PauseFetchPartitions(map[string][]int32{tp.topic: {tp.partition}})
+	p.paused = true
+	// records of the partition no longer take buffer
+	k.notify()
+}
+
+// resume starts fetching from paused partition again. It should be called with lock held
+func (k *Kafka) resume(tp topicPartition, p *partition) {
+	k.Client.ResumeFetchPartitions(map[string][]int32{tp.topic: {tp.partition}})
+	p.paused = false
+}
+
+func (k *Kafka) Stop() error {
+	k.logger.Infof("stopping queue")
+	if k.running == false {
+		return errors.New("not running")
+	} else {
+		close(k.wantDown)
+		k.cancel()
+		k.wg.Wait()
+		k.running = false
+		return nil
+	}
+}
+
+// Close commits offsets of finished records and leaves the consumer group
+func (k *Kafka) Close() error {
+	err := k.Client.CommitMarkedOffsets(context.Background())
+	k.Client.Close()
+	if err != nil {
+		return errors.New("failed to commit offsets: " + err.Error())
+	}
+	return nil
+}
+
+func (k *Kafka) Abort(job *Job, retryAfter int) {
+	attempts := Attempts(job.entry.record) + 1
+	if k.config.MaxAttempts > 0 && attempts >= k.config.MaxAttempts {
+		k.Reject(job, fmt.Sprintf("attempted %d times", attempts))
+		return
+	}
+
+	// Retry at is rounded up to milliseconds so that record is never retried before retry after
+	retryAt := time.Now().Add(time.Duration(retryAfter) * time.Second)
+	record := k.forward(job.entry.record, k.config.RetryTopic, map[string]string{
+		AttemptsHeader: strconv.Itoa(attempts),
+		RetryAtHeader:  strconv.FormatInt((retryAt.UnixNano()+int64(time.Millisecond)-1)/int64(time.Millisecond), 10),
+	})
+	err := k.Client.ProduceSync(context.Background(), record).FirstErr()
+	if err != nil {
+		k.logger.Errorf("reprow/kafka: failed to produce to retry topic %s e=%s", describe(job.entry.record), err.Error())
+		k.requeue(job)
+		return
+	}
+	k.finish(job)
+}
+
+func (k *Kafka) End(job *Job) {
+	k.finish(job)
+}
+
+func (k *Kafka) Reject(job *Job, reason string) {
+	k.logger.Errorf("reprow/kafka: job rejected %s reason=%s", describe(job.entry.record), reason)
+	if k.config.DeadTopic != "" {
+		record := k.forward(job.entry.record, k.config.DeadTopic, map[string]string{
+			ReasonHeader: reason,
+		})
+		err := k.Client.ProduceSync(context.Background(), record).FirstErr()
+		if err != nil {
+			k.logger.Errorf("reprow/kafka: failed to produce to dead topic %s e=%s", describe(job.entry.record), err.Error())
+			k.requeue(job)
+			return
+		}
+	}
+	k.finish(job)
+}
+
+// forward makes a copy of record for topic with headers replaced
+func (k *Kafka) forward(original *kgo.Record, topic string, headers map[string]string) *kgo.Record {
+	record := &kgo.Record{
+		Topic: topic,
+		Key:   original.Key,
+		Value: original.Value,
+	}
+	for _, header := range original.Headers {
+		if _, replaced := headers[header.Key]; !replaced && header.Key != TopicHeader {
+			record.Headers = append(record.Headers, header)
+		}
+	}
+	for key, value := range headers {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: key, Value: []byte(value)})
+	}
+	origin := original.Topic
+	if value, found := header(original, TopicHeader); found {
+		origin = value
+	}
+	record.Headers = append(record.Headers, kgo.RecordHeader{Key: TopicHeader, Value: []byte(origin)})
+	return record
+}
+
+// finish marks record finished and commits offsets up to the lowest unfinished record
+func (k *Kafka) finish(job *Job) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if job.partition.revoked {
+		// Partition is assigned to another consumer, which will process the record again
+		return
+	}
+	if record := job.partition.finish(job.entry); record != nil {
+		k.Client.MarkCommitRecords(record)
+	}
+	k.notify()
+}
+
+// requeue puts record back to be dispatched again
+func (k *Kafka) requeue(job *Job) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if job.partition.revoked {
+		return
+	}
+	p := job.partition
+	for i, e := range p.inFlight {
+		if e == job.entry {
+			p.inFlight = append(p.inFlight[:i], p.inFlight[i+1:]...)
+			break
+		}
+	}
+	p.pending = append([]*kgo.Record{job.entry.record}, p.pending...)
+	k.notify()
+}
+
+// revoke forgets partitions assigned to another consumer
+func (k *Kafka) revoke(revoked map[string][]int32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for topic, partitions := range revoked {
+		for _, i := range partitions {
+			tp := topicPartition{topic, i}
+			if p, found := k.partitions[tp]; found {
+				p.revoked = true
+				if p.paused {
+					k.resume(tp, p)
+				}
+				delete(k.partitions, tp)
+			}
+		}
+	}
+	k.notify()
+}
+
+// Attempts returns how many times record was aborted
+func Attempts(record *kgo.Record) int {
+	value, _ := header(record, AttemptsHeader)
+	attempts, _ := strconv.Atoi(value)
+	return attempts
+}
+
+func retryAt(record *kgo.Record) time.Time {
+	value, found := header(record, RetryAtHeader)
+	if !found {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func header(record *kgo.Record, key string) (string, bool) {
+	for _, header := range record.Headers {
+		if header.Key == key {
+			return string(header.Value), true
+		}
+	}
+	return "", false
+}
+
+func describe(record *kgo.Record) string {
+	return fmt.Sprintf("topic=%s partition=%d offset=%d", record.Topic, record.Partition, record.Offset)
+}
+
+func (k *Kafka) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	k.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+	if len(config.Brokers) == 0 {
+		return errors.New("brokers is required")
+	}
+	if len(config.Topics) == 0 {
+		return errors.New("topics is required")
+	}
+	if config.RetryTopic == "" {
+		return errors.New("retry_topic is required")
+	}
+	for _, topic := range config.Topics {
+		if topic == config.RetryTopic {
+			return errors.New("retry_topic should not be one of topics")
+		}
+	}
+
+	if config.PartitionConcurrency <= 0 {
+		config.PartitionConcurrency = 1
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = 100
+	}
+	k.fetchTimeout, err = reprow.ParseDuration(config.FetchTimeout, "1s")
+	if err != nil {
+		return errors.New("fetch_timeout failed to parse: " + err.Error())
+	}
+
+	k.config = config
+	k.partitions = make(map[topicPartition]*partition)
+	k.wakeup = make(chan bool)
+
+	k.Client, err = kgo.NewClient(
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ConsumerGroup(config.Group),
+		kgo.ConsumeTopics(append(append([]string{}, config.Topics...), config.RetryTopic)...),
+		kgo.AutoCommitMarks(),
+		kgo.OnPartitionsRevoked(func(ctx context.Context, client *kgo.Client, revoked map[string][]int32) {
+			k.revoke(revoked)
+			err := client.CommitMarkedOffsets(ctx)
+			if err != nil {
+				k.logger.Errorf("reprow/kafka: failed to commit on revoke e=%s", err.Error())
+			}
+		}),
+		kgo.OnPartitionsLost(func(ctx context.Context, client *kgo.Client, lost map[string][]int32) {
+			k.revoke(lost)
+		}),
+	)
+	return err
+}
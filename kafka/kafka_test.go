@@ -0,0 +1,246 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func runCluster(t *testing.T) *kfake.Cluster {
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(2, "jobs", "retry", "dead"))
+	if err != nil {
+		t.Fatalf("failed to make cluster e=%s", err.Error())
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+func newTestKafka(t *testing.T, cluster *kfake.Cluster, config map[string]interface{}) *Kafka {
+	c := map[string]interface{}{
+		"brokers":               cluster.ListenAddrs(),
+		"topics":                []string{"jobs"},
+		"group":                 "reprow",
+		"retry_topic":           "retry",
+		"partition_concurrency": 8,
+		"dead_topic":            "dead",
+	}
+	for key, value := range config {
+		c[key] = value
+	}
+	queue, err := NewKafka(c, logger)
+	if err != nil {
+		t.Fatalf("failed to make kafka queue e=%s", err.Error())
+	}
+	t.Cleanup(func() { queue.Close() })
+	return queue
+}
+
+func mustProduce(t *testing.T, client *kgo.Client, payload map[string]interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	err = client.ProduceSync(context.Background(), &kgo.Record{Topic: "jobs", Value: b}).FirstErr()
+	if err != nil {
+		t.Fatalf("failed to produce e=%s", err.Error())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			return newTestKafka(t, runCluster(t), nil)
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustProduce(t, queue.(*Kafka).Client, payload)
+		},
+	}.Run(t)
+}
+
+func TestConfigure(t *testing.T) {
+	invalid := []map[string]interface{}{
+		{"brokers": []string{"127.0.0.1:9092"}, "topics": []string{"jobs"}, "group": "reprow"},
+		{"brokers": []string{"127.0.0.1:9092"}, "topics": []string{"jobs", "retry"}, "group": "reprow", "retry_topic": "retry"},
+		{"brokers": []string{"127.0.0.1:9092"}, "topics": []string{"jobs"}, "retry_topic": "retry"},
+	}
+	for _, c := range invalid {
+		_, err := NewKafka(c, logger)
+		if err == nil {
+			t.Errorf("invalid config should fail config=%v", c)
+		}
+	}
+}
+
+func TestRetryAndDead(t *testing.T) {
+	cluster := runCluster(t)
+	queue := newTestKafka(t, cluster, map[string]interface{}{
+		"max_attempts": 2,
+	})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustProduce(t, queue.Client, map[string]interface{}{"id": "retried"})
+	started := time.Now()
+	mustReceive(t, stream).Abort(1)
+
+	job := mustReceive(t, stream)
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	metadata := reprow.JobMetadata(job)
+	if metadata["Topic"] != "retry" || metadata["Attempts"] != 1 {
+		t.Errorf("job should be retried from retry topic got=%v", metadata)
+	}
+	// Reaches max attempts
+	job.Abort(0)
+
+	consumer, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...), kgo.ConsumeTopics("dead"))
+	if err != nil {
+		t.Fatalf("failed to make client e=%s", err.Error())
+	}
+	defer consumer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records := consumer.PollRecords(ctx, 1).Records()
+	if len(records) != 1 {
+		t.Fatalf("job should be produced to dead topic")
+	}
+	if topic, _ := header(records[0], TopicHeader); topic != "jobs" {
+		t.Errorf("original topic should be kept got=%s", topic)
+	}
+	if reason, _ := header(records[0], ReasonHeader); reason != "attempted 2 times" {
+		t.Errorf("reason should be recorded got=%s", reason)
+	}
+}
+
+func TestCloseCommitsOffsets(t *testing.T) {
+	cluster := runCluster(t)
+	queue := newTestKafka(t, cluster, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+
+	mustProduce(t, queue.Client, map[string]interface{}{"id": "committed"})
+	mustReceive(t, stream).End()
+	queue.Stop()
+	err := queue.Close()
+	if err != nil {
+		t.Fatalf("failed to close e=%s", err.Error())
+	}
+
+	queue = newTestKafka(t, cluster, nil)
+	queue.Start(stream)
+	defer queue.Stop()
+	mustProduce(t, queue.Client, map[string]interface{}{"id": "next"})
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "next" {
+		t.Errorf("ended record should not be redelivered got=%v", job.Payload())
+	}
+}
+
+func TestDelayedPartitionDoesNotBlockOthers(t *testing.T) {
+	cluster := runCluster(t)
+	queue := newTestKafka(t, cluster, map[string]interface{}{
+		"buffer_size": 2,
+	})
+	producer, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...), kgo.RecordPartitioner(kgo.ManualPartitioner()))
+	if err != nil {
+		t.Fatalf("failed to make client e=%s", err.Error())
+	}
+	defer producer.Close()
+	produce := func(partition int32, payload map[string]interface{}, headers []kgo.RecordHeader) {
+		b, _ := json.Marshal(payload)
+		err := producer.ProduceSync(context.Background(), &kgo.Record{Topic: "jobs", Partition: partition, Value: b, Headers: headers}).FirstErr()
+		if err != nil {
+			t.Fatalf("failed to produce e=%s", err.Error())
+		}
+	}
+
+	// more delayed records than buffer_size in one partition
+	delayed := []kgo.RecordHeader{{Key: RetryAtHeader, Value: []byte(formatMillis(time.Now().Add(time.Hour)))}}
+	for i := 0; i < 3; i++ {
+		produce(0, map[string]interface{}{"id": "delayed"}, delayed)
+	}
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	produce(1, map[string]interface{}{"id": "ready"}, nil)
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "ready" {
+		t.Errorf("record of other partition should be delivered got=%v", job.Payload())
+	}
+	job.End()
+	if paused := queue.Client.PauseFetchPartitions(nil); len(paused["jobs"]) != 1 || paused["jobs"][0] != 0 {
+		t.Errorf("delayed partition should be paused got=%v", paused)
+	}
+}
+
+func TestPartitionCommitsLowestUnfinished(t *testing.T) {
+	p := &partition{}
+	for i := int64(0); i < 3; i++ {
+		p.pending = append(p.pending, &kgo.Record{Offset: i})
+	}
+
+	if ok, _ := p.dispatchable(2, time.Now()); !ok {
+		t.Fatalf("first record should be dispatchable")
+	}
+	first := p.dispatch()
+	second := p.dispatch()
+	if ok, _ := p.dispatchable(2, time.Now()); ok {
+		t.Errorf("records over concurrency should not be dispatchable")
+	}
+
+	if record := p.finish(second); record != nil {
+		t.Errorf("offset should not be committed beyond unfinished record got=%d", record.Offset)
+	}
+	if record := p.finish(first); record == nil || record.Offset != 1 {
+		t.Errorf("offset should be committed up to finished records got=%v", record)
+	}
+	if ok, _ := p.dispatchable(2, time.Now()); !ok {
+		t.Errorf("record should be dispatchable after others finished")
+	}
+}
+
+func TestPartitionWaitsRetryAt(t *testing.T) {
+	at := time.Now().Add(time.Minute)
+	p := &partition{pending: []*kgo.Record{{
+		Headers: []kgo.RecordHeader{{Key: RetryAtHeader, Value: []byte(formatMillis(at))}},
+	}}}
+	ok, until := p.dispatchable(1, time.Now())
+	if ok || until <= 0 {
+		t.Errorf("record should wait until retry at got=%v,%s", ok, until)
+	}
+	if ok, _ := p.dispatchable(1, at); !ok {
+		t.Errorf("record should be dispatchable at retry at")
+	}
+}
+
+func formatMillis(at time.Time) string {
+	return strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"github.com/twmb/franz-go/pkg/kgo"
+	"time"
+)
+
+// partition holds records of a partition assigned to this consumer.
+// Records are dispatched in offset order, and offset can only be committed up to the lowest unfinished record.
+type partition struct {
+	pending  []*kgo.Record // fetched but not yet dispatched
+	inFlight []*entry      // dispatched in offset order, including finished ones not yet committable
+	revoked  bool
+	paused   bool // fetching is paused while next record waits for retry at
+}
+
+type entry struct {
+	record   *kgo.Record
+	finished bool
+}
+
+// dispatchable returns whether next pending record can be dispatched.
+// When it can not because of retry at, time until the record gets ready is returned.
+func (p *partition) dispatchable(concurrency int, now time.Time) (bool, time.Duration) {
+	if len(p.pending) == 0 || p.running() >= concurrency {
+		return false, 0
+	}
+	if at := retryAt(p.pending[0]); at.After(now) {
+		return false, at.Sub(now)
+	}
+	return true, 0
+}
+
+// delayed returns whether next pending record waits for retry at
+func (p *partition) delayed(now time.Time) bool {
+	return len(p.pending) > 0 && retryAt(p.pending[0]).After(now)
+}
+
+// dispatch takes next pending record
+func (p *partition) dispatch() *entry {
+	e := &entry{record: p.pending[0]}
+	p.pending = p.pending[1:]
+	p.inFlight = append(p.inFlight, e)
+	return e
+}
+
+// finish marks entry finished and returns the last record that can be committed. nil is returned when it does not change
+func (p *partition) finish(e *entry) *kgo.Record {
+	e.finished = true
+	var committable *kgo.Record
+	for len(p.inFlight) > 0 && p.inFlight[0].finished {
+		committable = p.inFlight[0].record
+		p.inFlight = p.inFlight[1:]
+	}
+	return committable
+}
+
+func (p *partition) running() int {
+	n := 0
+	for _, e := range p.inFlight {
+		if !e.finished {
+			n++
+		}
+	}
+	return n
+}
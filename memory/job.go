@@ -0,0 +1,30 @@
+package memory
+
+type Job struct {
+	payload map[string]interface{}
+	queue   *Memory
+}
+
+func (j *Job) Queue() *Memory {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return true
+}
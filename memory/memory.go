@@ -0,0 +1,250 @@
+// memory package implements in memory queue as reprow.Queue.
+// Jobs are pushed programmatically with Push, which makes it suitable for embedding reprow and for tests.
+// All jobs are lost when the process exits.
+package memory
+
+import (
+	"container/heap"
+	"errors"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFull = errors.New("queue is full")
+)
+
+func init() {
+	reprow.RegisterQueue("memory", &MemoryBuilder{})
+}
+
+type MemoryBuilder struct{}
+
+func (b *MemoryBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewMemory(config, logger)
+}
+
+func NewMemory(config map[string]interface{}, logger seelog.LoggerInterface) (*Memory, error) {
+	m := Memory{}
+	err := m.configure(config, logger)
+	return &m, err
+}
+
+// Memory implements in memory queue as reprow.Queue
+type Memory struct {
+	logger   seelog.LoggerInterface
+	config   Config
+	mu       sync.Mutex
+	ready    []*Job
+	delayed  delayHeap
+	inFlight int
+	ended    []map[string]interface{}
+	aborted  []map[string]interface{}
+	rejected []map[string]interface{}
+	notify   chan bool
+	wantDown chan bool
+	done     chan bool
+}
+
+// Config of memory queue. Capacity limits number of jobs waiting in the queue. 0 means unlimited.
+type Config struct {
+	Capacity int `valid:"int"`
+}
+
+// Push adds payload to the queue. ErrFull is returned when queue has reached its capacity.
+func (m *Memory) Push(payload map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.config.Capacity > 0 && len(m.ready)+len(m.delayed) >= m.config.Capacity {
+		return ErrFull
+	}
+	m.ready = append(m.ready, &Job{payload: payload, queue: m})
+	m.wakeup()
+	return nil
+}
+
+// Len returns number of jobs waiting in the queue including delayed ones.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.ready) + len(m.delayed)
+}
+
+// InFlight returns number of jobs passed to runner that are not yet ended or aborted.
+func (m *Memory) InFlight() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inFlight
+}
+
+// Ended returns payloads of ended jobs in order.
+func (m *Memory) Ended() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]map[string]interface{}{}, m.ended...)
+}
+
+// Aborted returns payloads of aborted jobs in order. Aborted jobs are also requeued.
+func (m *Memory) Aborted() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]map[string]interface{}{}, m.aborted...)
+}
+
+// Rejected returns payloads of rejected jobs in order. Rejected jobs are never requeued.
+func (m *Memory) Rejected() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]map[string]interface{}{}, m.rejected...)
+}
+
+func (m *Memory) Start(outChannel chan reprow.Job) error {
+	if m.done != nil {
+		return errors.New("Start called twice")
+	} else {
+		m.wantDown = make(chan bool)
+		m.done = make(chan bool)
+		go func() {
+			m.run(outChannel)
+			close(m.done)
+		}()
+		return nil
+	}
+}
+
+func (m *Memory) run(outChannel chan reprow.Job) {
+	for {
+		m.mu.Lock()
+		m.promote(time.Now())
+		var job *Job
+		if len(m.ready) > 0 {
+			job = m.ready[0]
+		}
+		var timer <-chan time.Time
+		if len(m.delayed) > 0 {
+			timer = time.After(m.delayed[0].at.Sub(time.Now()))
+		}
+		m.mu.Unlock()
+
+		if job != nil {
+			select {
+			case outChannel <- job:
+				m.mu.Lock()
+				// Only run loop removes jobs from ready, so head of ready is still the job
+				m.ready = m.ready[1:]
+				m.inFlight++
+				m.mu.Unlock()
+			case <-m.wantDown:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-m.notify:
+		case <-timer:
+		case <-m.wantDown:
+			return
+		}
+	}
+}
+
+func (m *Memory) Stop() error {
+	if m.done == nil {
+		return errors.New("not running")
+	} else {
+		close(m.wantDown)
+		<-m.done
+		m.done = nil
+		return nil
+	}
+}
+
+func (m *Memory) Abort(job *Job, retryAfter int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.aborted = append(m.aborted, job.payload)
+	requeued := &Job{payload: job.payload, queue: m}
+	if retryAfter > 0 {
+		heap.Push(&m.delayed, &delayedJob{job: requeued, at: time.Now().Add(time.Duration(retryAfter) * time.Second)})
+	} else {
+		m.ready = append(m.ready, requeued)
+	}
+	m.wakeup()
+}
+
+func (m *Memory) End(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.ended = append(m.ended, job.payload)
+}
+
+func (m *Memory) Reject(job *Job, reason string) {
+	m.logger.Errorf("reprow/memory: job rejected reason=%s", reason)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.rejected = append(m.rejected, job.payload)
+}
+
+// promote moves delayed jobs whose time has come to ready. It should be called with lock held.
+func (m *Memory) promote(now time.Time) {
+	for len(m.delayed) > 0 && !m.delayed[0].at.After(now) {
+		d := heap.Pop(&m.delayed).(*delayedJob)
+		m.ready = append(m.ready, d.job)
+	}
+}
+
+// wakeup notifies run loop that queue has changed. It should be called with lock held.
+func (m *Memory) wakeup() {
+	select {
+	case m.notify <- true:
+	default:
+	}
+}
+
+func (m *Memory) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	m.logger = logger
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+	if config.Capacity < 0 {
+		return errors.New("capacity should not be negative")
+	}
+
+	m.config = config
+	m.notify = make(chan bool, 1)
+	return nil
+}
+
+type delayedJob struct {
+	job *Job
+	at  time.Time
+}
+
+// delayHeap implements heap.Interface ordered by time jobs become ready
+type delayHeap []*delayedJob
+
+func (h delayHeap) Len() int            { return len(h) }
+func (h delayHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h delayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(*delayedJob)) }
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,143 @@
+package memory
+
+import (
+	"context"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func TestStart(t *testing.T) {
+	queue, err := NewMemory(map[string]interface{}{}, logger)
+	if err != nil {
+		t.Fatalf("failed to make memory queue e=%s", err.Error())
+	}
+
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	queue.Push(map[string]interface{}{"id": 1})
+	queue.Push(map[string]interface{}{"id": 2})
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != 1 {
+		t.Errorf("jobs should be received in order got=%v", job.Payload())
+	}
+	job.End()
+
+	job = mustReceive(t, stream)
+	job.Abort(0)
+	job = mustReceive(t, stream)
+	if job.Payload()["id"] != 2 {
+		t.Errorf("aborted job should be redelivered got=%v", job.Payload())
+	}
+	job.(reprow.Rejecter).Reject("invalid")
+
+	if len(queue.Ended()) != 1 || len(queue.Aborted()) != 1 || len(queue.Rejected()) != 1 {
+		t.Errorf("history not match ended=%v aborted=%v rejected=%v", queue.Ended(), queue.Aborted(), queue.Rejected())
+	}
+	if queue.InFlight() != 0 || queue.Len() != 0 {
+		t.Errorf("queue should be empty inFlight=%d len=%d", queue.InFlight(), queue.Len())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			queue, err := NewMemory(map[string]interface{}{}, logger)
+			if err != nil {
+				t.Fatalf("failed to make memory queue e=%s", err.Error())
+			}
+			return queue
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			err := queue.(*Memory).Push(payload)
+			if err != nil {
+				t.Fatalf("failed to push e=%s", err.Error())
+			}
+		},
+	}.Run(t)
+}
+
+func TestAbortRetryAfter(t *testing.T) {
+	queue, _ := NewMemory(map[string]interface{}{}, logger)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	queue.Push(map[string]interface{}{"id": 1})
+	mustReceive(t, stream).Abort(1)
+	queue.Push(map[string]interface{}{"id": 2})
+
+	aborted := time.Now()
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != 2 {
+		t.Errorf("delayed job should not be delivered before others got=%v", job.Payload())
+	}
+	job.End()
+
+	job = mustReceive(t, stream)
+	if job.Payload()["id"] != 1 {
+		t.Errorf("delayed job should be delivered got=%v", job.Payload())
+	}
+	if time.Since(aborted) < 900*time.Millisecond {
+		t.Errorf("delayed job delivered too early")
+	}
+	job.End()
+}
+
+func TestCapacity(t *testing.T) {
+	queue, err := NewMemory(map[string]interface{}{"capacity": 1}, logger)
+	if err != nil {
+		t.Fatalf("failed to make memory queue e=%s", err.Error())
+	}
+	if err := queue.Push(map[string]interface{}{"id": 1}); err != nil {
+		t.Errorf("push should succeed e=%s", err.Error())
+	}
+	if err := queue.Push(map[string]interface{}{"id": 2}); err != ErrFull {
+		t.Errorf("push over capacity should be ErrFull got=%v", err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	queue, _ := NewMemory(map[string]interface{}{}, logger)
+	runner := reprowtest.NewScriptedRunner(3)
+	server, err := reprow.NewServerFrom(queue, runner, reprow.WithLogger(logger))
+	if err != nil {
+		t.Fatalf("failed to make server e=%s", err.Error())
+	}
+	for i := 0; i < 10; i++ {
+		queue.Push(map[string]interface{}{"id": i})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- server.Run(ctx) }()
+
+	deadline := time.Now().Add(time.Second)
+	for len(queue.Ended()) < 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-result
+
+	if len(queue.Ended()) != 10 {
+		t.Errorf("all jobs should be ended got=%d", len(queue.Ended()))
+	}
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	select {
+	case job := <-stream:
+		return job
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout reading stream")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package mqtt
+
+import (
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+type Job struct {
+	payload map[string]interface{}
+	message paho.Message
+	queue   *MQTT
+	ready   chan bool
+}
+
+func (j *Job) Queue() *MQTT {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns topic and qos of the message and whether it is redelivered by broker
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Topic":     j.message.Topic(),
+		"Qos":       int(j.message.Qos()),
+		"MessageId": j.message.MessageID(),
+		"Duplicate": j.message.Duplicate(),
+		"Retained":  j.message.Retained(),
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	j.ready <- j.payload != nil
+}
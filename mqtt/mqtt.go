@@ -0,0 +1,319 @@
+// mqtt package implements MQTT subscription as reprow.Queue.
+// Producers should publish json encoded payloads to topics matching one of the topic filters.
+//
+// Topic filters are subscribed as shared subscription of the group, so that messages are distributed among reprow processes.
+// Automatic acknowledgement is disabled, and PUBACK of a message is sent only when its job is ended or rejected.
+// As MQTT has no negative acknowledgement, aborted messages are kept unacknowledged and redelivered from memory after retry after.
+// Unacknowledged messages are redelivered by broker when session is resumed, so clean_session should be kept false with a fixed client_id.
+// Topic filters are unsubscribed on Stop, and messages arriving meanwhile are left unacknowledged.
+// Start after Stop connects again, so that the broker redelivers them as the session is resumed.
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	PublishTimeout = 10 * time.Second
+)
+
+func init() {
+	reprow.RegisterQueue("mqtt", &MQTTBuilder{})
+}
+
+type MQTTBuilder struct{}
+
+func (b *MQTTBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewMQTT(config, logger)
+}
+
+func NewMQTT(config map[string]interface{}, logger seelog.LoggerInterface) (*MQTT, error) {
+	m := MQTT{}
+	err := m.configure(config, logger)
+	return &m, err
+}
+
+// MQTT implements MQTT subscription as reprow.Queue
+type MQTT struct {
+	Client       paho.Client
+	logger       seelog.LoggerInterface
+	config       Config
+	messages     chan paho.Message
+	subscribed   chan error
+	fetchTimeout time.Duration
+	wantDown     chan bool
+	stopped      bool
+	mu           sync.Mutex
+	running      bool
+	wg           sync.WaitGroup
+}
+
+type Config struct {
+	Broker       string   `valid:"required"`
+	ClientId     string   `valid:"-" mapstructure:"client_id"`
+	Username     string   `valid:"-"`
+	Password     string   `valid:"-"`
+	Topics       []string `valid:"-"`
+	Group        string   `valid:"-"`
+	Qos          int      `valid:"-"`
+	CleanSession bool     `valid:"-" mapstructure:"clean_session"`
+	DeadTopic    string   `valid:"-" mapstructure:"dead_topic"`
+	FetchTimeout string   `valid:"-" mapstructure:"fetch_timeout"`
+}
+
+func (m *MQTT) Start(outChannel chan reprow.Job) error {
+	if m.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		m.mu.Lock()
+		m.wantDown = make(chan bool)
+		reconnect := m.stopped
+		m.stopped = false
+		m.mu.Unlock()
+		if reconnect {
+			// topic filters are subscribed again on connect
+			m.Client.Disconnect(250)
+			err := m.connect()
+			if err != nil {
+				return err
+			}
+		}
+		m.running = true
+		m.wg.Add(1)
+		go m.run(outChannel)
+		return nil
+	}
+}
+
+func (m *MQTT) run(outChannel chan reprow.Job) {
+	defer m.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: m,
+		}
+		select {
+		case outChannel <- &job:
+		case <-m.wantDown:
+			return
+		}
+
+		m.wg.Add(1)
+		go func() {
+			defer job.finalize()
+			defer m.wg.Done()
+			m.receive(&job)
+		}()
+	}
+}
+
+func (m *MQTT) receive(job *Job) {
+	select {
+	case message := <-m.messages:
+		job.message = message
+		err := json.Unmarshal(message.Payload(), &job.payload)
+		if err != nil {
+			m.logger.Errorf("reprow/mqtt: failed to deserialize job. rejecting err=%s", err.Error())
+			m.Reject(job, "failed to deserialize")
+			job.payload = nil
+		}
+	case <-time.After(m.fetchTimeout):
+		m.logger.Debugf("no queue retrieved")
+	case <-m.wantDown:
+	}
+}
+
+// handle passes arrived message to waiting job.
+// Handlers are called in their own goroutines and block until the message is taken or queue is stopped,
+// so number of messages held here is bounded by in flight window of broker.
+func (m *MQTT) handle(client paho.Client, message paho.Message) {
+	m.deliver(message)
+}
+
+// redeliver passes unacknowledged message to jobs again after delay
+func (m *MQTT) redeliver(message paho.Message, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		m.deliver(message)
+	})
+}
+
+// deliver passes message to waiting job unless queue is stopped
+func (m *MQTT) deliver(message paho.Message) {
+	m.mu.Lock()
+	wantDown := m.wantDown
+	m.mu.Unlock()
+	select {
+	case m.messages <- message:
+	case <-wantDown:
+	}
+}
+
+func (m *MQTT) Stop() error {
+	m.logger.Infof("stopping queue")
+	if m.running == false {
+		return errors.New("not running")
+	} else {
+		m.mu.Lock()
+		close(m.wantDown)
+		m.stopped = true
+		m.mu.Unlock()
+		err := m.unsubscribe(m.Client)
+		if err != nil {
+			m.logger.Errorf("reprow/mqtt: failed to unsubscribe e=%s", err.Error())
+		}
+		m.wg.Wait()
+		m.running = false
+		return nil
+	}
+}
+
+func (m *MQTT) Abort(job *Job, retryAfter int) {
+	m.redeliver(job.message, time.Duration(retryAfter)*time.Second)
+}
+
+func (m *MQTT) End(job *Job) {
+	job.message.Ack()
+}
+
+func (m *MQTT) Reject(job *Job, reason string) {
+	m.logger.Errorf("reprow/mqtt: job rejected topic=%s reason=%s", job.message.Topic(), reason)
+
+	if m.config.DeadTopic != "" {
+		token := m.Client.Publish(m.config.DeadTopic, byte(m.config.Qos), false, job.message.Payload())
+		if !token.WaitTimeout(PublishTimeout) {
+			m.logger.Errorf("reprow/mqtt: publishing to dead topic timed out")
+			m.redeliver(job.message, 0)
+			return
+		}
+		if err := token.Error(); err != nil {
+			m.logger.Errorf("reprow/mqtt: failed to publish to dead topic e=%s", err.Error())
+			m.redeliver(job.message, 0)
+			return
+		}
+	}
+	job.message.Ack()
+}
+
+// onConnect subscribes topic filters on every connection as broker may not keep the session
+func (m *MQTT) onConnect(client paho.Client) {
+	m.mu.Lock()
+	stopped := m.stopped
+	m.mu.Unlock()
+	if stopped {
+		return
+	}
+	err := m.subscribe(client)
+	if err != nil {
+		m.logger.Errorf("reprow/mqtt: failed to subscribe e=%s", err.Error())
+	}
+	select {
+	case m.subscribed <- err:
+	default:
+	}
+}
+
+func (m *MQTT) subscribe(client paho.Client) error {
+	filters := make(map[string]byte)
+	for _, topic := range m.filters() {
+		filters[topic] = byte(m.config.Qos)
+	}
+	token := client.SubscribeMultiple(filters, m.handle)
+	token.Wait()
+	return token.Error()
+}
+
+func (m *MQTT) unsubscribe(client paho.Client) error {
+	token := client.Unsubscribe(m.filters()...)
+	if !token.WaitTimeout(PublishTimeout) {
+		return errors.New("unsubscribe timed out")
+	}
+	return token.Error()
+}
+
+// filters returns topic filters with shared subscription of the group
+func (m *MQTT) filters() []string {
+	filters := make([]string, len(m.config.Topics))
+	for i, topic := range m.config.Topics {
+		if m.config.Group != "" {
+			topic = "$share/" + m.config.Group + "/" + topic
+		}
+		filters[i] = topic
+	}
+	return filters
+}
+
+func (m *MQTT) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	m.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+	if len(config.Topics) == 0 {
+		return errors.New("topics is required")
+	}
+
+	if _, ok := c["qos"]; !ok {
+		config.Qos = 1
+	}
+	if config.Qos < 1 || config.Qos > 2 {
+		return errors.New("qos should be 1 or 2")
+	}
+	if config.ClientId == "" {
+		hostname, _ := os.Hostname()
+		config.ClientId = fmt.Sprintf("reprow-%s-%d", hostname, os.Getpid())
+	}
+	m.fetchTimeout, err = reprow.ParseDuration(config.FetchTimeout, "1s")
+	if err != nil {
+		return errors.New("fetch_timeout failed to parse: " + err.Error())
+	}
+
+	m.config = config
+	m.messages = make(chan paho.Message)
+	m.subscribed = make(chan error, 1)
+
+	options := paho.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientId).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetCleanSession(config.CleanSession).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(client paho.Client, err error) {
+			m.logger.Errorf("reprow/mqtt: connection lost e=%s", err.Error())
+		})
+	m.Client = paho.NewClient(options)
+	return m.connect()
+}
+
+// connect connects to broker and waits for topic filters to be subscribed
+func (m *MQTT) connect() error {
+	token := m.Client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return errors.New("failed to connect: " + token.Error().Error())
+	}
+	// messages published before subscription completes are not delivered
+	err := <-m.subscribed
+	if err != nil {
+		return errors.New("failed to subscribe: " + err.Error())
+	}
+	return nil
+}
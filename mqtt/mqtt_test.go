@@ -0,0 +1,195 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+var clients int64
+
+func runBroker(t *testing.T) *mochi.Server {
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	server.AddHook(new(auth.AllowHook), nil)
+	err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"}))
+	if err != nil {
+		t.Fatalf("failed to listen e=%s", err.Error())
+	}
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("failed to serve e=%s", err.Error())
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func newTestMQTT(t *testing.T, server *mochi.Server, config map[string]interface{}) *MQTT {
+	listener, _ := server.Listeners.Get("tcp")
+	c := map[string]interface{}{
+		"broker":    "tcp://" + listener.Address(),
+		"client_id": "reprow-test-" + strconv.FormatInt(atomic.AddInt64(&clients, 1), 10),
+		"topics":    []string{"jobs/#"},
+		"group":     "reprow",
+	}
+	for key, value := range config {
+		c[key] = value
+	}
+	queue, err := NewMQTT(c, logger)
+	if err != nil {
+		t.Fatalf("failed to make mqtt queue e=%s", err.Error())
+	}
+	t.Cleanup(func() { queue.Client.Disconnect(0) })
+	return queue
+}
+
+func mustPublish(t *testing.T, server *mochi.Server, topic string, payload map[string]interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	err = server.Publish(topic, b, false, 1)
+	if err != nil {
+		t.Fatalf("failed to publish e=%s", err.Error())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	servers := make(map[reprow.Queue]*mochi.Server)
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			server := runBroker(t)
+			queue := newTestMQTT(t, server, nil)
+			servers[queue] = server
+			return queue
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustPublish(t, servers[queue], "jobs/test", payload)
+		},
+	}.Run(t)
+}
+
+func TestMetadata(t *testing.T) {
+	server := runBroker(t)
+	queue := newTestMQTT(t, server, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPublish(t, server, "jobs/metadata", map[string]interface{}{"id": "metadata"})
+	job := mustReceive(t, stream)
+	metadata := reprow.JobMetadata(job)
+	if metadata["Topic"] != "jobs/metadata" || metadata["Qos"] != 1 {
+		t.Errorf("topic and qos should be in metadata got=%v", metadata)
+	}
+	job.End()
+}
+
+func TestRejectPublishesToDeadTopic(t *testing.T) {
+	server := runBroker(t)
+	queue := newTestMQTT(t, server, map[string]interface{}{
+		"topics":     []string{"jobs/#", "dead"},
+		"dead_topic": "dead",
+	})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPublish(t, server, "jobs/rejected", map[string]interface{}{"id": "rejected"})
+	mustReceive(t, stream).(reprow.Rejecter).Reject("invalid")
+
+	job := mustReceive(t, stream)
+	if topic := reprow.JobMetadata(job)["Topic"]; topic != "dead" {
+		t.Errorf("rejected job should be published to dead topic got=%v", topic)
+	}
+	if job.Payload()["id"] != "rejected" {
+		t.Errorf("payload should be kept got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func TestAbortWaitsRetryAfter(t *testing.T) {
+	server := runBroker(t)
+	queue := newTestMQTT(t, server, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPublish(t, server, "jobs/retried", map[string]interface{}{"id": "retried"})
+	started := time.Now()
+	mustReceive(t, stream).Abort(1)
+
+	job := mustReceive(t, stream)
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	if job.Payload()["id"] != "retried" {
+		t.Errorf("aborted job should be redelivered got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func TestStopUnsubscribes(t *testing.T) {
+	server := runBroker(t)
+	queue := newTestMQTT(t, server, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	queue.Stop()
+
+	if subscribers := server.Topics.Subscribers("jobs/test"); len(subscribers.Shared) != 0 {
+		t.Errorf("topic filters should be unsubscribed on stop got=%v", subscribers.Shared)
+	}
+
+	// message arriving after stop should not block handler
+	handled := make(chan bool)
+	go func() {
+		queue.handle(queue.Client, nil)
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Errorf("handler blocked after stop")
+	}
+
+	err := queue.Start(stream)
+	if err != nil {
+		t.Fatalf("failed to start again e=%s", err.Error())
+	}
+	defer queue.Stop()
+	mustPublish(t, server, "jobs/restarted", map[string]interface{}{"id": "restarted"})
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "restarted" {
+		t.Errorf("topic filters should be subscribed again on start got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
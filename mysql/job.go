@@ -0,0 +1,55 @@
+package mysql
+
+import (
+	"database/sql"
+)
+
+type Job struct {
+	payload map[string]interface{}
+	id      interface{}
+	tx      *sql.Tx
+	queue   *MySQL
+	ready   chan bool
+}
+
+func (j *Job) Queue() *MySQL {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns id of the row
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Id": j.id,
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	if j.payload == nil {
+		j.ready <- false
+		if j.tx != nil {
+			j.tx.Rollback()
+		}
+	} else {
+		j.ready <- true
+	}
+}
@@ -0,0 +1,263 @@
+// mysql package implements mysql table as reprow.Queue without q4m storage engine.
+// Rows are claimed with SELECT ... FOR UPDATE SKIP LOCKED available since MySQL 8.0,
+// and the transaction is held while the job is running in the same way q4m package does.
+//
+// Ended rows are deleted, or marked as done when done_column is given.
+// Aborted rows are kept with visible_after moved by retry after, so they are claimed again after the delay.
+// Rejected rows, and rows whose payload column fails to deserialize, are kept with visible_after set to
+// the maximum datetime, so they are never claimed again and can be inspected later.
+package mysql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/q4m"
+	"github.com/mitchellh/mapstructure"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	reprow.RegisterQueue("mysql", &MySQLBuilder{})
+}
+
+type MySQLBuilder struct{}
+
+func (b *MySQLBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewMySQL(config, logger)
+}
+
+func NewMySQL(config map[string]interface{}, logger seelog.LoggerInterface) (*MySQL, error) {
+	m := MySQL{}
+	err := m.configure(config, logger)
+	return &m, err
+}
+
+// MySQL implements mysql table as reprow.Queue
+type MySQL struct {
+	DB           *sql.DB
+	logger       seelog.LoggerInterface
+	config       Config
+	pollInterval time.Duration
+	claimQuery   string
+	wantDown     chan bool
+	running      bool
+	wg           sync.WaitGroup
+}
+
+type Config struct {
+	Dsn                string `valid:"required"`
+	Table              string `valid:"required"`
+	IdColumn           string `valid:"-" mapstructure:"id_column"`
+	VisibleAfterColumn string `valid:"-" mapstructure:"visible_after_column"`
+	DoneColumn         string `valid:"-" mapstructure:"done_column"`
+	PayloadColumn      string `valid:"-" mapstructure:"payload_column"`
+	PollInterval       string `valid:"-" mapstructure:"poll_interval"`
+}
+
+func (m *MySQL) Start(outChannel chan reprow.Job) error {
+	if m.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		m.running = true
+		m.wantDown = make(chan bool)
+		m.wg.Add(1)
+		go m.run(outChannel)
+		return nil
+	}
+}
+
+func (m *MySQL) run(outChannel chan reprow.Job) {
+	defer m.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: m,
+		}
+		select {
+		case outChannel <- &job:
+		case <-m.wantDown:
+			return
+		}
+		m.wg.Add(1)
+		go func(job *Job) {
+			defer job.finalize()
+			defer m.wg.Done()
+
+			found, err := m.claim(job)
+			if err != nil {
+				m.logger.Errorf("reprow/mysql: failed to claim row e=%s", err.Error())
+				time.Sleep(time.Second)
+				return
+			}
+			if !found {
+				m.logger.Debugf("no queue retrieved")
+				select {
+				case <-m.wantDown:
+				case <-time.After(m.pollInterval):
+				}
+			}
+		}(&job)
+	}
+}
+
+// claim locks a visible row in a new transaction. false is returned when no row is available
+func (m *MySQL) claim(job *Job) (bool, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	record, err := q4m.RowToMap(tx.QueryRow(m.claimQuery))
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return false, nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	job.tx = tx
+	job.id = record[m.config.IdColumn]
+	if m.config.PayloadColumn == "" {
+		job.payload = record
+		return true, nil
+	}
+
+	var value []byte
+	switch v := record[m.config.PayloadColumn].(type) {
+	case string:
+		value = []byte(v)
+	case []byte:
+		value = v
+	}
+	err = json.Unmarshal(value, &job.payload)
+	if err != nil {
+		m.Reject(job, "failed to deserialize payload: "+err.Error())
+		job.payload = nil
+		job.tx = nil
+	}
+	return true, nil
+}
+
+func (m *MySQL) Stop() error {
+	m.logger.Infof("stopping queue")
+	if m.running == false {
+		return errors.New("not running")
+	} else {
+		close(m.wantDown)
+		m.wg.Wait()
+		m.running = false
+		return nil
+	}
+}
+
+func (m *MySQL) Abort(job *Job, retryAfter int) {
+	_, err := job.tx.Exec(fmt.Sprintf("UPDATE %s SET %s = NOW() + INTERVAL ? SECOND WHERE %s = ?",
+		quoteIdentifier(m.config.Table),
+		quoteIdentifier(m.config.VisibleAfterColumn),
+		quoteIdentifier(m.config.IdColumn)), retryAfter, job.id)
+	if err != nil {
+		m.logger.Errorf("reprow/mysql: abort failed id=%v e=%s", job.id, err.Error())
+		job.tx.Rollback()
+		return
+	}
+	m.commit(job)
+}
+
+func (m *MySQL) End(job *Job) {
+	var err error
+	if m.config.DoneColumn == "" {
+		_, err = job.tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?",
+			quoteIdentifier(m.config.Table),
+			quoteIdentifier(m.config.IdColumn)), job.id)
+	} else {
+		_, err = job.tx.Exec(fmt.Sprintf("UPDATE %s SET %s = 1 WHERE %s = ?",
+			quoteIdentifier(m.config.Table),
+			quoteIdentifier(m.config.DoneColumn),
+			quoteIdentifier(m.config.IdColumn)), job.id)
+	}
+	if err != nil {
+		m.logger.Errorf("reprow/mysql: end failed id=%v e=%s", job.id, err.Error())
+		job.tx.Rollback()
+		return
+	}
+	m.commit(job)
+}
+
+// Reject keeps row with visible_after set to the maximum datetime so that it is never claimed again
+func (m *MySQL) Reject(job *Job, reason string) {
+	m.logger.Errorf("reprow/mysql: job rejected id=%v reason=%s", job.id, reason)
+	_, err := job.tx.Exec(fmt.Sprintf("UPDATE %s SET %s = '9999-12-31 23:59:59' WHERE %s = ?",
+		quoteIdentifier(m.config.Table),
+		quoteIdentifier(m.config.VisibleAfterColumn),
+		quoteIdentifier(m.config.IdColumn)), job.id)
+	if err != nil {
+		m.logger.Errorf("reprow/mysql: reject failed id=%v e=%s", job.id, err.Error())
+		job.tx.Rollback()
+		return
+	}
+	m.commit(job)
+}
+
+func (m *MySQL) commit(job *Job) {
+	err := job.tx.Commit()
+	if err != nil {
+		m.logger.Errorf("reprow/mysql: commit failed id=%v e=%s", job.id, err.Error())
+	}
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func (m *MySQL) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	m.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if config.IdColumn == "" {
+		config.IdColumn = "id"
+	}
+	if config.VisibleAfterColumn == "" {
+		config.VisibleAfterColumn = "visible_after"
+	}
+	m.pollInterval, err = reprow.ParseDuration(config.PollInterval, "1s")
+	if err != nil {
+		return errors.New("poll_interval failed to parse: " + err.Error())
+	}
+
+	m.config = config
+	condition := fmt.Sprintf("%s <= NOW()", quoteIdentifier(config.VisibleAfterColumn))
+	if config.DoneColumn != "" {
+		condition += fmt.Sprintf(" AND %s = 0", quoteIdentifier(config.DoneColumn))
+	}
+	m.claimQuery = fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY %s LIMIT 1 FOR UPDATE SKIP LOCKED",
+		quoteIdentifier(config.Table),
+		condition,
+		quoteIdentifier(config.VisibleAfterColumn))
+
+	db, err := q4m.OpenDB(config.Dsn)
+	if err != nil {
+		return err
+	}
+	m.DB = db
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package mysql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cihub/seelog"
+	"github.com/lestrrat/go-tcputil"
+	"github.com/lestrrat/go-test-mysqld"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+	table     = "reprow_test_queue"
+)
+
+func TestStart(t *testing.T) {
+	mysqld, dsn, err := launchMysqld()
+	if err != nil {
+		t.Skipf("mysqld failed to initialized e=%s", err.Error())
+	}
+	defer mysqld.Stop()
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("failed to open db e=%s", err.Error())
+	}
+	defer db.Close()
+
+	t.Run("Conformance", func(t *testing.T) {
+		reprowtest.QueueSuite{
+			NewQueue: func(t *testing.T) reprow.Queue {
+				mustResetTable(t, db)
+				return newTestMySQL(t, dsn, "")
+			},
+			Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+				mustInsert(t, db, payload)
+			},
+		}.Run(t)
+	})
+	t.Run("RetryAfter", func(t *testing.T) {
+		mustResetTable(t, db)
+		testRetryAfter(t, db, dsn)
+	})
+	t.Run("DoneColumn", func(t *testing.T) {
+		mustResetTable(t, db)
+		testDoneColumn(t, db, dsn)
+	})
+	t.Run("InvalidPayload", func(t *testing.T) {
+		mustResetTable(t, db)
+		testInvalidPayload(t, db, dsn)
+	})
+}
+
+func testRetryAfter(t *testing.T, db *sql.DB, dsn string) {
+	queue := newTestMySQL(t, dsn, "")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustInsert(t, db, map[string]interface{}{"id": "delayed"})
+	started := time.Now()
+	mustReceive(t, stream).Abort(2)
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "delayed" {
+		t.Errorf("delayed job not delivered got=%v", job.Payload())
+	}
+	// visible_after has second precision
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	job.End()
+}
+
+func testDoneColumn(t *testing.T, db *sql.DB, dsn string) {
+	queue := newTestMySQL(t, dsn, "done")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustInsert(t, db, map[string]interface{}{"id": "done"})
+	mustReceive(t, stream).End()
+
+	var count int
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE done = 1", table)).Scan(&count)
+	if err != nil {
+		t.Fatalf("count not retrieved e=%s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("ended row should be marked as done count=%d", count)
+	}
+}
+
+func testInvalidPayload(t *testing.T, db *sql.DB, dsn string) {
+	queue := newTestMySQL(t, dsn, "")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	_, err := db.Exec(fmt.Sprintf("INSERT INTO %s (payload) VALUES ('{')", table))
+	if err != nil {
+		t.Fatalf("failed to insert e=%s", err.Error())
+	}
+	mustInsert(t, db, map[string]interface{}{"id": "valid"})
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "valid" {
+		t.Errorf("row with invalid payload should be skipped got=%v", job.Payload())
+	}
+	job.End()
+
+	var count int
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE visible_after = '9999-12-31 23:59:59'", table)).Scan(&count)
+	if err != nil {
+		t.Fatalf("count not retrieved e=%s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("row with invalid payload should be kept with maximum visible_after count=%d", count)
+	}
+}
+
+func newTestMySQL(t *testing.T, dsn string, doneColumn string) *MySQL {
+	queue, err := NewMySQL(map[string]interface{}{
+		"dsn":            dsn,
+		"table":          table,
+		"payload_column": "payload",
+		"done_column":    doneColumn,
+		"poll_interval":  "100ms",
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make mysql queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func mustResetTable(t *testing.T, db *sql.DB) {
+	for _, stmt := range []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", table),
+		fmt.Sprintf("CREATE TABLE %s (id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY, payload text NOT NULL, visible_after datetime NOT NULL DEFAULT CURRENT_TIMESTAMP, done tinyint NOT NULL DEFAULT 0)", table),
+	} {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("failed to reset table e=%s", err.Error())
+		}
+	}
+}
+
+func mustInsert(t *testing.T, db *sql.DB, payload map[string]interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	_, err = db.Exec(fmt.Sprintf("INSERT INTO %s (payload) VALUES (?)", table), string(b))
+	if err != nil {
+		t.Fatalf("failed to insert e=%s", err.Error())
+	}
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
+
+func launchMysqld() (*mysqltest.TestMysqld, string, error) {
+	port, err := tcputil.EmptyPort()
+	if err != nil {
+		return nil, "", errors.New("port not retrieved " + err.Error())
+	}
+	config := mysqltest.NewConfig()
+	config.SkipNetworking = false
+	config.Port = port
+	if mysqldPath := os.Getenv("MYSQLD"); len(mysqldPath) > 0 {
+		config.Mysqld = mysqldPath
+	}
+	if mysqlInstallDbPath := os.Getenv("MYSQL_INSTALL_DB"); len(mysqlInstallDbPath) > 0 {
+		config.MysqlInstallDb = mysqlInstallDbPath
+	}
+
+	mysqld, err := mysqltest.NewMysqld(config)
+	if err != nil {
+		return nil, "", errors.New("faield to initialize mysqld " + err.Error())
+	}
+	return mysqld, fmt.Sprintf("root@tcp(127.0.0.1:%d)/mysql", port), nil
+}
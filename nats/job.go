@@ -0,0 +1,66 @@
+package nats
+
+import (
+	natsgo "github.com/nats-io/nats.go"
+	"sync"
+)
+
+type Job struct {
+	payload  map[string]interface{}
+	message  *natsgo.Msg
+	metadata *natsgo.MsgMetadata
+	running  chan bool
+	once     sync.Once
+	queue    *NATS
+	ready    chan bool
+}
+
+func (j *Job) Queue() *NATS {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns subject, stream sequence and how many times the message was delivered
+func (j *Job) Metadata() map[string]interface{} {
+	metadata := map[string]interface{}{
+		"Subject": j.message.Subject,
+	}
+	if j.metadata != nil {
+		metadata["Stream"] = j.metadata.Stream
+		metadata["StreamSequence"] = j.metadata.Sequence.Stream
+		metadata["DeliveryCount"] = j.metadata.NumDelivered
+	}
+	return metadata
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	j.ready <- j.payload != nil
+}
+
+// finish stops marking job as in progress
+func (j *Job) finish() {
+	j.once.Do(func() {
+		if j.running != nil {
+			close(j.running)
+		}
+	})
+}
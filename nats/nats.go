@@ -0,0 +1,277 @@
+// nats package implements NATS JetStream durable pull consumer as reprow.Queue.
+// Producers should publish json encoded payloads to a subject captured by a JetStream stream.
+//
+// Messages are fetched in batches sized to the free runner slots in the same way sqs package buffers requests.
+// Ended messages are acked, aborted messages are nacked with retry after as delay, and rejected messages are terminated.
+// Running jobs are marked as in progress so that long running jobs do not exceed ack wait.
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	natsgo "github.com/nats-io/nats.go"
+	"sync"
+	"time"
+)
+
+var (
+	MaxBatchSize = 10
+)
+
+func init() {
+	reprow.RegisterQueue("nats", &NATSBuilder{})
+}
+
+type NATSBuilder struct{}
+
+func (b *NATSBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewNATS(config, logger)
+}
+
+func NewNATS(config map[string]interface{}, logger seelog.LoggerInterface) (*NATS, error) {
+	n := NATS{}
+	err := n.configure(config, logger)
+	return &n, err
+}
+
+// NATS implements NATS JetStream as reprow.Queue
+type NATS struct {
+	Conn               *natsgo.Conn
+	subscription       *natsgo.Subscription
+	logger             seelog.LoggerInterface
+	config             Config
+	bufferTimeout      time.Duration
+	fetchTimeout       time.Duration
+	inProgressInterval time.Duration
+	wantDown           chan bool
+	running            bool
+	wg                 sync.WaitGroup
+}
+
+type Config struct {
+	Url           string `valid:"-"`
+	Stream        string `valid:"-"`
+	Subject       string `valid:"required"`
+	Durable       string `valid:"required"`
+	DeadSubject   string `valid:"-" mapstructure:"dead_subject"`
+	AckWait       string `valid:"-" mapstructure:"ack_wait"`
+	BufferTimeout string `valid:"-" mapstructure:"buffer_timeout"`
+	FetchTimeout  string `valid:"-" mapstructure:"fetch_timeout"`
+}
+
+func (n *NATS) Start(outChannel chan reprow.Job) error {
+	if n.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		n.running = true
+		n.wantDown = make(chan bool)
+		n.wg.Add(1)
+		go n.run(outChannel)
+		return nil
+	}
+}
+
+func (n *NATS) run(outChannel chan reprow.Job) {
+	defer n.wg.Done()
+
+	for {
+		// Placeholders are only taken while runner has free slots,
+		// so number of placeholders buffered here is number of messages to fetch.
+		jobs := make([]*Job, 0, MaxBatchSize)
+		for len(jobs) < MaxBatchSize {
+			// Placeholder might be finalized before its WaitFinalize is called when runner has no free slot,
+			// so finalizing should not wait for it or Stop would never return.
+			job := Job{
+				ready: make(chan bool, 1),
+				queue: n,
+			}
+			timeout := time.After(n.bufferTimeout)
+			if len(jobs) == 0 {
+				timeout = nil
+			}
+
+			var sent bool
+			select {
+			case outChannel <- &job:
+				sent = true
+			case <-timeout:
+				n.logger.Debugf("Buffering timeout reached proceed to making a request")
+			case <-n.wantDown:
+			}
+			if !sent {
+				break
+			}
+			jobs = append(jobs, &job)
+		}
+
+		if len(jobs) == 0 {
+			return
+		}
+		n.wg.Add(1)
+		go func(jobs []*Job) {
+			defer n.wg.Done()
+			n.finalizeJobs(jobs)
+		}(jobs)
+	}
+}
+
+func (n *NATS) finalizeJobs(jobs []*Job) {
+	messages, err := n.subscription.Fetch(len(jobs), natsgo.MaxWait(n.fetchTimeout))
+	if err != nil && !errors.Is(err, natsgo.ErrTimeout) {
+		n.logger.Errorf("reprow/nats: failed to fetch e=%s", err.Error())
+		time.Sleep(time.Second)
+	}
+	if len(messages) == 0 {
+		n.logger.Debugf("no queue retrieved")
+	}
+
+	for i, job := range jobs {
+		if i < len(messages) {
+			n.prepare(job, messages[i])
+		}
+		job.finalize()
+	}
+}
+
+func (n *NATS) prepare(job *Job, message *natsgo.Msg) {
+	job.message = message
+	job.metadata, _ = message.Metadata()
+
+	err := json.Unmarshal(message.Data, &job.payload)
+	if err != nil {
+		n.logger.Errorf("reprow/nats: failed to deserialize job. terminating err=%s", err.Error())
+		n.Reject(job, "failed to deserialize")
+		job.payload = nil
+		return
+	}
+
+	job.running = make(chan bool)
+	go n.keepInProgress(job)
+}
+
+// keepInProgress resets ack wait of job until it is finished
+func (n *NATS) keepInProgress(job *Job) {
+	ticker := time.NewTicker(n.inProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.running:
+			return
+		case <-ticker.C:
+			err := job.message.InProgress()
+			if err != nil {
+				n.logger.Errorf("reprow/nats: in progress failed e=%s", err.Error())
+			}
+		}
+	}
+}
+
+func (n *NATS) Stop() error {
+	n.logger.Infof("stopping queue")
+	if n.running == false {
+		return errors.New("not running")
+	} else {
+		close(n.wantDown)
+		n.wg.Wait()
+		n.running = false
+		return nil
+	}
+}
+
+func (n *NATS) Abort(job *Job, retryAfter int) {
+	job.finish()
+	var err error
+	if retryAfter > 0 {
+		err = job.message.NakWithDelay(time.Duration(retryAfter) * time.Second)
+	} else {
+		err = job.message.Nak()
+	}
+	if err != nil {
+		n.logger.Errorf("reprow/nats: abort failed e=%s", err.Error())
+	}
+}
+
+func (n *NATS) End(job *Job) {
+	job.finish()
+	err := job.message.Ack()
+	if err != nil {
+		n.logger.Errorf("reprow/nats: end failed e=%s", err.Error())
+	}
+}
+
+func (n *NATS) Reject(job *Job, reason string) {
+	n.logger.Errorf("reprow/nats: job rejected subject=%s reason=%s", job.message.Subject, reason)
+	job.finish()
+
+	if n.config.DeadSubject != "" {
+		message := natsgo.NewMsg(n.config.DeadSubject)
+		message.Data = job.message.Data
+		message.Header.Set("Reprow-Reason", reason)
+		message.Header.Set("Reprow-Subject", job.message.Subject)
+		err := n.Conn.PublishMsg(message)
+		if err != nil {
+			n.logger.Errorf("reprow/nats: failed to publish to dead subject e=%s", err.Error())
+			job.message.Nak()
+			return
+		}
+	}
+	err := job.message.Term()
+	if err != nil {
+		n.logger.Errorf("reprow/nats: reject failed e=%s", err.Error())
+	}
+}
+
+func (n *NATS) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	n.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if config.Url == "" {
+		config.Url = natsgo.DefaultURL
+	}
+	ackWait, err := reprow.ParseDuration(config.AckWait, "30s")
+	if err != nil {
+		return errors.New("ack_wait failed to parse: " + err.Error())
+	}
+	n.inProgressInterval = ackWait / 2
+	n.bufferTimeout, err = reprow.ParseDuration(config.BufferTimeout, "100ms")
+	if err != nil {
+		return errors.New("buffer_timeout failed to parse: " + err.Error())
+	}
+	n.fetchTimeout, err = reprow.ParseDuration(config.FetchTimeout, "5s")
+	if err != nil {
+		return errors.New("fetch_timeout failed to parse: " + err.Error())
+	}
+	n.config = config
+
+	n.Conn, err = natsgo.Connect(config.Url, natsgo.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	js, err := n.Conn.JetStream()
+	if err != nil {
+		return err
+	}
+
+	options := []natsgo.SubOpt{natsgo.AckWait(ackWait)}
+	if config.Stream != "" {
+		options = append(options, natsgo.BindStream(config.Stream))
+	}
+	n.subscription, err = js.PullSubscribe(config.Subject, config.Durable, options...)
+	if err != nil {
+		return errors.New("failed to subscribe: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package nats
+
+import (
+	"encoding/json"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"github.com/nats-io/nats-server/v2/server"
+	natsgo "github.com/nats-io/nats.go"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+// runServer runs embedded nats server with JetStream and a stream capturing reprow_test subjects
+func runServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("failed to make nats server e=%s", err.Error())
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+
+	conn, err := natsgo.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect e=%s", err.Error())
+	}
+	defer conn.Close()
+	js, _ := conn.JetStream()
+	_, err = js.AddStream(&natsgo.StreamConfig{Name: "REPROW_TEST", Subjects: []string{"reprow_test.>"}})
+	if err != nil {
+		t.Fatalf("failed to add stream e=%s", err.Error())
+	}
+	return s
+}
+
+func newTestNATS(t *testing.T, s *server.Server) *NATS {
+	queue, err := NewNATS(map[string]interface{}{
+		"url":           s.ClientURL(),
+		"stream":        "REPROW_TEST",
+		"subject":       "reprow_test.jobs",
+		"durable":       "reprow",
+		"dead_subject":  "reprow_test.dead",
+		"ack_wait":      "2s",
+		"fetch_timeout": "500ms",
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make nats queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func mustPublish(t *testing.T, s *server.Server, payload map[string]interface{}) {
+	conn, err := natsgo.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect e=%s", err.Error())
+	}
+	defer conn.Close()
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	js, _ := conn.JetStream()
+	_, err = js.Publish("reprow_test.jobs", b)
+	if err != nil {
+		t.Fatalf("failed to publish e=%s", err.Error())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	var s *server.Server
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			s = runServer(t)
+			return newTestNATS(t, s)
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustPublish(t, s, payload)
+		},
+	}.Run(t)
+}
+
+func TestRetryAfterAndReject(t *testing.T) {
+	s := runServer(t)
+	queue := newTestNATS(t, s)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPublish(t, s, map[string]interface{}{"id": "delayed"})
+	started := time.Now()
+	mustReceive(t, stream).Abort(1)
+
+	job := mustReceive(t, stream)
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	metadata := reprow.JobMetadata(job)
+	if metadata["DeliveryCount"] != uint64(2) || metadata["StreamSequence"] != uint64(1) {
+		t.Errorf("unexpected metadata got=%v", metadata)
+	}
+
+	dead, err := queue.Conn.SubscribeSync("reprow_test.dead")
+	if err != nil {
+		t.Fatalf("failed to subscribe e=%s", err.Error())
+	}
+	job.(reprow.Rejecter).Reject("invalid")
+	message, err := dead.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("rejected job should be published to dead subject e=%s", err.Error())
+	}
+	if reason := message.Header.Get("Reprow-Reason"); reason != "invalid" {
+		t.Errorf("reason should be recorded got=%s", reason)
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	s := runServer(t)
+	queue := newTestNATS(t, s)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPublish(t, s, map[string]interface{}{"id": "long"})
+	job := mustReceive(t, stream)
+
+	// Running longer than ack wait should not cause redelivery
+	deadline := time.After(3 * time.Second)
+	for waiting := true; waiting; {
+		select {
+		case placeholder := <-stream:
+			if placeholder.WaitFinalize() {
+				t.Fatalf("running job was redelivered")
+			}
+		case <-deadline:
+			waiting = false
+		}
+	}
+	job.End()
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
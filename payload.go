@@ -0,0 +1,30 @@
+package reprow
+
+import (
+	"strings"
+)
+
+// LookupField returns value in payload specified by dot separated path such as "user.id".
+// Second return value is false when any part of the path does not exist.
+func LookupField(payload map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		switch m := current.(type) {
+		case map[string]interface{}:
+			v, found := m[key]
+			if !found {
+				return nil, false
+			}
+			current = v
+		case map[interface{}]interface{}:
+			v, found := m[key]
+			if !found {
+				return nil, false
+			}
+			current = v
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
@@ -0,0 +1,343 @@
+// postgres package implements postgresql table as reprow.Queue.
+// Rows are claimed with SELECT ... FOR UPDATE SKIP LOCKED, and the transaction is held while the job is running
+// in the same way q4m package does.
+//
+// Ended rows are deleted. Aborted rows are kept with run_at moved by retry after, so they are claimed again after the delay.
+// Rejected rows, and rows whose payload column is not a json object, are kept with run_at set to 'infinity',
+// so they are never claimed again and can be inspected later.
+// Consumers LISTEN to the channel and wake up on NOTIFY, and poll the table at poll_interval in case notifications are lost.
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/lib/pq"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"sync"
+	"time"
+)
+
+func init() {
+	reprow.RegisterQueue("postgres", &PostgresBuilder{})
+}
+
+type PostgresBuilder struct{}
+
+func (b *PostgresBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewPostgres(config, logger)
+}
+
+func NewPostgres(config map[string]interface{}, logger seelog.LoggerInterface) (*Postgres, error) {
+	p := Postgres{}
+	err := p.configure(config, logger)
+	return &p, err
+}
+
+// Postgres implements postgresql table as reprow.Queue
+type Postgres struct {
+	DB           *sql.DB
+	logger       seelog.LoggerInterface
+	config       Config
+	pollInterval time.Duration
+	listener     *pq.Listener
+	claimQuery   string
+	wakeup       chan bool
+	wakeupMutex  sync.Mutex
+	wantDown     chan bool
+	running      bool
+	wg           sync.WaitGroup
+}
+
+type Config struct {
+	Dsn            string `valid:"required"`
+	Table          string `valid:"required"`
+	IdColumn       string `valid:"-" mapstructure:"id_column"`
+	RunAtColumn    string `valid:"-" mapstructure:"run_at_column"`
+	AttemptsColumn string `valid:"-" mapstructure:"attempts_column"`
+	PayloadColumn  string `valid:"-" mapstructure:"payload_column"`
+	Channel        string `valid:"-"`
+	PollInterval   string `valid:"-" mapstructure:"poll_interval"`
+}
+
+func (p *Postgres) Start(outChannel chan reprow.Job) error {
+	if p.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		p.running = true
+		p.wantDown = make(chan bool)
+		p.wakeup = make(chan bool)
+		p.listener = pq.NewListener(p.config.Dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				p.logger.Errorf("reprow/postgres: listener error e=%s", err.Error())
+			}
+		})
+		err := p.listener.Listen(p.config.Channel)
+		if err != nil {
+			p.logger.Errorf("reprow/postgres: failed to listen channel=%s e=%s", p.config.Channel, err.Error())
+		}
+		p.wg.Add(2)
+		go p.listen(p.listener)
+		go p.run(outChannel)
+		return nil
+	}
+}
+
+func (p *Postgres) run(outChannel chan reprow.Job) {
+	defer p.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: p,
+		}
+		select {
+		case outChannel <- &job:
+		case <-p.wantDown:
+			return
+		}
+		p.wg.Add(1)
+		go func(job *Job) {
+			defer job.finalize()
+			defer p.wg.Done()
+
+			wakeup := p.waitWakeup()
+			found, err := p.claim(job)
+			if err != nil {
+				p.logger.Errorf("reprow/postgres: failed to claim row e=%s", err.Error())
+				time.Sleep(time.Second)
+				return
+			}
+			if !found {
+				p.logger.Debugf("no queue retrieved")
+				select {
+				case <-wakeup:
+				case <-p.wantDown:
+				case <-time.After(p.pollInterval):
+				}
+			}
+		}(&job)
+	}
+}
+
+// claim locks a row whose run_at has come in a new transaction. false is returned when no row is available
+func (p *Postgres) claim(job *Job) (bool, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.Query(p.claimQuery)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	record, err := scanRecord(rows)
+	rows.Close()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if record == nil {
+		tx.Rollback()
+		return false, nil
+	}
+
+	job.tx = tx
+	job.id = record[p.config.IdColumn]
+	if p.config.AttemptsColumn != "" {
+		err = tx.QueryRow(fmt.Sprintf("UPDATE %s SET %s = %s + 1 WHERE %s = $1 RETURNING %s",
+			pq.QuoteIdentifier(p.config.Table),
+			pq.QuoteIdentifier(p.config.AttemptsColumn), pq.QuoteIdentifier(p.config.AttemptsColumn),
+			pq.QuoteIdentifier(p.config.IdColumn),
+			pq.QuoteIdentifier(p.config.AttemptsColumn)), job.id).Scan(&job.attempts)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if p.config.PayloadColumn == "" {
+		job.payload = record
+	} else {
+		payload, ok := record[p.config.PayloadColumn].(map[string]interface{})
+		if !ok {
+			p.Reject(job, "payload column is not json object")
+			job.tx = nil
+			return true, nil
+		}
+		job.payload = payload
+	}
+	return true, nil
+}
+
+// listen wakes up waiting jobs when notification arrives until queue is stopped
+func (p *Postgres) listen(listener *pq.Listener) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-listener.NotificationChannel():
+			// nil notification is sent on reconnect, and rows might have been added meanwhile
+			p.notifyWakeup()
+		case <-p.wantDown:
+			listener.Close()
+			return
+		}
+	}
+}
+
+// waitWakeup returns channel that is closed on next notification
+func (p *Postgres) waitWakeup() chan bool {
+	p.wakeupMutex.Lock()
+	defer p.wakeupMutex.Unlock()
+	return p.wakeup
+}
+
+func (p *Postgres) notifyWakeup() {
+	p.wakeupMutex.Lock()
+	defer p.wakeupMutex.Unlock()
+	close(p.wakeup)
+	p.wakeup = make(chan bool)
+}
+
+func (p *Postgres) Stop() error {
+	p.logger.Infof("stopping queue")
+	if p.running == false {
+		return errors.New("not running")
+	} else {
+		close(p.wantDown)
+		p.wg.Wait()
+		p.running = false
+		return nil
+	}
+}
+
+func (p *Postgres) Abort(job *Job, retryAfter int) {
+	_, err := job.tx.Exec(fmt.Sprintf("UPDATE %s SET %s = now() + $1 * interval '1 second' WHERE %s = $2",
+		pq.QuoteIdentifier(p.config.Table),
+		pq.QuoteIdentifier(p.config.RunAtColumn),
+		pq.QuoteIdentifier(p.config.IdColumn)), retryAfter, job.id)
+	if err != nil {
+		p.logger.Errorf("reprow/postgres: abort failed id=%v e=%s", job.id, err.Error())
+		job.tx.Rollback()
+		return
+	}
+	p.commit(job)
+}
+
+func (p *Postgres) End(job *Job) {
+	_, err := job.tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = $1",
+		pq.QuoteIdentifier(p.config.Table),
+		pq.QuoteIdentifier(p.config.IdColumn)), job.id)
+	if err != nil {
+		p.logger.Errorf("reprow/postgres: end failed id=%v e=%s", job.id, err.Error())
+		job.tx.Rollback()
+		return
+	}
+	p.commit(job)
+}
+
+// Reject keeps row with run_at set to infinity so that it is never claimed again
+func (p *Postgres) Reject(job *Job, reason string) {
+	p.logger.Errorf("reprow/postgres: job rejected id=%v reason=%s", job.id, reason)
+	_, err := job.tx.Exec(fmt.Sprintf("UPDATE %s SET %s = 'infinity' WHERE %s = $1",
+		pq.QuoteIdentifier(p.config.Table),
+		pq.QuoteIdentifier(p.config.RunAtColumn),
+		pq.QuoteIdentifier(p.config.IdColumn)), job.id)
+	if err != nil {
+		p.logger.Errorf("reprow/postgres: reject failed id=%v e=%s", job.id, err.Error())
+		job.tx.Rollback()
+		return
+	}
+	p.commit(job)
+}
+
+func (p *Postgres) commit(job *Job) {
+	err := job.tx.Commit()
+	if err != nil {
+		p.logger.Errorf("reprow/postgres: commit failed id=%v e=%s", job.id, err.Error())
+	}
+}
+
+// scanRecord reads the first row as map. json columns are decoded. nil is returned when there is no row
+func scanRecord(rows *sql.Rows) (map[string]interface{}, error) {
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &(values[i])
+	}
+	err = rows.Scan(scanArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make(map[string]interface{})
+	for i, col := range columns {
+		switch col.DatabaseTypeName() {
+		case "JSON", "JSONB":
+			var value interface{}
+			if b, ok := values[i].([]byte); ok {
+				err = json.Unmarshal(b, &value)
+				if err != nil {
+					return nil, err
+				}
+			}
+			record[col.Name()] = value
+		default:
+			record[col.Name()] = values[i]
+		}
+	}
+	return record, nil
+}
+
+func (p *Postgres) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	p.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if config.IdColumn == "" {
+		config.IdColumn = "id"
+	}
+	if config.RunAtColumn == "" {
+		config.RunAtColumn = "run_at"
+	}
+	if config.Channel == "" {
+		config.Channel = config.Table
+	}
+	p.pollInterval, err = reprow.ParseDuration(config.PollInterval, "5s")
+	if err != nil {
+		return errors.New("poll_interval failed to parse: " + err.Error())
+	}
+
+	p.config = config
+	p.claimQuery = fmt.Sprintf("SELECT * FROM %s WHERE %s <= now() ORDER BY %s LIMIT 1 FOR UPDATE SKIP LOCKED",
+		pq.QuoteIdentifier(config.Table),
+		pq.QuoteIdentifier(config.RunAtColumn),
+		pq.QuoteIdentifier(config.RunAtColumn))
+
+	db, err := sql.Open("postgres", config.Dsn)
+	if err != nil {
+		return err
+	}
+	p.DB = db
+
+	return nil
+}
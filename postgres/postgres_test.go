@@ -0,0 +1,146 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+const table = "reprow_test_queue"
+
+// testDB connects to database given by REPROW_TEST_POSTGRES_DSN and recreates the table
+func testDB(t *testing.T) (*sql.DB, string) {
+	dsn := os.Getenv("REPROW_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("REPROW_TEST_POSTGRES_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to connect e=%s", err.Error())
+	}
+	for _, query := range []string{
+		"DROP TABLE IF EXISTS " + table,
+		"CREATE TABLE " + table + " (id bigserial PRIMARY KEY, payload jsonb NOT NULL, run_at timestamptz NOT NULL DEFAULT now(), attempts int NOT NULL DEFAULT 0)",
+	} {
+		_, err = db.Exec(query)
+		if err != nil {
+			t.Fatalf("failed to create table e=%s", err.Error())
+		}
+	}
+	return db, dsn
+}
+
+func newTestPostgres(t *testing.T, dsn string) *Postgres {
+	queue, err := NewPostgres(map[string]interface{}{
+		"dsn":             dsn,
+		"table":           table,
+		"payload_column":  "payload",
+		"attempts_column": "attempts",
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make postgres queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func mustInsert(t *testing.T, db *sql.DB, payload map[string]interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	_, err = db.Exec("INSERT INTO "+table+" (payload) VALUES ($1)", string(b))
+	if err != nil {
+		t.Fatalf("failed to insert e=%s", err.Error())
+	}
+	_, err = db.Exec("NOTIFY " + table)
+	if err != nil {
+		t.Fatalf("failed to notify e=%s", err.Error())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	var db *sql.DB
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			var dsn string
+			db, dsn = testDB(t)
+			return newTestPostgres(t, dsn)
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustInsert(t, db, payload)
+		},
+	}.Run(t)
+}
+
+func TestRetryAfter(t *testing.T) {
+	db, dsn := testDB(t)
+	queue := newTestPostgres(t, dsn)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustInsert(t, db, map[string]interface{}{"id": "delayed"})
+	started := time.Now()
+	mustReceive(t, stream).Abort(1)
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "delayed" {
+		t.Errorf("delayed job not delivered got=%v", job.Payload())
+	}
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	if attempts := reprow.JobMetadata(job)["Attempts"]; attempts != 2 {
+		t.Errorf("attempts should be 2 got=%v", attempts)
+	}
+	job.End()
+}
+
+func TestInvalidPayload(t *testing.T) {
+	db, dsn := testDB(t)
+	queue := newTestPostgres(t, dsn)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	_, err := db.Exec("INSERT INTO " + table + " (payload) VALUES ('[1, 2]')")
+	if err != nil {
+		t.Fatalf("failed to insert e=%s", err.Error())
+	}
+	mustInsert(t, db, map[string]interface{}{"id": "valid"})
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "valid" {
+		t.Errorf("row with invalid payload should be skipped got=%v", job.Payload())
+	}
+	job.End()
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE run_at = 'infinity'").Scan(&count)
+	if err != nil {
+		t.Fatalf("failed to count e=%s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("row with invalid payload should be kept with run_at set to infinity count=%d", count)
+	}
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
@@ -1,15 +1,17 @@
 package q4m
 
 import (
-	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
 )
 
 type Job struct {
-	payload map[string]interface{}
-	tx      *sql.Tx
-	queue   *Q4M
-	ready   chan bool
+	payload  map[string]interface{}
+	row      map[string]interface{}
+	slot     *slot
+	table    string
+	attempts int
+	queue    *Q4M
+	ready    chan bool
 }
 
 func (j *Job) Queue() *Q4M {
@@ -19,27 +21,31 @@ func (j *Job) Queue() *Q4M {
 func (j *Job) Payload() map[string]interface{} {
 	return j.payload
 }
-func (j *Job) Abort(retryAfter int) {
-	if retryAfter > 0 {
-		j.queue.logger.Errorf("Retry after is not supported for this queue backend")
+
+// Metadata returns shard and table the row was dequeued from, and attempts read from attempts_column
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Shard":    j.slot.shard.name,
+		"Table":    j.table,
+		"Attempts": j.attempts,
 	}
-	j.queue.Abort(j)
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
 }
 func (j *Job) End() {
 	j.queue.End(j)
 }
 
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
 func (j *Job) WaitFinalize() bool {
 	return <-j.ready
 }
 
 func (job *Job) finalize() {
-	if job.payload == nil {
-		job.ready <- false
-		if job.tx != nil {
-			job.queue.abortTx(job.tx)
-		}
-	} else {
-		job.ready <- true
-	}
+	job.ready <- job.payload != nil
 }
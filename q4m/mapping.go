@@ -0,0 +1,115 @@
+package q4m
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	// EncodingBase64 encodes binary columns as base64 strings, which is how []byte was encoded to json
+	EncodingBase64 = "base64"
+	// EncodingHex encodes binary columns as hex strings
+	EncodingHex = "hex"
+	// EncodingUTF8 passes binary columns as strings as they are
+	EncodingUTF8 = "utf8"
+)
+
+var (
+	// identifierPattern matches names of tables and columns accepted in config
+	identifierPattern = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+)
+
+// validTable reports whether table is an identifier optionally qualified with database like "db.table"
+func validTable(table string) bool {
+	parts := strings.Split(table, ".")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if !identifierPattern.MatchString(part) {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// quoteTable quotes table qualified with database part by part
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = quoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// mapRow makes payload from row read by RowToMap.
+// Only columns are taken when they are given, fields of json columns are merged into payload,
+// and binary values are encoded as strings.
+func (q *Q4M) mapRow(row map[string]interface{}) (map[string]interface{}, error) {
+	payload := make(map[string]interface{}, len(row))
+	if len(q.config.Columns) == 0 {
+		for column, value := range row {
+			payload[column] = value
+		}
+	} else {
+		for _, column := range q.config.Columns {
+			value, ok := row[column]
+			if !ok {
+				return nil, errors.New("column not found column=" + column)
+			}
+			payload[column] = value
+		}
+	}
+
+	for _, column := range q.config.JsonColumns {
+		var text []byte
+		switch v := row[column].(type) {
+		case nil:
+			continue
+		case string:
+			text = []byte(v)
+		case []byte:
+			text = v
+		}
+		var value interface{}
+		err := json.Unmarshal(text, &value)
+		if err != nil {
+			return nil, errors.New("failed to decode json column=" + column + ": " + err.Error())
+		}
+		if object, ok := value.(map[string]interface{}); ok {
+			// fields of json object override columns of the same name
+			delete(payload, column)
+			for key, field := range object {
+				payload[key] = field
+			}
+		} else {
+			payload[column] = value
+		}
+	}
+
+	for column, value := range payload {
+		if b, ok := value.([]byte); ok {
+			payload[column] = q.encodeBinary(b)
+		}
+	}
+	return payload, nil
+}
+
+func (q *Q4M) encodeBinary(b []byte) string {
+	switch q.config.BinaryEncoding {
+	case EncodingHex:
+		return hex.EncodeToString(b)
+	case EncodingUTF8:
+		return string(b)
+	default:
+		return base64.StdEncoding.EncodeToString(b)
+	}
+}
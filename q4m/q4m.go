@@ -1,19 +1,45 @@
 // q4m package implements q4m as reprow.Queue.
 // q4m is a message queue implemented as mysql storage engine see http://q4m.github.io/ for detail
+//
+// Multiple tables can be consumed with tables. They are passed to queue_wait in the given order,
+// so a row in an earlier table is always dequeued before rows in later tables.
+//
+// Retry after is supported when not_before_column is given. Aborted rows are requeued as new rows
+// with not_before_column set to unix time of retry after, and rows are waited with condition on the column,
+// so rows not yet due are left in the table. Rows aborted max_attempts times are moved to dead_table,
+// counting attempts in attempts_column.
+//
+// Rows are dequeued on long-lived connections, each of which holds a row until it is ended or aborted.
+// A connection is taken for each job the runner receives, and concurrency limits the number of them when given.
+// Failures to connect or to wait are retried with exponential backoff up to max_backoff.
+//
+// Tables partitioned over several mysqld can be consumed by giving dsns. Each shard has its own wait loop
+// sharing concurrency, and a job is ended or aborted on the connection of its shard.
+// Unreachable shards are skipped with backoff until they recover, and Stats reports counts of jobs per shard.
+//
+// Payload is the row as map from column name to value, which can be narrowed with columns.
+// Json encoded columns given as json_columns are decoded and their fields are merged into payload,
+// and binary columns are encoded as strings with binary_encoding. Columns are checked to exist on configure,
+// and rows which still fail to be mapped are moved to dead_table, which is required with either of them.
 package q4m
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/arnehormann/sqlinternals/mysqlinternals"
 	"github.com/asaskevich/govalidator"
 	"github.com/cihub/seelog"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/maedama/reprow"
 	"github.com/mitchellh/mapstructure"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func init() {
@@ -34,17 +60,38 @@ func NewQ4M(config map[string]interface{}, logger seelog.LoggerInterface) (*Q4M,
 
 // Q4M implements q4m as reprow.Queue
 type Q4M struct {
-	DB       *sql.DB
-	logger   seelog.LoggerInterface
-	config   Config
-	wantDown bool
-	running  bool
-	wg       sync.WaitGroup
+	// DB is database of the first shard
+	DB              *sql.DB
+	logger          seelog.LoggerInterface
+	config          Config
+	waitTimeout     time.Duration
+	maxBackoff      time.Duration
+	connMaxLifetime time.Duration
+	shards          []*shard
+	semaphore       chan bool
+	wantDown        chan bool
+	running         bool
+	wg              sync.WaitGroup
 }
 
 type Config struct {
-	Dsn   string `valid:"string,required"`
-	Table string `valid:"string,required"`
+	Dsn             string   `valid:"-"`
+	Dsns            []string `valid:"-"`
+	Table           string   `valid:"-"`
+	Tables          []string `valid:"-"`
+	WaitTimeout     string   `valid:"-" mapstructure:"wait_timeout"`
+	NotBeforeColumn string   `valid:"-" mapstructure:"not_before_column"`
+	AttemptsColumn  string   `valid:"-" mapstructure:"attempts_column"`
+	MaxAttempts     int      `valid:"-" mapstructure:"max_attempts"`
+	DeadTable       string   `valid:"-" mapstructure:"dead_table"`
+	Concurrency     int      `valid:"-"`
+	MaxBackoff      string   `valid:"-" mapstructure:"max_backoff"`
+	MaxOpenConns    int      `valid:"-" mapstructure:"max_open_conns"`
+	MaxIdleConns    int      `valid:"-" mapstructure:"max_idle_conns"`
+	ConnMaxLifetime string   `valid:"-" mapstructure:"conn_max_lifetime"`
+	Columns         []string `valid:"-"`
+	JsonColumns     []string `valid:"-" mapstructure:"json_columns"`
+	BinaryEncoding  string   `valid:"-" mapstructure:"binary_encoding"`
 }
 
 func (q *Q4M) Start(outChannel chan reprow.Job) error {
@@ -52,108 +99,257 @@ func (q *Q4M) Start(outChannel chan reprow.Job) error {
 		return errors.New("Dequeue already called")
 	} else {
 		q.running = true
-		go q.run(outChannel)
+		q.wantDown = make(chan bool)
+		for _, sh := range q.shards {
+			q.wg.Add(1)
+			go q.run(sh, outChannel)
+		}
 		return nil
 	}
 }
 
-func (q *Q4M) run(outChannel chan reprow.Job) {
+func (q *Q4M) run(sh *shard, outChannel chan reprow.Job) {
+	defer q.wg.Done()
 
-	for q.wantDown == false {
+	for {
+		// Unhealthy shard is skipped without taking concurrency until its backoff passes
+		if !sh.wait(q.wantDown) {
+			return
+		}
+		// A job is made only when concurrency is left, so that connections never exceed concurrency.
+		// Without concurrency, jobs are bounded by the runner receiving them as before.
+		if q.semaphore != nil {
+			select {
+			case q.semaphore <- true:
+			case <-q.wantDown:
+				return
+			}
+		}
 		job := Job{
 			ready: make(chan bool),
 			queue: q,
+			slot:  sh.take(),
+		}
+		select {
+		case outChannel <- &job:
+		case <-q.wantDown:
+			q.release(&job)
+			return
 		}
-		outChannel <- &job
 		q.wg.Add(1)
 		go func(job *Job) {
-			defer job.finalize()
 			defer q.wg.Done()
-			tx, err := q.DB.Begin()
+			// wait_timeout bounds the time it takes to shut down, because queue_wait is not interrupted by Stop
+			err := q.dequeue(job)
 			if err != nil {
-				q.logger.Errorf("Failed to make new transaction e=%s", err.Error())
-				return
+				job.slot.reset()
+				atomic.AddInt64(&sh.errors, 1)
+				backoff := sh.fail(q.maxBackoff)
+				q.logger.Errorf("reprow/q4m: failed to dequeue. skipping shard shard=%s backoff=%s e=%s", sh.name, backoff, err.Error())
+				job.payload = nil
+			} else if sh.recover() {
+				q.logger.Infof("shard recovered shard=%s", sh.name)
 			}
-			job.tx = tx
-			//TODO: queue wait timeout is currently set to 5 as hard coded value
-			// Changing this values will affect, time it takes to safully shutting down, because currently there is no signal handling done arround here
-
-			row := tx.QueryRow(fmt.Sprintf("SELECT queue_wait(\"%s\", 5)", q.config.Table))
-			var res int
-			err = row.Scan(&res)
-			if err != nil {
-				q.logger.Errorf("Failed for to query e=%s", err.Error())
-				return
-			}
-
-			if res != 1 {
-				q.logger.Debugf("no queue retrieved")
-				return
+			found := job.payload != nil
+			if found {
+				atomic.AddInt64(&sh.dequeued, 1)
 			}
-
-			row = tx.QueryRow(fmt.Sprintf("SELECT * FROM %s", q.config.Table))
-			payload, err := rowToMap(row)
-			if err != nil {
-				q.logger.Errorf("Failed for to get first row err=%s", err.Error())
-				return
+			job.finalize()
+			if !found {
+				// slot of found job is released when the job is ended or aborted
+				q.release(job)
 			}
-			job.payload = payload
-			job.queue = q
 		}(&job)
 	}
 }
 
+// dequeue waits a row on connection of the job's slot. Payload is left nil when no row is available
+func (q *Q4M) dequeue(job *Job) error {
+	err := job.slot.connect()
+	if err != nil {
+		return err
+	}
+	conn := job.slot.conn
+	ctx := context.Background()
+
+	var res int
+	err = conn.QueryRowContext(ctx, q.waitQuery(time.Now())).Scan(&res)
+	if err != nil {
+		return err
+	}
+	// queue_wait returns 1 based index of the table that had a row, and 0 on timeout
+	if res < 1 || res > len(q.config.Tables) {
+		q.logger.Debugf("no queue retrieved")
+		return nil
+	}
+	job.table = q.config.Tables[res-1]
+
+	row, err := RowToMap(conn.QueryRowContext(ctx, fmt.Sprintf("SELECT * FROM %s", quoteTable(job.table))))
+	if err != nil {
+		return errors.New("failed to get first row table=" + job.table + ": " + err.Error())
+	}
+	job.row = row
+	if q.config.AttemptsColumn != "" {
+		job.attempts = toInt(row[q.config.AttemptsColumn])
+	}
+	payload, err := q.mapRow(row)
+	if err != nil {
+		q.logger.Errorf("reprow/q4m: failed to map row. moving to dead_table table=%s e=%s", job.table, err.Error())
+		q.bury(job, job.attempts)
+		return nil
+	}
+	job.payload = payload
+	return nil
+}
+
 func (q *Q4M) Stop() error {
 	q.logger.Infof("stopping queue")
 	if q.running == false {
 		return errors.New("not running")
 	} else {
-		q.wantDown = true
+		close(q.wantDown)
 		q.wg.Wait()
 		q.running = false
-		q.wantDown = false
 		return nil
 	}
 }
 
-func (q *Q4M) Abort(job *Job) {
-	q.abortTx(job.tx)
+// Abort returns row to the table. When retry is enabled, the row is requeued as a new row
+// with attempts incremented, or moved to dead_table when it has been aborted max_attempts times.
+func (q *Q4M) Abort(job *Job, retryAfter int) {
+	defer q.release(job)
+	atomic.AddInt64(&job.slot.shard.aborted, 1)
+	if q.config.NotBeforeColumn == "" && retryAfter > 0 {
+		q.logger.Errorf("Retry after is not supported without not_before_column")
+	}
+	if q.config.NotBeforeColumn == "" && q.config.AttemptsColumn == "" {
+		q.abortRow(job)
+		return
+	}
+
+	attempts := job.attempts + 1
+	if q.config.MaxAttempts > 0 && attempts >= q.config.MaxAttempts {
+		q.logger.Errorf("reprow/q4m: job reached max attempts table=%s attempts=%d", job.table, attempts)
+		q.bury(job, attempts)
+		return
+	}
+	err := q.insert(job.slot.conn, job.table, job.row, attempts, time.Now().Add(time.Duration(retryAfter)*time.Second))
+	if err != nil {
+		q.logger.Errorf("reprow/q4m: failed to requeue table=%s e=%s", job.table, err.Error())
+		q.abortRow(job)
+		return
+	}
+	q.endRow(job)
 }
 
 func (q *Q4M) End(job *Job) {
-	q.endTx(job.tx)
+	defer q.release(job)
+	atomic.AddInt64(&job.slot.shard.ended, 1)
+	q.endRow(job)
 }
 
-func (q *Q4M) abortTx(tx *sql.Tx) {
-	var res int
-	q.logger.Debugf("aborting transaction")
-	row := tx.QueryRow(fmt.Sprintf("select queue_abort()"))
-	err := row.Scan(&res)
+// Reject moves row to dead_table
+func (q *Q4M) Reject(job *Job, reason string) {
+	defer q.release(job)
+	atomic.AddInt64(&job.slot.shard.rejected, 1)
+	q.logger.Errorf("reprow/q4m: job rejected table=%s reason=%s", job.table, reason)
+	q.bury(job, job.attempts)
+}
 
+// bury moves row to dead_table. The row is dropped when dead_table is not given
+func (q *Q4M) bury(job *Job, attempts int) {
+	if q.config.DeadTable == "" {
+		q.logger.Errorf("reprow/q4m: dropping job as dead_table is not given table=%s", job.table)
+		q.endRow(job)
+		return
+	}
+	err := q.insert(job.slot.conn, q.config.DeadTable, job.row, attempts, time.Time{})
 	if err != nil {
-		q.logger.Errorf("abort failed err=%s", err.Error())
+		q.logger.Errorf("reprow/q4m: failed to move job to dead_table table=%s e=%s", job.table, err.Error())
+		q.abortRow(job)
+		return
+	}
+	q.endRow(job)
+}
+
+// insert inserts row into table as a new row, with attempts_column and not_before_column overwritten when they are given.
+// not_before_column is left as it is when notBefore is zero.
+func (q *Q4M) insert(conn *sql.Conn, table string, original map[string]interface{}, attempts int, notBefore time.Time) error {
+	row := make(map[string]interface{}, len(original))
+	for column, value := range original {
+		row[column] = value
+	}
+	if q.config.AttemptsColumn != "" {
+		row[q.config.AttemptsColumn] = attempts
 	}
-	if res != 1 {
-		q.logger.Errorf("response is not 1 for queue_abort")
+	if q.config.NotBeforeColumn != "" && !notBefore.IsZero() {
+		// rounded up so that the row is never dequeued before retry after
+		unix := notBefore.Unix()
+		if notBefore.Nanosecond() > 0 {
+			unix++
+		}
+		row[q.config.NotBeforeColumn] = unix
+	}
+
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+		placeholders[i] = "?"
+		values[i] = row[column]
 	}
+	_, err := conn.ExecContext(context.Background(), fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		quoteTable(table), strings.Join(quoted, ", "), strings.Join(placeholders, ", ")), values...)
+	return err
+}
+
+func (q *Q4M) abortRow(job *Job) {
+	q.finishRow(job, "queue_abort")
+}
 
-	tx.Commit() // For golang connection pooling
+func (q *Q4M) endRow(job *Job) {
+	q.finishRow(job, "queue_end")
 }
-func (q *Q4M) endTx(tx *sql.Tx) {
+
+// finishRow calls function on connection owning row of job
+func (q *Q4M) finishRow(job *Job, function string) {
 	var res int
-	row := tx.QueryRow(fmt.Sprintf("select queue_end()"))
-	err := row.Scan(&res)
+	err := job.slot.conn.QueryRowContext(context.Background(), "SELECT "+function+"()").Scan(&res)
 	if err != nil {
-		q.logger.Errorf("abort failed err=%s", err.Error())
+		// the row is returned to the table by Q4M when connection is closed
+		q.logger.Errorf("%s failed table=%s err=%s", function, job.table, err.Error())
+		job.slot.reset()
+	} else if res != 1 {
+		q.logger.Errorf("response is not 1 for %s", function)
 	}
-	if res != 1 {
-		q.logger.Errorf("response is not 1 for queue_abort")
+}
+
+// release makes connection of job available for next job
+func (q *Q4M) release(job *Job) {
+	job.slot.shard.put(job.slot)
+	if q.semaphore != nil {
+		<-q.semaphore
 	}
+}
 
-	tx.Commit() // For golang connection pooling
+// Stats returns counts of jobs and health of each shard in order of dsns
+func (q *Q4M) Stats() []ShardStats {
+	stats := make([]ShardStats, len(q.shards))
+	for i, sh := range q.shards {
+		stats[i] = sh.stats()
+	}
+	return stats
 }
 
-func rowToMap(row *sql.Row) (map[string]interface{}, error) {
+// RowToMap reads row as map from column name to value converted by column type.
+// It is shared with other mysql based queues.
+func RowToMap(row *sql.Row) (map[string]interface{}, error) {
 	columns, err := mysqlinternals.Columns(row)
 	if err != nil {
 		return nil, err
@@ -192,11 +388,102 @@ func rowToMap(row *sql.Row) (map[string]interface{}, error) {
 }
 
 func (q *Q4M) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	q.logger = logger
+
+	err := q.loadConfig(c)
+	if err != nil {
+		return err
+	}
 
-	q.wantDown = false
+	if q.config.Concurrency > 0 {
+		q.semaphore = make(chan bool, q.config.Concurrency)
+	}
+	var healthy int
+	for _, dsn := range q.config.Dsns {
+		sh, err := q.openShard(dsn)
+		if err != nil {
+			q.closeShards()
+			return err
+		}
+		q.shards = append(q.shards, sh)
+
+		err = sh.db.Ping()
+		if err != nil {
+			// Unreachable shard is retried after backoff unless no shard is reachable
+			backoff := sh.fail(q.maxBackoff)
+			q.logger.Errorf("reprow/q4m: failed to connect. skipping shard shard=%s backoff=%s e=%s", sh.name, backoff, err.Error())
+			continue
+		}
+		if healthy == 0 {
+			err = q.checkColumns(sh.db)
+			if err != nil {
+				q.closeShards()
+				return err
+			}
+		}
+		healthy++
+	}
+	if healthy == 0 {
+		q.closeShards()
+		return errors.New("failed to connect to any shard")
+	}
+	q.DB = q.shards[0].db
+	return nil
+}
 
-	q.logger = logger
+// checkColumns checks that columns in config exist in all tables
+func (q *Q4M) checkColumns(db *sql.DB) error {
+	var columns []string
+	for _, column := range append(append([]string{q.config.NotBeforeColumn, q.config.AttemptsColumn}, q.config.Columns...), q.config.JsonColumns...) {
+		if column != "" {
+			columns = append(columns, quoteIdentifier(column))
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	for _, table := range q.config.Tables {
+		rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s LIMIT 0", strings.Join(columns, ", "), quoteTable(table)))
+		if err != nil {
+			return errors.New("columns are not found in table=" + table + ": " + err.Error())
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+func (q *Q4M) closeShards() {
+	for _, sh := range q.shards {
+		sh.db.Close()
+	}
+	q.shards = nil
+}
+
+// openShard opens database of dsn with limits of connection pool
+func (q *Q4M) openShard(dsn string) (*shard, error) {
+	c, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, errors.New("dsn failed to parse: " + err.Error())
+	}
+	db, err := OpenDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(q.config.MaxOpenConns)
+	if q.config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(q.config.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(q.connMaxLifetime)
+
+	sh := &shard{
+		name: c.Addr + "/" + c.DBName,
+		db:   db,
+	}
+	return sh, nil
+}
 
+// loadConfig decodes and validates config with defaults applied
+func (q *Q4M) loadConfig(c map[string]interface{}) error {
 	var config Config
 
 	err := mapstructure.Decode(c, &config)
@@ -209,13 +496,96 @@ func (q *Q4M) configure(c map[string]interface{}, logger seelog.LoggerInterface)
 		return err
 	}
 
-	q.config = config
+	if config.Dsn != "" {
+		config.Dsns = append([]string{config.Dsn}, config.Dsns...)
+	}
+	if len(config.Dsns) == 0 {
+		return errors.New("dsn or dsns is required")
+	}
+	if config.Table != "" {
+		config.Tables = append([]string{config.Table}, config.Tables...)
+	}
+	if len(config.Tables) == 0 {
+		return errors.New("table or tables is required")
+	}
+	q.waitTimeout, err = reprow.ParseDuration(config.WaitTimeout, "5s")
+	if err != nil {
+		return errors.New("wait_timeout failed to parse: " + err.Error())
+	}
+	if q.waitTimeout < time.Second {
+		return errors.New("wait_timeout should be at least 1s")
+	}
+
+	for _, table := range append(config.Tables, config.DeadTable) {
+		if table != "" && !validTable(table) {
+			return errors.New("invalid table name: " + table)
+		}
+	}
+	columns := append(append([]string{config.NotBeforeColumn, config.AttemptsColumn}, config.Columns...), config.JsonColumns...)
+	for _, column := range columns {
+		if column != "" && !identifierPattern.MatchString(column) {
+			return errors.New("invalid column name: " + column)
+		}
+	}
+	if config.BinaryEncoding == "" {
+		config.BinaryEncoding = EncodingBase64
+	}
+	if config.BinaryEncoding != EncodingBase64 && config.BinaryEncoding != EncodingHex && config.BinaryEncoding != EncodingUTF8 {
+		return fmt.Errorf("binary_encoding should be %s, %s or %s", EncodingBase64, EncodingHex, EncodingUTF8)
+	}
+
+	if config.MaxAttempts > 0 && config.AttemptsColumn == "" {
+		return errors.New("attempts_column is required for max_attempts")
+	}
+	if (len(config.Columns) > 0 || len(config.JsonColumns) > 0) && config.DeadTable == "" {
+		return errors.New("dead_table is required for columns and json_columns")
+	}
 
-	db, err := sql.Open("mysql", config.Dsn)
+	if config.MaxOpenConns > 0 && config.MaxOpenConns < config.Concurrency {
+		return errors.New("max_open_conns should not be less than concurrency")
+	}
+	q.maxBackoff, err = reprow.ParseDuration(config.MaxBackoff, "30s")
 	if err != nil {
-		return err
+		return errors.New("max_backoff failed to parse: " + err.Error())
+	}
+	q.connMaxLifetime, err = reprow.ParseDuration(config.ConnMaxLifetime, "0s")
+	if err != nil {
+		return errors.New("conn_max_lifetime failed to parse: " + err.Error())
 	}
-	q.DB = db
 
+	q.config = config
 	return nil
 }
+
+// waitQuery returns queue_wait query for tables in priority order.
+// When not_before_column is given, tables are conditioned to rows due at now.
+// Timeout is passed in seconds as queue_wait only accepts integer.
+func (q *Q4M) waitQuery(now time.Time) string {
+	args := make([]string, 0, len(q.config.Tables)+1)
+	for _, table := range q.config.Tables {
+		if q.config.NotBeforeColumn != "" {
+			table = fmt.Sprintf("%s:%s<=%d", table, q.config.NotBeforeColumn, now.Unix())
+		}
+		args = append(args, strconv.Quote(table))
+	}
+	args = append(args, strconv.Itoa(int(q.waitTimeout/time.Second)))
+	return fmt.Sprintf("SELECT queue_wait(%s)", strings.Join(args, ", "))
+}
+
+func toInt(value interface{}) int {
+	switch v := value.(type) {
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		i, _ := strconv.Atoi(v)
+		return i
+	}
+	return 0
+}
+
+// OpenDB opens mysql database with dsn. It is shared with other mysql based queues.
+func OpenDB(dsn string) (*sql.DB, error) {
+	return sql.Open("mysql", dsn)
+}
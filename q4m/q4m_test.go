@@ -9,20 +9,26 @@ import (
 	"github.com/lestrrat/go-tcputil"
 	"github.com/lestrrat/go-test-mysqld"
 	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
 var (
-	logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
-	mysqld    *mysqltest.TestMysqld
-	q4m       *Q4M
-	table     = "reprow_test_queue"
-	port      int
-	makePort  sync.Once
-	dsn       string
+	logger, _  = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+	mysqld     *mysqltest.TestMysqld
+	q4m        *Q4M
+	table      = "reprow_test_queue"
+	lowTable   = "reprow_test_queue_low"
+	retryTable = "reprow_test_retry"
+	deadTable  = "reprow_test_dead"
+	suiteTable = "reprow_test_suite"
+	port       int
+	makePort   sync.Once
+	dsn        string
 )
 
 type TestQueue struct {
@@ -45,6 +51,204 @@ func TestStart(t *testing.T) {
 
 	testQueueCompletion(t)
 	testPayload(t)
+	testTables(t)
+	testRetry(t)
+	testShards(t)
+}
+
+func TestConformance(t *testing.T) {
+	mysqld, err := launchMysqld()
+	if err != nil {
+		t.Skipf("mysqld failed to initialized e=%s", err.Error())
+	}
+	defer mysqld.Stop()
+
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			queue, err := NewQ4M(map[string]interface{}{
+				"dsn":          dsn,
+				"table":        suiteTable,
+				"wait_timeout": "1s",
+			}, logger)
+			if err != nil {
+				t.Fatalf("q4m failed to initialized e=%s", err.Error())
+			}
+			_, err = queue.DB.Exec(fmt.Sprintf("DELETE FROM %s", suiteTable))
+			if err != nil {
+				t.Fatalf("failed to empty table e=%s", err.Error())
+			}
+			return queue
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			b, err := json.Marshal(payload)
+			if err != nil {
+				t.Fatalf("failed to marshal e=%s", err.Error())
+			}
+			_, err = queue.(*Q4M).DB.Exec(fmt.Sprintf("INSERT INTO %s (payload) VALUES(?)", suiteTable), string(b))
+			if err != nil {
+				t.Fatalf("failed to insert e=%s", err.Error())
+			}
+		},
+		Payload: func(job reprow.Job) map[string]interface{} {
+			var payload map[string]interface{}
+			text, _ := job.Payload()["payload"].(string)
+			json.Unmarshal([]byte(text), &payload)
+			return payload
+		},
+	}.Run(t)
+}
+
+func TestConfigure(t *testing.T) {
+	// configuration is loaded without connecting to mysqld
+	q := &Q4M{logger: logger}
+	err := q.loadConfig(map[string]interface{}{
+		"dsn":          "root@tcp(127.0.0.1:3306)/test",
+		"table":        "high",
+		"tables":       []string{"low"},
+		"wait_timeout": "1500ms",
+	})
+	if err != nil {
+		t.Fatalf("q4m failed to configure e=%s", err.Error())
+	}
+	expect := `SELECT queue_wait("high", "low", 1)`
+	if got := q.waitQuery(time.Now()); got != expect {
+		t.Errorf("wait query does not match got=%s expect=%s", got, expect)
+	}
+
+	q = &Q4M{logger: logger}
+	err = q.loadConfig(map[string]interface{}{
+		"dsn":               "root@tcp(127.0.0.1:3306)/test",
+		"tables":            []string{"high", "low"},
+		"not_before_column": "not_before",
+	})
+	if err != nil {
+		t.Fatalf("q4m failed to configure e=%s", err.Error())
+	}
+	expect = `SELECT queue_wait("high:not_before<=1700000000", "low:not_before<=1700000000", 5)`
+	if got := q.waitQuery(time.Unix(1700000000, 0)); got != expect {
+		t.Errorf("wait query should be conditioned by not_before_column got=%s expect=%s", got, expect)
+	}
+
+	invalid := []map[string]interface{}{
+		{"dsn": "root@tcp(127.0.0.1:3306)/test"},
+		{"table": "high"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "wait_timeout": "100ms"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "wait_timeout": "soon"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "max_attempts": 3},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "concurrency": 4, "max_open_conns": 2},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "max_backoff": "soon"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high; DROP TABLE high"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "db.high.low"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "dead_table": "dead`"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "columns": []string{"id", "a b"}, "dead_table": "dead"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "json_columns": []string{"payload'"}, "dead_table": "dead"},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "columns": []string{"id"}},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "json_columns": []string{"payload"}},
+		{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "binary_encoding": "base32"},
+	}
+	for _, c := range invalid {
+		err := (&Q4M{logger: logger}).loadConfig(c)
+		if err == nil {
+			t.Errorf("invalid config should fail config=%v", c)
+		}
+	}
+
+	_, err = NewQ4M(map[string]interface{}{
+		"dsn":   "root@tcp(127.0.0.1:1)/test",
+		"table": "high",
+	}, logger)
+	if err == nil {
+		t.Errorf("configuration should fail when mysqld is not reachable")
+	}
+}
+
+func TestMapRow(t *testing.T) {
+	row := map[string]interface{}{
+		"id":      int64(1),
+		"secret":  "hidden",
+		"payload": `{"user_id": 10, "id": "overridden"}`,
+		"tags":    []byte(`["a", "b"]`),
+		"digest":  []byte{0xde, 0xad},
+	}
+	for _, c := range []struct {
+		config map[string]interface{}
+		expect map[string]interface{}
+	}{
+		{
+			config: map[string]interface{}{"json_columns": []string{"payload", "tags"}},
+			expect: map[string]interface{}{"id": "overridden", "secret": "hidden", "user_id": 10, "tags": []string{"a", "b"}, "digest": "3q0="},
+		},
+		{
+			config: map[string]interface{}{"columns": []string{"id", "digest"}, "binary_encoding": "hex"},
+			expect: map[string]interface{}{"id": 1, "digest": "dead"},
+		},
+		{
+			config: map[string]interface{}{"columns": []string{"tags"}, "binary_encoding": "utf8"},
+			expect: map[string]interface{}{"tags": `["a", "b"]`},
+		},
+	} {
+		q := &Q4M{logger: logger}
+		c.config["dsn"] = "root@tcp(127.0.0.1:3306)/test"
+		c.config["table"] = "high"
+		c.config["dead_table"] = "dead"
+		err := q.loadConfig(c.config)
+		if err != nil {
+			t.Fatalf("q4m failed to configure e=%s", err.Error())
+		}
+		got, err := q.mapRow(row)
+		if err != nil {
+			t.Fatalf("failed to map row e=%s", err.Error())
+		}
+		if !DeepEqual(got, c.expect) {
+			t.Errorf("payload does not match config=%v got=%v expect=%v", c.config, got, c.expect)
+		}
+	}
+
+	q := &Q4M{logger: logger}
+	err := q.loadConfig(map[string]interface{}{"dsn": "root@tcp(127.0.0.1:3306)/test", "table": "high", "json_columns": []string{"secret"}, "dead_table": "dead"})
+	if err != nil {
+		t.Fatalf("q4m failed to configure e=%s", err.Error())
+	}
+	_, err = q.mapRow(row)
+	if err == nil {
+		t.Errorf("invalid json column should fail")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := &shard{name: "127.0.0.1:3306/test"}
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, s.fail(time.Second))
+	}
+	expect := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("backoff should be doubled up to max got=%v expect=%v", got, expect)
+			break
+		}
+	}
+	if s.stats().Healthy {
+		t.Errorf("failed shard should be unhealthy")
+	}
+
+	started := time.Now()
+	if !s.wait(make(chan bool)) || time.Since(started) < 900*time.Millisecond {
+		t.Errorf("unhealthy shard should be waited until backoff passes")
+	}
+	wantDown := make(chan bool)
+	close(wantDown)
+	s.fail(time.Second)
+	if s.wait(wantDown) {
+		t.Errorf("waiting shard should be interrupted by wantDown")
+	}
+
+	if !s.recover() || !s.stats().Healthy {
+		t.Errorf("recovered shard should be healthy")
+	}
+	if s.recover() {
+		t.Errorf("healthy shard should not be reported as recovered")
+	}
 }
 
 func testMysqldRecoverability(t *testing.T) {
@@ -182,6 +386,154 @@ func testQueueCompletion(t *testing.T) {
 
 }
 
+func testTables(t *testing.T) {
+	t.Logf("testing multiple tables")
+
+	jobChannel := make(chan reprow.Job)
+	q4m, err := NewQ4M(map[string]interface{}{
+		"Dsn":          dsn,
+		"Tables":       []string{table, lowTable},
+		"wait_timeout": "1s",
+	}, logger)
+	if err != nil {
+		t.Fatalf("q4m failed to initialized e=%s", err.Error())
+	}
+
+	_, err = q4m.DB.Exec(fmt.Sprintf(
+		"INSERT INTO %s (intcolumn, stringcolumn, nullcolumn) VALUES(20, \"low\", NULL)", lowTable))
+	if err != nil {
+		t.Fatalf("failed to insert e=%s", err.Error())
+	}
+	mustInsertQueue(TestQueue{StringColumn: "high", IntColumn: 10}, t)
+
+	q4m.Start(jobChannel)
+	defer q4m.Stop()
+
+	for _, expect := range []string{table, lowTable} {
+		job := mustDequeue(jobChannel, t)
+		got := reprow.JobMetadata(job)["Table"]
+		job.End()
+		if got != expect {
+			t.Errorf("job should be dequeued in priority order got=%v expect=%s", got, expect)
+		}
+	}
+}
+
+func testRetry(t *testing.T) {
+	t.Logf("testing retry after and dead table")
+
+	jobChannel := make(chan reprow.Job)
+	q4m, err := NewQ4M(map[string]interface{}{
+		"Dsn":               dsn,
+		"Table":             retryTable,
+		"wait_timeout":      "1s",
+		"not_before_column": "not_before",
+		"attempts_column":   "attempts",
+		"max_attempts":      2,
+		"dead_table":        deadTable,
+	}, logger)
+	if err != nil {
+		t.Fatalf("q4m failed to initialized e=%s", err.Error())
+	}
+	_, err = q4m.DB.Exec(fmt.Sprintf("INSERT INTO %s (intcolumn) VALUES(10)", retryTable))
+	if err != nil {
+		t.Fatalf("failed to insert e=%s", err.Error())
+	}
+
+	q4m.Start(jobChannel)
+	defer q4m.Stop()
+
+	job := mustDequeueWithin(jobChannel, 3*time.Second, t)
+	started := time.Now()
+	job.Abort(1)
+
+	job = mustDequeueWithin(jobChannel, 5*time.Second, t)
+	if time.Since(started) < time.Second {
+		t.Errorf("job dequeued before retry after")
+	}
+	if attempts := reprow.JobMetadata(job)["Attempts"]; attempts != 1 {
+		t.Errorf("attempts should be incremented got=%v", attempts)
+	}
+	job.Abort(1)
+
+	var count int
+	err = q4m.DB.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE intcolumn = 10 AND attempts = 2", deadTable)).Scan(&count)
+	if err != nil {
+		t.Fatalf("dead count not retrieved e=%s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("job reached max attempts should be moved to dead table count=%d", count)
+	}
+}
+
+func testShards(t *testing.T) {
+	t.Logf("testing shards")
+
+	shardDsn := strings.Replace(dsn, "/mysql", "/reprow_test_shard", 1)
+	statements := []string{
+		"CREATE DATABASE reprow_test_shard",
+		fmt.Sprintf("CREATE TABLE reprow_test_shard.%s(intcolumn int unsigned NOT NULL, stringcolumn varchar(255) NOT NULL, nullcolumn int DEFAULT NULL) Engine=Queue", table),
+		fmt.Sprintf("INSERT INTO reprow_test_shard.%s (intcolumn, stringcolumn) VALUES(20, \"shard\")", table),
+	}
+	for _, stmt := range statements {
+		_, err := q4m.DB.Exec(stmt)
+		if err != nil {
+			t.Fatalf("failed to prepare shard e=%s", err.Error())
+		}
+	}
+	mustInsertQueue(TestQueue{StringColumn: "main", IntColumn: 10}, t)
+
+	jobChannel := make(chan reprow.Job)
+	queue, err := NewQ4M(map[string]interface{}{
+		// the last shard is unreachable, and skipped
+		"Dsns":         []string{dsn, shardDsn, "root@tcp(127.0.0.1:1)/mysql"},
+		"Table":        table,
+		"Concurrency":  2,
+		"wait_timeout": "1s",
+	}, logger)
+	if err != nil {
+		t.Fatalf("q4m failed to initialized e=%s", err.Error())
+	}
+	queue.Start(jobChannel)
+	defer queue.Stop()
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		job := mustDequeueWithin(jobChannel, 5*time.Second, t)
+		got[job.Payload()["stringcolumn"].(string)] = true
+		job.End()
+	}
+	if !got["main"] || !got["shard"] {
+		t.Errorf("jobs should be dequeued from all shards got=%v", got)
+	}
+
+	stats := queue.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("stats should be reported for each shard got=%v", stats)
+	}
+	for i, expect := range []bool{true, true, false} {
+		if stats[i].Healthy != expect || (expect && stats[i].Ended != 1) {
+			t.Errorf("stats of shard does not match got=%+v", stats[i])
+		}
+	}
+}
+
+// mustDequeueWithin receives jobs until one is finalized with a row
+func mustDequeueWithin(jobChannel chan reprow.Job, timeout time.Duration, t *testing.T) reprow.Job {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case job := <-jobChannel:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("dequeue timetout")
+			return nil
+		}
+	}
+}
+
 func launchMysqld() (mysqld *mysqltest.TestMysqld, err error) {
 
 	c, err := getMysqldConfig()
@@ -212,6 +564,10 @@ func launchMysqld() (mysqld *mysqltest.TestMysqld, err error) {
 		"CREATE FUNCTION queue_set_srcid RETURNS INT SONAME 'libqueue_engine.so'",
 		"CREATE FUNCTION queue_compact RETURNS INT SONAME 'libqueue_engine.so'",
 		fmt.Sprintf("CREATE TABLE %s(intcolumn int unsigned NOT NULL, stringcolumn varchar(255) NOT NULL, nullcolumn int DEFAULT NULL) Engine=Queue", table),
+		fmt.Sprintf("CREATE TABLE %s(intcolumn int unsigned NOT NULL, stringcolumn varchar(255) NOT NULL, nullcolumn int DEFAULT NULL) Engine=Queue", lowTable),
+		fmt.Sprintf("CREATE TABLE %s(intcolumn int unsigned NOT NULL, attempts int unsigned NOT NULL DEFAULT 0, not_before bigint unsigned NOT NULL DEFAULT 0) Engine=Queue", retryTable),
+		fmt.Sprintf("CREATE TABLE %s(intcolumn int unsigned NOT NULL, attempts int unsigned NOT NULL DEFAULT 0, not_before bigint unsigned NOT NULL DEFAULT 0)", deadTable),
+		fmt.Sprintf("CREATE TABLE %s(payload text NOT NULL) Engine=Queue", suiteTable),
 	}
 
 	for _, stmt := range statements {
@@ -259,7 +615,7 @@ func mustInsertQueue(queue TestQueue, t *testing.T) {
 	))
 
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatalf("failed to insert e=%s", err.Error())
 	}
 }
 
@@ -0,0 +1,110 @@
+package q4m
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shard is a mysqld holding the tables. It is skipped with backoff while it fails to connect or to wait.
+type shard struct {
+	name     string
+	db       *sql.DB
+	mu       sync.Mutex
+	slots    []*slot
+	backoff  time.Duration
+	retryAt  time.Time
+	dequeued int64
+	ended    int64
+	aborted  int64
+	rejected int64
+	errors   int64
+}
+
+// ShardStats is counts of jobs and health of a shard
+type ShardStats struct {
+	// Name is address and database of the shard
+	Name     string
+	Healthy  bool
+	Dequeued int64
+	Ended    int64
+	Aborted  int64
+	Rejected int64
+	Errors   int64
+}
+
+// fail marks the shard unhealthy and returns backoff before next try, doubled from the last one up to max
+func (s *shard) fail(max time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.backoff == 0 {
+		s.backoff = 100 * time.Millisecond
+	} else {
+		s.backoff *= 2
+	}
+	if s.backoff > max {
+		s.backoff = max
+	}
+	s.retryAt = time.Now().Add(s.backoff)
+	return s.backoff
+}
+
+// recover marks the shard healthy. true is returned when it was unhealthy
+func (s *shard) recover() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unhealthy := s.backoff > 0
+	s.backoff = 0
+	return unhealthy
+}
+
+// wait waits until backoff of the shard passes. false is returned when wantDown is closed
+func (s *shard) wait(wantDown chan bool) bool {
+	s.mu.Lock()
+	delay := time.Until(s.retryAt)
+	s.mu.Unlock()
+	if delay <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-wantDown:
+		return false
+	}
+}
+
+// take returns an idle slot, or a new one when all slots are in use
+func (s *shard) take() *slot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.slots) == 0 {
+		return &slot{shard: s}
+	}
+	sl := s.slots[len(s.slots)-1]
+	s.slots = s.slots[:len(s.slots)-1]
+	return sl
+}
+
+// put returns slot to idle slots keeping its connection for next row
+func (s *shard) put(sl *slot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slots = append(s.slots, sl)
+}
+
+func (s *shard) stats() ShardStats {
+	s.mu.Lock()
+	healthy := s.backoff == 0
+	s.mu.Unlock()
+	return ShardStats{
+		Name:     s.name,
+		Healthy:  healthy,
+		Dequeued: atomic.LoadInt64(&s.dequeued),
+		Ended:    atomic.LoadInt64(&s.ended),
+		Aborted:  atomic.LoadInt64(&s.aborted),
+		Rejected: atomic.LoadInt64(&s.rejected),
+		Errors:   atomic.LoadInt64(&s.errors),
+	}
+}
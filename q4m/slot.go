@@ -0,0 +1,40 @@
+package q4m
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+)
+
+// slot holds a long-lived connection to dequeue rows on.
+// Q4M keeps a dequeued row owned by the connection until queue_end or queue_abort is called on it,
+// so a slot is used by one job at a time.
+type slot struct {
+	shard *shard
+	conn  *sql.Conn
+}
+
+// connect takes a dedicated connection from database of the shard unless the slot already has one
+func (s *slot) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := s.shard.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// reset discards the connection instead of returning it to pool, so that a row it might own is returned to the table
+func (s *slot) reset() {
+	if s.conn == nil {
+		return
+	}
+	// connection is closed instead of being returned to pool when Raw returns ErrBadConn
+	s.conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+	s.conn = nil
+}
@@ -1,6 +1,7 @@
 package reprow
 
 import (
+	"errors"
 	"github.com/cihub/seelog"
 )
 
@@ -31,3 +32,16 @@ func RegisterQueue(name string, queue QueueBuilder) {
 	}
 	queues[name] = queue
 }
+
+// NewQueue builds queue registered with name config["type"].
+func NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (Queue, error) {
+	queueType, ok := config["type"].(string)
+	if !ok {
+		return nil, errors.New("queue type required")
+	}
+	queueBuilder := queues[queueType]
+	if queueBuilder == nil {
+		return nil, errors.New("queue not registered")
+	}
+	return queueBuilder.NewQueue(config, logger)
+}
@@ -0,0 +1,36 @@
+package redis
+
+type Job struct {
+	payload map[string]interface{}
+	message string
+	queue   *Redis
+	ready   chan bool
+}
+
+func (j *Job) Queue() *Redis {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	j.ready <- j.payload != nil
+}
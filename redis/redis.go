@@ -0,0 +1,351 @@
+// redis package implements redis list as reprow.Queue with reliable queue pattern.
+// Producers should LPUSH json encoded payloads to the list.
+//
+// Each job is moved atomically to per consumer processing list with BRPOPLPUSH, and removed from it when the job ends.
+// Aborted jobs are pushed back to the list, or to a sorted set of delayed jobs when retry after is given.
+// Delayed jobs are kept in a hash under unique ids, so that jobs with the same payload are delayed separately.
+// Consumers record heartbeats, and jobs left in processing lists of consumers whose heartbeat stopped are pushed back to the list.
+package redis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// abortScript pushes job back to the list only when it is still owned by the consumer
+	abortScript = redigo.NewScript(2, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+  redis.call('RPUSH', KEYS[2], ARGV[1])
+  return 1
+end
+return 0`)
+
+	// delayScript moves job to delayed jobs under a new id only when it is still owned by the consumer
+	delayScript = redigo.NewScript(4, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+  local id = redis.call('INCR', KEYS[4])
+  redis.call('HSET', KEYS[3], id, ARGV[1])
+  redis.call('ZADD', KEYS[2], ARGV[2], id)
+  return 1
+end
+return 0`)
+
+	// rejectScript moves job to dead letter list only when it is still owned by the consumer
+	rejectScript = redigo.NewScript(2, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 and KEYS[2] ~= '' then
+  redis.call('LPUSH', KEYS[2], ARGV[1])
+  return 1
+end
+return 0`)
+
+	// promoteScript moves delayed jobs whose time has come to the list.
+	promoteScript = redigo.NewScript(3, `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for i, id in ipairs(ids) do
+  local item = redis.call('HGET', KEYS[2], id)
+  redis.call('ZREM', KEYS[1], id)
+  redis.call('HDEL', KEYS[2], id)
+  redis.call('LPUSH', KEYS[3], item)
+end
+return #ids`)
+
+	// recoverScript pushes all jobs in processing list back to the list and forgets the consumer
+	recoverScript = redigo.NewScript(3, `
+local n = 0
+while redis.call('RPOPLPUSH', KEYS[1], KEYS[2]) do
+  n = n + 1
+end
+redis.call('ZREM', KEYS[3], ARGV[1])
+return n`)
+)
+
+func init() {
+	reprow.RegisterQueue("redis", &RedisBuilder{})
+}
+
+type RedisBuilder struct{}
+
+func (b *RedisBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewRedis(config, logger)
+}
+
+func NewRedis(config map[string]interface{}, logger seelog.LoggerInterface) (*Redis, error) {
+	r := Redis{}
+	err := r.configure(config, logger)
+	return &r, err
+}
+
+// Redis implements redis list as reprow.Queue
+type Redis struct {
+	Pool          *redigo.Pool
+	logger        seelog.LoggerInterface
+	config        Config
+	blockTimeout  time.Duration
+	reapAfter     time.Duration
+	pollInterval  time.Duration
+	processingKey string
+	delayedKey    string
+	itemsKey      string
+	sequenceKey   string
+	consumersKey  string
+	wantDown      chan bool
+	running       bool
+	wg            sync.WaitGroup
+}
+
+type Config struct {
+	Address      string `valid:"required"`
+	Password     string `valid:"-"`
+	Database     int    `valid:"-"`
+	Key          string `valid:"required"`
+	Consumer     string `valid:"-"`
+	DeadKey      string `valid:"-" mapstructure:"dead_key"`
+	BlockTimeout string `valid:"-" mapstructure:"block_timeout"`
+	ReapAfter    string `valid:"-" mapstructure:"reap_after"`
+	PollInterval string `valid:"-" mapstructure:"poll_interval"`
+}
+
+func (r *Redis) Start(outChannel chan reprow.Job) error {
+	if r.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		r.running = true
+		r.wantDown = make(chan bool)
+		r.wg.Add(2)
+		go r.maintain()
+		go r.run(outChannel)
+		return nil
+	}
+}
+
+func (r *Redis) run(outChannel chan reprow.Job) {
+	defer r.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: r,
+		}
+		select {
+		case outChannel <- &job:
+		case <-r.wantDown:
+			return
+		}
+		r.wg.Add(1)
+		go func(job *Job) {
+			defer job.finalize()
+			defer r.wg.Done()
+
+			conn := r.Pool.Get()
+			defer conn.Close()
+
+			message, err := redigo.String(conn.Do("BRPOPLPUSH", r.config.Key, r.processingKey, int(r.blockTimeout.Seconds())))
+			if err == redigo.ErrNil {
+				r.logger.Debugf("no queue retrieved")
+				return
+			}
+			if err != nil {
+				r.logger.Errorf("reprow/redis: failed to dequeue e=%s", err.Error())
+				time.Sleep(time.Second)
+				return
+			}
+
+			job.message = message
+			err = json.Unmarshal([]byte(message), &job.payload)
+			if err != nil {
+				r.logger.Errorf("reprow/redis: failed to deserialize job. rejecting message=%s err=%s", message, err.Error())
+				r.Reject(job, "failed to deserialize")
+				job.payload = nil
+			}
+		}(&job)
+	}
+}
+
+// maintain records heartbeat, promotes delayed jobs and reaps jobs of dead consumers until queue is stopped
+func (r *Redis) maintain() {
+	defer r.wg.Done()
+	for {
+		r.heartbeat()
+		r.promote()
+		r.reap()
+
+		select {
+		case <-r.wantDown:
+			return
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+func (r *Redis) heartbeat() {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("ZADD", r.consumersKey, time.Now().Unix(), r.config.Consumer)
+	if err != nil {
+		r.logger.Errorf("reprow/redis: failed to record heartbeat e=%s", err.Error())
+	}
+}
+
+func (r *Redis) promote() {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	n, err := redigo.Int(promoteScript.Do(conn, r.delayedKey, r.itemsKey, r.config.Key, time.Now().Unix()))
+	if err != nil {
+		r.logger.Errorf("reprow/redis: failed to promote delayed jobs e=%s", err.Error())
+	} else if n > 0 {
+		r.logger.Debugf("reprow/redis: promoted delayed jobs count=%d", n)
+	}
+}
+
+func (r *Redis) reap() {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	deadline := time.Now().Add(-r.reapAfter).Unix()
+	consumers, err := redigo.Strings(conn.Do("ZRANGEBYSCORE", r.consumersKey, "-inf", deadline))
+	if err != nil {
+		r.logger.Errorf("reprow/redis: failed to find dead consumers e=%s", err.Error())
+		return
+	}
+	for _, consumer := range consumers {
+		if consumer == r.config.Consumer {
+			continue
+		}
+		err := r.recover(conn, consumer)
+		if err != nil {
+			r.logger.Errorf("reprow/redis: failed to reap jobs consumer=%s e=%s", consumer, err.Error())
+		}
+	}
+}
+
+// recover pushes jobs in processing list of consumer back to the list
+func (r *Redis) recover(conn redigo.Conn, consumer string) error {
+	n, err := redigo.Int(recoverScript.Do(conn, r.processingKeyOf(consumer), r.config.Key, r.consumersKey, consumer))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		r.logger.Infof("reprow/redis: recovered jobs consumer=%s count=%d", consumer, n)
+	}
+	return nil
+}
+
+func (r *Redis) Stop() error {
+	r.logger.Infof("stopping queue")
+	if r.running == false {
+		return errors.New("not running")
+	} else {
+		close(r.wantDown)
+		r.wg.Wait()
+		r.running = false
+		return nil
+	}
+}
+
+func (r *Redis) Abort(job *Job, retryAfter int) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	var err error
+	if retryAfter > 0 {
+		at := time.Now().Add(time.Duration(retryAfter) * time.Second).Unix()
+		_, err = delayScript.Do(conn, r.processingKey, r.delayedKey, r.itemsKey, r.sequenceKey, job.message, at)
+	} else {
+		_, err = abortScript.Do(conn, r.processingKey, r.config.Key, job.message)
+	}
+	if err != nil {
+		r.logger.Errorf("reprow/redis: abort failed e=%s", err.Error())
+	}
+}
+
+func (r *Redis) End(job *Job) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("LREM", r.processingKey, 1, job.message)
+	if err != nil {
+		r.logger.Errorf("reprow/redis: end failed e=%s", err.Error())
+	}
+}
+
+func (r *Redis) Reject(job *Job, reason string) {
+	r.logger.Errorf("reprow/redis: job rejected reason=%s message=%s", reason, job.message)
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err := rejectScript.Do(conn, r.processingKey, r.config.DeadKey, job.message)
+	if err != nil {
+		r.logger.Errorf("reprow/redis: reject failed e=%s", err.Error())
+	}
+}
+
+func (r *Redis) processingKeyOf(consumer string) string {
+	return fmt.Sprintf("%s:processing:%s", r.config.Key, consumer)
+}
+
+func (r *Redis) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	r.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if config.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		config.Consumer = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	r.blockTimeout, err = reprow.ParseDuration(config.BlockTimeout, "1s")
+	if err != nil {
+		return errors.New("block_timeout failed to parse: " + err.Error())
+	}
+	if r.blockTimeout < time.Second {
+		return errors.New("block_timeout should be at least 1s")
+	}
+	r.reapAfter, err = reprow.ParseDuration(config.ReapAfter, "5m")
+	if err != nil {
+		return errors.New("reap_after failed to parse: " + err.Error())
+	}
+	r.pollInterval, err = reprow.ParseDuration(config.PollInterval, "1s")
+	if err != nil {
+		return errors.New("poll_interval failed to parse: " + err.Error())
+	}
+
+	r.config = config
+	r.processingKey = r.processingKeyOf(config.Consumer)
+	r.delayedKey = config.Key + ":delayed"
+	r.itemsKey = config.Key + ":delayed:items"
+	r.sequenceKey = config.Key + ":delayed:sequence"
+	r.consumersKey = config.Key + ":consumers"
+
+	r.Pool = &redigo.Pool{
+		MaxIdle:     10,
+		IdleTimeout: time.Minute,
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", config.Address,
+				redigo.DialPassword(config.Password),
+				redigo.DialDatabase(config.Database))
+		},
+	}
+
+	// Jobs left by previous process with the same consumer name are pushed back
+	conn := r.Pool.Get()
+	defer conn.Close()
+	return r.recover(conn, config.Consumer)
+}
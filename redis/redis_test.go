@@ -0,0 +1,145 @@
+package redis
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func newTestRedis(t *testing.T, server *miniredis.Miniredis, consumer string) *Redis {
+	queue, err := NewRedis(map[string]interface{}{
+		"address":       server.Addr(),
+		"key":           "reprow_test",
+		"consumer":      consumer,
+		"dead_key":      "reprow_test:dead",
+		"poll_interval": "100ms",
+		"reap_after":    "1s",
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make redis queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func mustPush(t *testing.T, server *miniredis.Miniredis, payload map[string]interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	_, err = server.Lpush("reprow_test", string(b))
+	if err != nil {
+		t.Fatalf("failed to push e=%s", err.Error())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	var server *miniredis.Miniredis
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			if server != nil {
+				server.Close()
+			}
+			server = miniredis.RunT(t)
+			return newTestRedis(t, server, "test")
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustPush(t, server, payload)
+		},
+	}.Run(t)
+}
+
+func TestRetryAfter(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestRedis(t, server, "test")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPush(t, server, map[string]interface{}{"id": "delayed"})
+	mustReceive(t, stream).Abort(1)
+
+	delayed, _ := server.SortedSet("reprow_test:delayed")
+	if len(delayed) != 1 {
+		t.Fatalf("aborted job should be delayed got=%v", delayed)
+	}
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "delayed" {
+		t.Errorf("delayed job not delivered got=%v", job.Payload())
+	}
+	job.(reprow.Rejecter).Reject("invalid")
+
+	dead, _ := server.List("reprow_test:dead")
+	if len(dead) != 1 {
+		t.Errorf("rejected job should be in dead list got=%v", dead)
+	}
+}
+
+func TestRetryAfterSamePayload(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestRedis(t, server, "test")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPush(t, server, map[string]interface{}{"id": "same"})
+	mustPush(t, server, map[string]interface{}{"id": "same"})
+	first := mustReceive(t, stream)
+	second := mustReceive(t, stream)
+	first.Abort(1)
+	second.Abort(1)
+
+	delayed, _ := server.SortedSet("reprow_test:delayed")
+	if len(delayed) != 2 {
+		t.Fatalf("jobs with the same payload should be delayed separately got=%v", delayed)
+	}
+	for i := 0; i < 2; i++ {
+		job := mustReceive(t, stream)
+		if job.Payload()["id"] != "same" {
+			t.Errorf("delayed job not delivered got=%v", job.Payload())
+		}
+		job.End()
+	}
+}
+
+func TestReap(t *testing.T) {
+	server := miniredis.RunT(t)
+	mustPush(t, server, map[string]interface{}{"id": "orphan"})
+
+	// Consumer crashed while processing a job
+	server.Lpush("reprow_test:processing:crashed", `{"id":"orphan"}`)
+	server.Lpop("reprow_test")
+	server.ZAdd("reprow_test:consumers", float64(time.Now().Add(-time.Minute).Unix()), "crashed")
+
+	queue := newTestRedis(t, server, "test")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "orphan" {
+		t.Errorf("orphan job not recovered got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package redis_streams
+
+type Job struct {
+	payload map[string]interface{}
+	entry   *entry
+	err     error
+	queue   *RedisStreams
+	ready   chan bool
+}
+
+func (j *Job) Queue() *RedisStreams {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns stream name, entry id and how many times the entry was delivered
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Stream":        j.queue.config.Stream,
+		"StreamId":      j.entry.id,
+		"DeliveryCount": j.entry.deliveryCount,
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	j.ready <- j.entry != nil && j.err == nil
+}
@@ -0,0 +1,458 @@
+// redis_streams package implements redis streams consumer group as reprow.Queue.
+// Entries are read with XREADGROUP and acknowledged with XACK when the job ends.
+//
+// Aborted entries are left pending, and taken over with XAUTOCLAIM once they are idle longer than claim_idle.
+// This also takes over entries of dead consumers. When retry after is given, entry is acknowledged and added to the stream again after the delay.
+// Fields of delayed entries are kept in a hash under their entry ids, so that entries with the same fields are delayed separately.
+package redis_streams
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// delayScript acknowledges entry and schedules its fields to be added again under its entry id
+	delayScript = redigo.NewScript(3, `
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+  redis.call('HSET', KEYS[3], ARGV[2], ARGV[4])
+  redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+  return 1
+end
+return 0`)
+
+	// rejectScript acknowledges entry and adds it to dead letter stream when given
+	rejectScript = redigo.NewScript(2, `
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 1 and KEYS[2] ~= '' then
+  local fields = cjson.decode(ARGV[3])
+  local args = {}
+  for k, v in pairs(fields) do
+    table.insert(args, k)
+    table.insert(args, v)
+  end
+  redis.call('XADD', KEYS[2], '*', unpack(args))
+  return 1
+end
+return 0`)
+
+	// promoteScript adds delayed entries whose time has come to the stream.
+	promoteScript = redigo.NewScript(3, `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for i, id in ipairs(ids) do
+  local item = redis.call('HGET', KEYS[2], id)
+  redis.call('ZREM', KEYS[1], id)
+  redis.call('HDEL', KEYS[2], id)
+  local fields = cjson.decode(item)
+  local args = {}
+  for k, v in pairs(fields) do
+    table.insert(args, k)
+    table.insert(args, v)
+  end
+  redis.call('XADD', KEYS[3], '*', unpack(args))
+end
+return #ids`)
+)
+
+func init() {
+	reprow.RegisterQueue("redis_streams", &RedisStreamsBuilder{})
+}
+
+type RedisStreamsBuilder struct{}
+
+func (b *RedisStreamsBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewRedisStreams(config, logger)
+}
+
+func NewRedisStreams(config map[string]interface{}, logger seelog.LoggerInterface) (*RedisStreams, error) {
+	r := RedisStreams{}
+	err := r.configure(config, logger)
+	return &r, err
+}
+
+// RedisStreams implements redis streams as reprow.Queue
+type RedisStreams struct {
+	Pool          *redigo.Pool
+	logger        seelog.LoggerInterface
+	config        Config
+	blockTimeout  time.Duration
+	claimIdle     time.Duration
+	claimInterval time.Duration
+	delayedKey    string
+	fieldsKey     string
+	claimed       chan *entry
+	wantDown      chan bool
+	running       bool
+	wg            sync.WaitGroup
+}
+
+type Config struct {
+	Address       string `valid:"required"`
+	Password      string `valid:"-"`
+	Database      int    `valid:"-"`
+	Stream        string `valid:"required"`
+	Group         string `valid:"required"`
+	Consumer      string `valid:"-"`
+	StartId       string `valid:"-" mapstructure:"start_id"`
+	PayloadField  string `valid:"-" mapstructure:"payload_field"`
+	DeadStream    string `valid:"-" mapstructure:"dead_stream"`
+	BlockTimeout  string `valid:"-" mapstructure:"block_timeout"`
+	ClaimIdle     string `valid:"-" mapstructure:"claim_idle"`
+	ClaimInterval string `valid:"-" mapstructure:"claim_interval"`
+}
+
+// entry is an entry of redis stream
+type entry struct {
+	id            string
+	fields        map[string]string
+	deliveryCount int
+}
+
+func (r *RedisStreams) Start(outChannel chan reprow.Job) error {
+	if r.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		r.running = true
+		r.wantDown = make(chan bool)
+		r.wg.Add(2)
+		go r.maintain()
+		go r.run(outChannel)
+		return nil
+	}
+}
+
+func (r *RedisStreams) run(outChannel chan reprow.Job) {
+	defer r.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: r,
+		}
+		select {
+		case outChannel <- &job:
+		case <-r.wantDown:
+			return
+		}
+		r.wg.Add(1)
+		go func(job *Job) {
+			defer job.finalize()
+			defer r.wg.Done()
+
+			var e *entry
+			select {
+			case e = <-r.claimed:
+			default:
+				var err error
+				e, err = r.read()
+				if err != nil {
+					r.logger.Errorf("reprow/redis_streams: failed to read e=%s", err.Error())
+					time.Sleep(time.Second)
+					return
+				}
+			}
+			if e == nil {
+				r.logger.Debugf("no queue retrieved")
+				return
+			}
+
+			job.entry = e
+			job.payload, job.err = r.decode(e)
+			if job.err != nil {
+				r.logger.Errorf("reprow/redis_streams: failed to deserialize entry. rejecting id=%s err=%s", e.id, job.err.Error())
+				r.Reject(job, "failed to deserialize")
+			}
+		}(&job)
+	}
+}
+
+// read reads a new entry for the consumer. nil is returned when no entry is available in block timeout
+func (r *RedisStreams) read() (*entry, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	reply, err := redigo.Values(conn.Do("XREADGROUP",
+		"GROUP", r.config.Group, r.config.Consumer,
+		"COUNT", 1,
+		"BLOCK", int(r.blockTimeout/time.Millisecond),
+		"STREAMS", r.config.Stream, ">"))
+	if err == redigo.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// reply is [[stream, [[id, [field, value, ...]], ...]]]
+	for _, s := range reply {
+		stream, err := redigo.Values(s, nil)
+		if err != nil || len(stream) != 2 {
+			return nil, errors.New("unexpected XREADGROUP reply")
+		}
+		entries, err := parseEntries(stream[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			e.deliveryCount = 1
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// maintain claims idle entries and adds delayed entries until queue is stopped
+func (r *RedisStreams) maintain() {
+	defer r.wg.Done()
+	for {
+		r.promote()
+		if len(r.claimed) == 0 {
+			r.claim()
+		}
+
+		select {
+		case <-r.wantDown:
+			return
+		case <-time.After(r.claimInterval):
+		}
+	}
+}
+
+// claim takes over entries that are pending longer than claim idle, including ones of dead consumers
+func (r *RedisStreams) claim() {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	reply, err := redigo.Values(conn.Do("XAUTOCLAIM", r.config.Stream, r.config.Group, r.config.Consumer,
+		int(r.claimIdle/time.Millisecond), "0-0", "COUNT", cap(r.claimed)))
+	if err != nil {
+		r.logger.Errorf("reprow/redis_streams: failed to claim idle entries e=%s", err.Error())
+		return
+	}
+	if len(reply) < 2 {
+		r.logger.Errorf("reprow/redis_streams: unexpected XAUTOCLAIM reply")
+		return
+	}
+	entries, err := parseEntries(reply[1])
+	if err != nil {
+		r.logger.Errorf("reprow/redis_streams: failed to parse claimed entries e=%s", err.Error())
+		return
+	}
+
+	for _, e := range entries {
+		e.deliveryCount = r.deliveryCount(conn, e.id)
+		r.logger.Infof("reprow/redis_streams: claimed idle entry id=%s delivery_count=%d", e.id, e.deliveryCount)
+		select {
+		case r.claimed <- e:
+		default:
+			// Entry would be claimed again after it gets idle
+			return
+		}
+	}
+}
+
+func (r *RedisStreams) deliveryCount(conn redigo.Conn, id string) int {
+	// reply is [[id, consumer, idle, delivery count]]
+	reply, err := redigo.Values(conn.Do("XPENDING", r.config.Stream, r.config.Group, id, id, 1))
+	if err != nil || len(reply) == 0 {
+		return 0
+	}
+	pending, err := redigo.Values(reply[0], nil)
+	if err != nil || len(pending) < 4 {
+		return 0
+	}
+	count, _ := redigo.Int(pending[3], nil)
+	return count
+}
+
+func (r *RedisStreams) promote() {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	n, err := redigo.Int(promoteScript.Do(conn, r.delayedKey, r.fieldsKey, r.config.Stream, time.Now().Unix()))
+	if err != nil {
+		r.logger.Errorf("reprow/redis_streams: failed to add delayed entries e=%s", err.Error())
+	} else if n > 0 {
+		r.logger.Debugf("reprow/redis_streams: added delayed entries count=%d", n)
+	}
+}
+
+func (r *RedisStreams) Stop() error {
+	r.logger.Infof("stopping queue")
+	if r.running == false {
+		return errors.New("not running")
+	} else {
+		close(r.wantDown)
+		r.wg.Wait()
+		r.running = false
+		return nil
+	}
+}
+
+func (r *RedisStreams) Abort(job *Job, retryAfter int) {
+	if retryAfter <= 0 {
+		// Entry is left pending and claimed again after it gets idle
+		r.logger.Debugf("reprow/redis_streams: aborting job id=%s", job.entry.id)
+		return
+	}
+
+	fields, err := json.Marshal(job.entry.fields)
+	if err != nil {
+		r.logger.Errorf("reprow/redis_streams: failed to serialize entry e=%s", err.Error())
+		return
+	}
+	conn := r.Pool.Get()
+	defer conn.Close()
+	at := time.Now().Add(time.Duration(retryAfter) * time.Second).Unix()
+	_, err = delayScript.Do(conn, r.config.Stream, r.delayedKey, r.fieldsKey, r.config.Group, job.entry.id, at, fields)
+	if err != nil {
+		r.logger.Errorf("reprow/redis_streams: abort failed id=%s e=%s", job.entry.id, err.Error())
+	}
+}
+
+func (r *RedisStreams) End(job *Job) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XACK", r.config.Stream, r.config.Group, job.entry.id)
+	if err != nil {
+		r.logger.Errorf("reprow/redis_streams: end failed id=%s e=%s", job.entry.id, err.Error())
+	}
+}
+
+func (r *RedisStreams) Reject(job *Job, reason string) {
+	r.logger.Errorf("reprow/redis_streams: job rejected id=%s reason=%s", job.entry.id, reason)
+
+	fields := make(map[string]string)
+	for k, v := range job.entry.fields {
+		fields[k] = v
+	}
+	fields["reprow_reason"] = reason
+	fields["reprow_id"] = job.entry.id
+	b, err := json.Marshal(fields)
+	if err != nil {
+		r.logger.Errorf("reprow/redis_streams: failed to serialize entry e=%s", err.Error())
+		return
+	}
+
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err = rejectScript.Do(conn, r.config.Stream, r.config.DeadStream, r.config.Group, job.entry.id, b)
+	if err != nil {
+		r.logger.Errorf("reprow/redis_streams: reject failed id=%s e=%s", job.entry.id, err.Error())
+	}
+}
+
+// decode makes payload from entry.
+// When payload_field is in the entry, it is decoded as json. Otherwise fields of the entry are the payload.
+func (r *RedisStreams) decode(e *entry) (map[string]interface{}, error) {
+	if value, found := e.fields[r.config.PayloadField]; found {
+		var payload map[string]interface{}
+		err := json.Unmarshal([]byte(value), &payload)
+		return payload, err
+	}
+	payload := make(map[string]interface{})
+	for k, v := range e.fields {
+		payload[k] = v
+	}
+	return payload, nil
+}
+
+func parseEntries(reply interface{}) ([]*entry, error) {
+	values, err := redigo.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*entry, 0, len(values))
+	for _, v := range values {
+		pair, err := redigo.Values(v, nil)
+		if err != nil || len(pair) != 2 {
+			return nil, errors.New("unexpected stream entry")
+		}
+		id, err := redigo.String(pair[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		if pair[1] == nil {
+			// Entry was deleted from the stream while it was pending
+			continue
+		}
+		fields, err := redigo.StringMap(pair[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry{id: id, fields: fields})
+	}
+	return entries, nil
+}
+
+func (r *RedisStreams) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	r.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if config.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		config.Consumer = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if config.StartId == "" {
+		config.StartId = "0"
+	}
+	if config.PayloadField == "" {
+		config.PayloadField = "payload"
+	}
+
+	r.blockTimeout, err = reprow.ParseDuration(config.BlockTimeout, "1s")
+	if err != nil {
+		return errors.New("block_timeout failed to parse: " + err.Error())
+	}
+	r.claimIdle, err = reprow.ParseDuration(config.ClaimIdle, "5m")
+	if err != nil {
+		return errors.New("claim_idle failed to parse: " + err.Error())
+	}
+	r.claimInterval, err = reprow.ParseDuration(config.ClaimInterval, "10s")
+	if err != nil {
+		return errors.New("claim_interval failed to parse: " + err.Error())
+	}
+
+	r.config = config
+	r.delayedKey = config.Stream + ":delayed"
+	r.fieldsKey = config.Stream + ":delayed:fields"
+	r.claimed = make(chan *entry, 10)
+
+	r.Pool = &redigo.Pool{
+		MaxIdle:     10,
+		IdleTimeout: time.Minute,
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", config.Address,
+				redigo.DialPassword(config.Password),
+				redigo.DialDatabase(config.Database))
+		},
+	}
+
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("XGROUP", "CREATE", config.Stream, config.Group, config.StartId, "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.New("failed to create consumer group: " + err.Error())
+	}
+	return nil
+}
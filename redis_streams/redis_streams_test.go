@@ -0,0 +1,181 @@
+package redis_streams
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func newTestRedisStreams(t *testing.T, server *miniredis.Miniredis, consumer string) *RedisStreams {
+	queue, err := NewRedisStreams(map[string]interface{}{
+		"address":        server.Addr(),
+		"stream":         "reprow_test",
+		"group":          "reprow",
+		"consumer":       consumer,
+		"dead_stream":    "reprow_test:dead",
+		"claim_idle":     "1s",
+		"claim_interval": "100ms",
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make redis streams queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func mustAdd(t *testing.T, server *miniredis.Miniredis, payload map[string]interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	_, err = server.XAdd("reprow_test", "*", []string{"payload", string(b)})
+	if err != nil {
+		t.Fatalf("failed to add e=%s", err.Error())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	var server *miniredis.Miniredis
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			if server != nil {
+				server.Close()
+			}
+			server = miniredis.RunT(t)
+			return newTestRedisStreams(t, server, "test")
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustAdd(t, server, payload)
+		},
+	}.Run(t)
+}
+
+func TestFieldsPayload(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestRedisStreams(t, server, "test")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	server.XAdd("reprow_test", "*", []string{"id", "fields", "name", "reprow"})
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "fields" || job.Payload()["name"] != "reprow" {
+		t.Errorf("fields should be payload got=%v", job.Payload())
+	}
+	metadata := reprow.JobMetadata(job)
+	if metadata["Stream"] != "reprow_test" || metadata["DeliveryCount"] != 1 {
+		t.Errorf("unexpected metadata got=%v", metadata)
+	}
+	job.End()
+}
+
+func TestRetryAfter(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestRedisStreams(t, server, "test")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustAdd(t, server, map[string]interface{}{"id": "delayed"})
+	mustReceive(t, stream).Abort(1)
+
+	delayed, _ := server.SortedSet("reprow_test:delayed")
+	if len(delayed) != 1 {
+		t.Fatalf("aborted job should be delayed got=%v", delayed)
+	}
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "delayed" {
+		t.Errorf("delayed job not delivered got=%v", job.Payload())
+	}
+	job.(reprow.Rejecter).Reject("invalid")
+
+	dead, _ := server.Stream("reprow_test:dead")
+	if len(dead) != 1 {
+		t.Fatalf("rejected job should be in dead stream got=%v", dead)
+	}
+	if reason := fieldOf(dead[0].Values, "reprow_reason"); reason != "invalid" {
+		t.Errorf("reason should be recorded got=%s", reason)
+	}
+}
+
+func TestRetryAfterSameFields(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestRedisStreams(t, server, "test")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustAdd(t, server, map[string]interface{}{"id": "same"})
+	mustAdd(t, server, map[string]interface{}{"id": "same"})
+	first := mustReceive(t, stream)
+	second := mustReceive(t, stream)
+	first.Abort(1)
+	second.Abort(1)
+
+	delayed, _ := server.SortedSet("reprow_test:delayed")
+	if len(delayed) != 2 {
+		t.Fatalf("entries with the same fields should be delayed separately got=%v", delayed)
+	}
+	for i := 0; i < 2; i++ {
+		job := mustReceive(t, stream)
+		if job.Payload()["id"] != "same" {
+			t.Errorf("delayed job not delivered got=%v", job.Payload())
+		}
+		job.End()
+	}
+}
+
+func TestClaim(t *testing.T) {
+	server := miniredis.RunT(t)
+	crashed := newTestRedisStreams(t, server, "crashed")
+	mustAdd(t, server, map[string]interface{}{"id": "orphan"})
+
+	// Consumer crashed while processing an entry
+	if _, err := crashed.read(); err != nil {
+		t.Fatalf("failed to read e=%s", err.Error())
+	}
+
+	queue := newTestRedisStreams(t, server, "test")
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "orphan" {
+		t.Errorf("orphan entry not claimed got=%v", job.Payload())
+	}
+	if count := reprow.JobMetadata(job)["DeliveryCount"]; count != 2 {
+		t.Errorf("delivery count should be 2 got=%v", count)
+	}
+	job.End()
+}
+
+func fieldOf(values []string, name string) string {
+	for i := 0; i+1 < len(values); i += 2 {
+		if values[i] == name {
+			return values[i+1]
+		}
+	}
+	return ""
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
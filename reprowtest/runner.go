@@ -0,0 +1,117 @@
+package reprowtest
+
+import (
+	"errors"
+	"github.com/maedama/reprow"
+	"sync"
+	"time"
+)
+
+// Action describes how ScriptedRunner handles a job.
+type Action struct {
+	Delay      time.Duration // Time to wait before finishing the job
+	Result     string        // One of "end", "abort" or "reject"
+	RetryAfter int           // RetryAfter passed to Abort
+	Reason     string        // Reason passed to Reject
+}
+
+// End returns action that ends job.
+func End() Action { return Action{Result: "end"} }
+
+// Abort returns action that aborts job with retryAfter.
+func Abort(retryAfter int) Action { return Action{Result: "abort", RetryAfter: retryAfter} }
+
+// Reject returns action that rejects job with reason.
+func Reject(reason string) Action { return Action{Result: "reject", Reason: reason} }
+
+// ScriptedRunner is a fake reprow.Runner.
+// Jobs are handled by actions in Script in order, and Default is used after Script is exhausted.
+type ScriptedRunner struct {
+	Concurrency int
+	Script      []Action
+	Default     Action
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    []reprow.Job
+	handled int
+}
+
+// NewScriptedRunner makes ScriptedRunner that ends jobs by default.
+func NewScriptedRunner(concurrency int, script ...Action) *ScriptedRunner {
+	return &ScriptedRunner{
+		Concurrency: concurrency,
+		Script:      script,
+		Default:     End(),
+	}
+}
+
+func (r *ScriptedRunner) MaximumConcurrency() int { return r.Concurrency }
+
+func (r *ScriptedRunner) Run(job reprow.Job) error {
+	r.mu.Lock()
+	action := r.Default
+	if len(r.jobs) < len(r.Script) {
+		action = r.Script[len(r.jobs)]
+	}
+	r.jobs = append(r.jobs, job)
+	r.mu.Unlock()
+
+	if action.Delay > 0 {
+		time.Sleep(action.Delay)
+	}
+
+	var err error
+	switch action.Result {
+	case "abort":
+		job.Abort(action.RetryAfter)
+		err = errors.New("aborted by script")
+	case "reject":
+		reprow.RejectJob(job, action.Reason)
+		err = errors.New("rejected by script")
+	default:
+		job.End()
+	}
+
+	r.mu.Lock()
+	r.handled++
+	r.condition().Broadcast()
+	r.mu.Unlock()
+	return err
+}
+
+// Jobs returns jobs passed to Run in order.
+func (r *ScriptedRunner) Jobs() []reprow.Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]reprow.Job{}, r.jobs...)
+}
+
+// WaitFor waits until n jobs are handled by Run. false is returned on timeout.
+func (r *ScriptedRunner) WaitFor(n int, timeout time.Duration) bool {
+	timer := time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		r.condition().Broadcast()
+		r.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.handled < n {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		r.condition().Wait()
+	}
+	return true
+}
+
+// condition should be called with lock held
+func (r *ScriptedRunner) condition() *sync.Cond {
+	if r.cond == nil {
+		r.cond = sync.NewCond(&r.mu)
+	}
+	return r.cond
+}
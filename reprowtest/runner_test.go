@@ -0,0 +1,42 @@
+package reprowtest
+
+import (
+	"context"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/memory"
+	"testing"
+	"time"
+)
+
+func TestScriptedRunner(t *testing.T) {
+	queue, err := memory.NewMemory(map[string]interface{}{}, seelog.Disabled)
+	if err != nil {
+		t.Fatalf("failed to make queue e=%s", err.Error())
+	}
+	runner := NewScriptedRunner(1, Abort(0), Reject("invalid"))
+	server, err := reprow.NewServerFrom(queue, runner)
+	if err != nil {
+		t.Fatalf("failed to make server e=%s", err.Error())
+	}
+
+	queue.Push(map[string]interface{}{"id": 1})
+	queue.Push(map[string]interface{}{"id": 2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- server.Run(ctx) }()
+
+	if !runner.WaitFor(3, 2*time.Second) {
+		t.Fatalf("jobs not handled got=%d", len(runner.Jobs()))
+	}
+	cancel()
+	<-result
+
+	if len(queue.Aborted()) != 1 || len(queue.Rejected()) != 1 || len(queue.Ended()) != 1 {
+		t.Errorf("script not followed aborted=%v rejected=%v ended=%v", queue.Aborted(), queue.Rejected(), queue.Ended())
+	}
+	if queue.Ended()[0]["id"] != 1 {
+		t.Errorf("aborted job should be ended by default action got=%v", queue.Ended())
+	}
+}
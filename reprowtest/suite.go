@@ -0,0 +1,360 @@
+// reprowtest package provides utilities for testing reprow queue backends and runners.
+//
+// QueueSuite is a conformance suite that every reprow.Queue implementation is expected to pass.
+// It checks the contract that reprow.Server relies on:
+//   - Start can not be called twice and Stop fails when queue is not running
+//   - Queue can be started again after Stop
+//   - Ended jobs are never delivered again
+//   - Aborted jobs are delivered again
+//   - No job is sent to the channel after Stop returns
+//   - No job is lost when queue is stopped while jobs are running
+//
+// Jobs whose WaitFinalize returns false are treated as placeholders and ignored, like reprow.Server does.
+package reprowtest
+
+import (
+	"fmt"
+	"github.com/maedama/reprow"
+	"sync"
+	"testing"
+	"time"
+)
+
+// IDField is payload field that QueueSuite uses to identify jobs.
+const IDField = "reprowtest_id"
+
+// QueueSuite is a conformance suite for queue backends.
+type QueueSuite struct {
+	// NewQueue returns queue connected to a new and empty backend.
+	NewQueue func(t *testing.T) reprow.Queue
+	// Push enqueues payload to backend of queue.
+	Push func(t *testing.T, queue reprow.Queue, payload map[string]interface{})
+	// Payload returns payload given to Push from job. job.Payload() is used when nil.
+	Payload func(job reprow.Job) map[string]interface{}
+	// Timeout is maximum time to wait for a job to be delivered. Defaults to 5 seconds.
+	Timeout time.Duration
+	// QuietPeriod is time to wait to make sure a job is not delivered. Defaults to 500 milliseconds.
+	QuietPeriod time.Duration
+	// Concurrency is maximum number of jobs processed at a time like runner's MaximumConcurrency. Defaults to 4.
+	Concurrency int
+}
+
+// Run runs all conformance tests as sub tests of t.
+func (s QueueSuite) Run(t *testing.T) {
+	if s.Timeout == 0 {
+		s.Timeout = 5 * time.Second
+	}
+	if s.QuietPeriod == 0 {
+		s.QuietPeriod = 500 * time.Millisecond
+	}
+	if s.Concurrency == 0 {
+		s.Concurrency = 4
+	}
+	if s.Payload == nil {
+		s.Payload = func(job reprow.Job) map[string]interface{} { return job.Payload() }
+	}
+
+	t.Run("StartStop", s.testStartStop)
+	t.Run("EndRemoves", s.testEndRemoves)
+	t.Run("AbortRedelivers", s.testAbortRedelivers)
+	t.Run("StopDrains", s.testStopDrains)
+	t.Run("NoJobLostOnShutdown", s.testNoJobLostOnShutdown)
+}
+
+func (s QueueSuite) testStartStop(t *testing.T) {
+	queue := s.NewQueue(t)
+
+	err := s.within(t, "Stop before Start", func() error { return queue.Stop() })
+	if err == nil {
+		t.Errorf("Stop before Start should be error")
+	}
+
+	c := s.start(t, queue)
+	err = queue.Start(make(chan reprow.Job))
+	if err == nil {
+		t.Errorf("Start called twice should be error")
+	}
+	c.stop(t)
+
+	err = s.within(t, "Stop after Stop", func() error { return queue.Stop() })
+	if err == nil {
+		t.Errorf("Stop after Stop should be error")
+	}
+
+	c = s.start(t, queue)
+	s.Push(t, queue, s.payload("restart"))
+	job := c.next(t, s.Timeout)
+	if job != nil {
+		job.End()
+	}
+	c.stop(t)
+}
+
+func (s QueueSuite) testEndRemoves(t *testing.T) {
+	queue := s.NewQueue(t)
+	c := s.start(t, queue)
+	defer c.stop(t)
+
+	s.Push(t, queue, s.payload("end"))
+	job := c.next(t, s.Timeout)
+	if job == nil {
+		return
+	}
+	if s.id(job) != "end" {
+		t.Errorf("unexpected job delivered id=%s", s.id(job))
+	}
+	job.End()
+
+	if job := c.poll(s.QuietPeriod); job != nil {
+		t.Errorf("ended job delivered again id=%s", s.id(job))
+		job.End()
+	}
+}
+
+func (s QueueSuite) testAbortRedelivers(t *testing.T) {
+	queue := s.NewQueue(t)
+	c := s.start(t, queue)
+	defer c.stop(t)
+
+	s.Push(t, queue, s.payload("abort"))
+	job := c.next(t, s.Timeout)
+	if job == nil {
+		return
+	}
+	job.Abort(0)
+
+	job = c.next(t, s.Timeout)
+	if job == nil {
+		return
+	}
+	if s.id(job) != "abort" {
+		t.Errorf("aborted job not delivered again got=%s", s.id(job))
+	}
+	job.End()
+}
+
+func (s QueueSuite) testStopDrains(t *testing.T) {
+	queue := s.NewQueue(t)
+	c := s.start(t, queue)
+	for i := 0; i < 3; i++ {
+		s.Push(t, queue, s.payload(fmt.Sprintf("drain-%d", i)))
+	}
+	job := c.next(t, s.Timeout)
+	jobs := c.stop(t)
+	if job != nil {
+		jobs = append(jobs, job)
+	}
+	for _, job := range jobs {
+		job.End()
+	}
+}
+
+func (s QueueSuite) testNoJobLostOnShutdown(t *testing.T) {
+	queue := s.NewQueue(t)
+	remaining := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("lost-%d", i)
+		remaining[id] = true
+		s.Push(t, queue, s.payload(id))
+	}
+
+	c := s.start(t, queue)
+	var running []reprow.Job
+	for i := 0; i < 3; i++ {
+		job := c.next(t, s.Timeout)
+		if job == nil {
+			c.stop(t)
+			return
+		}
+		if i == 0 {
+			job.End()
+			delete(remaining, s.id(job))
+		} else {
+			running = append(running, job)
+		}
+	}
+
+	// Jobs still running or delivered while stopping fail after queue is stopped
+	running = append(running, c.stop(t)...)
+	for _, job := range running {
+		job.Abort(0)
+	}
+
+	c = s.start(t, queue)
+	defer c.stop(t)
+	for len(remaining) > 0 {
+		job := c.next(t, s.Timeout)
+		if job == nil {
+			t.Errorf("jobs lost on shutdown ids=%v", remaining)
+			return
+		}
+		delete(remaining, s.id(job))
+		job.End()
+	}
+}
+
+func (s QueueSuite) payload(id string) map[string]interface{} {
+	return map[string]interface{}{IDField: id}
+}
+
+func (s QueueSuite) id(job reprow.Job) string {
+	return fmt.Sprint(s.Payload(job.(*runningJob).Job)[IDField])
+}
+
+func (s QueueSuite) within(t *testing.T, name string, f func() error) error {
+	result := make(chan error, 1)
+	go func() { result <- f() }()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(s.Timeout):
+		t.Fatalf("%s did not return in %s", name, s.Timeout)
+	}
+	return nil
+}
+
+func (s QueueSuite) start(t *testing.T, queue reprow.Queue) *consumer {
+	c := &consumer{
+		suite:     s,
+		queue:     queue,
+		out:       make(chan reprow.Job),
+		delivered: make(chan reprow.Job, 1024),
+		semaphore: make(chan bool, s.Concurrency),
+		closing:   make(chan bool),
+		done:      make(chan bool),
+	}
+	err := queue.Start(c.out)
+	if err != nil {
+		t.Fatalf("failed to start queue e=%s", err.Error())
+	}
+	go c.run()
+	return c
+}
+
+// consumer receives jobs from queue like reprow.Server does
+type consumer struct {
+	suite     QueueSuite
+	queue     reprow.Queue
+	out       chan reprow.Job
+	delivered chan reprow.Job
+	semaphore chan bool
+	closing   chan bool
+	done      chan bool
+	wg        sync.WaitGroup
+	stopped   bool
+	mu        sync.Mutex
+	received  int
+}
+
+func (c *consumer) run() {
+	for job := range c.out {
+		c.mu.Lock()
+		c.received++
+		c.mu.Unlock()
+
+		// Jobs held by test should not block consumer from closing
+		slot := c.semaphore
+		select {
+		case slot <- true:
+		case <-c.closing:
+			slot = make(chan bool, 1)
+			slot <- true
+		}
+
+		c.wg.Add(1)
+		go func(job reprow.Job, slot chan bool) {
+			defer c.wg.Done()
+			if job.WaitFinalize() {
+				c.delivered <- &runningJob{Job: job, semaphore: slot}
+			} else {
+				<-slot
+			}
+		}(job, slot)
+	}
+	c.wg.Wait()
+	close(c.done)
+}
+
+// next returns next delivered job. nil is returned with test error when no job is delivered in timeout.
+func (c *consumer) next(t *testing.T, timeout time.Duration) reprow.Job {
+	job := c.poll(timeout)
+	if job == nil {
+		t.Errorf("no job delivered in %s", timeout)
+	}
+	return job
+}
+
+func (c *consumer) poll(timeout time.Duration) reprow.Job {
+	select {
+	case job := <-c.delivered:
+		return job
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// stop stops queue and returns jobs delivered but not yet received by test.
+func (c *consumer) stop(t *testing.T) []reprow.Job {
+	if c.stopped {
+		return nil
+	}
+	c.stopped = true
+
+	err := c.suite.within(t, "Stop", func() error { return c.queue.Stop() })
+	if err != nil {
+		t.Errorf("failed to stop queue e=%s", err.Error())
+	}
+
+	// Give jobs sent before Stop returned a moment to be counted
+	time.Sleep(50 * time.Millisecond)
+	c.mu.Lock()
+	received := c.received
+	c.mu.Unlock()
+
+	time.Sleep(c.suite.QuietPeriod)
+	c.mu.Lock()
+	late := c.received - received
+	c.mu.Unlock()
+	if late > 0 {
+		t.Errorf("%d jobs sent after Stop returned", late)
+	}
+	close(c.closing)
+	close(c.out)
+	<-c.done
+
+	var jobs []reprow.Job
+	for {
+		select {
+		case job := <-c.delivered:
+			jobs = append(jobs, job)
+		default:
+			return jobs
+		}
+	}
+}
+
+// runningJob releases slot of consumer when the job is finished
+type runningJob struct {
+	reprow.Job
+	semaphore chan bool
+	once      sync.Once
+}
+
+func (j *runningJob) release() {
+	j.once.Do(func() { <-j.semaphore })
+}
+
+func (j *runningJob) Abort(retryAfter int) {
+	j.Job.Abort(retryAfter)
+	j.release()
+}
+
+func (j *runningJob) End() {
+	j.Job.End()
+	j.release()
+}
+
+func (j *runningJob) Reject(reason string) {
+	reprow.RejectJob(j.Job, reason)
+	j.release()
+}
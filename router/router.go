@@ -0,0 +1,245 @@
+// router package implements runner that dispatches jobs to one of child runners by content of the job.
+// Routes are evaluated in order and first route whose rules all match the job is used.
+package router
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"regexp"
+)
+
+var (
+	unmatchedActions = map[string]bool{"reject": true, "abort": true, "end": true}
+)
+
+func init() {
+	reprow.RegisterRunner("router", &RouterBuilder{})
+}
+
+type RouterBuilder struct{}
+
+func (b *RouterBuilder) NewRunner(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Runner, error) {
+	return NewRouter(config, logger)
+}
+
+func NewRouter(config map[string]interface{}, logger seelog.LoggerInterface) (*Router, error) {
+	r := Router{}
+	err := r.configure(config, logger)
+	return &r, err
+}
+
+// Router implements reprow.Runner that routes jobs to child runners
+type Router struct {
+	logger  seelog.LoggerInterface
+	config  Config
+	routes  []*route
+	runners map[string]*child
+	dflt    *child
+}
+
+type Config struct {
+	Runners    map[string]map[string]interface{} `valid:"-"`
+	Routes     []RouteConfig                     `valid:"-"`
+	Default    string                            `valid:"-"`
+	Unmatched  string                            `valid:"-"`
+	RetryAfter int                               `valid:"-" mapstructure:"retry_after"`
+}
+
+// RouteConfig dispatches job to Runner when all of the rules in Match matches.
+type RouteConfig struct {
+	Runner string
+	Match  []RuleConfig
+}
+
+// RuleConfig describes a condition over a payload field or a metadata field.
+// Exactly one of Field or Metadata should be given as dot separated path.
+// Equals, Regex and Exists can be combined, and all given conditions must be satisfied.
+type RuleConfig struct {
+	Field    string
+	Metadata string
+	Equals   interface{}
+	Regex    string
+	Exists   *bool
+}
+
+type child struct {
+	name      string
+	runner    reprow.Runner
+	semaphore chan bool
+}
+
+func (c *child) run(job reprow.Job) error {
+	c.semaphore <- true
+	defer func() { <-c.semaphore }()
+	return c.runner.Run(job)
+}
+
+type route struct {
+	child *child
+	rules []*rule
+}
+
+func (r *route) match(job reprow.Job) bool {
+	for _, rule := range r.rules {
+		if !rule.match(job) {
+			return false
+		}
+	}
+	return true
+}
+
+type rule struct {
+	field    string
+	metadata bool
+	equals   *string
+	regex    *regexp.Regexp
+	exists   *bool
+}
+
+func (r *rule) match(job reprow.Job) bool {
+	var value interface{}
+	var found bool
+	if r.metadata {
+		value, found = reprow.LookupField(reprow.JobMetadata(job), r.field)
+	} else {
+		value, found = reprow.LookupField(job.Payload(), r.field)
+	}
+
+	if r.exists != nil && *r.exists != found {
+		return false
+	}
+	if r.equals != nil && (!found || fmt.Sprint(value) != *r.equals) {
+		return false
+	}
+	if r.regex != nil && (!found || !r.regex.MatchString(fmt.Sprint(value))) {
+		return false
+	}
+	return true
+}
+
+func (r *Router) MaximumConcurrency() int {
+	total := 0
+	for _, c := range r.runners {
+		total += c.runner.MaximumConcurrency()
+	}
+	return total
+}
+
+func (r *Router) Run(job reprow.Job) error {
+	for _, route := range r.routes {
+		if route.match(job) {
+			return route.child.run(job)
+		}
+	}
+	if r.dflt != nil {
+		return r.dflt.run(job)
+	}
+
+	r.logger.Errorf("no route matched job. action=%s", r.config.Unmatched)
+	switch r.config.Unmatched {
+	case "abort":
+		job.Abort(r.config.RetryAfter)
+	case "end":
+		job.End()
+	default:
+		reprow.RejectJob(job, "no route matched")
+	}
+	return errors.New("no route matched")
+}
+
+func (r *Router) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	r.logger = logger
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Runners) == 0 {
+		return errors.New("runners required")
+	}
+	if config.Unmatched == "" {
+		config.Unmatched = "reject"
+	}
+	if !unmatchedActions[config.Unmatched] {
+		return errors.New("unknown unmatched action " + config.Unmatched)
+	}
+
+	r.runners = make(map[string]*child)
+	for name, runnerConfig := range config.Runners {
+		runner, err := reprow.NewRunner(runnerConfig, logger)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to configure runner name=%s e=%s", name, err.Error()))
+		}
+		r.runners[name] = &child{
+			name:      name,
+			runner:    runner,
+			semaphore: make(chan bool, runner.MaximumConcurrency()),
+		}
+	}
+
+	for i, routeConfig := range config.Routes {
+		c, found := r.runners[routeConfig.Runner]
+		if !found {
+			return errors.New(fmt.Sprintf("route %d refers unknown runner %s", i, routeConfig.Runner))
+		}
+		route := &route{child: c}
+		for _, ruleConfig := range routeConfig.Match {
+			rule, err := newRule(ruleConfig)
+			if err != nil {
+				return errors.New(fmt.Sprintf("route %d has invalid rule e=%s", i, err.Error()))
+			}
+			route.rules = append(route.rules, rule)
+		}
+		r.routes = append(r.routes, route)
+	}
+
+	if config.Default != "" {
+		c, found := r.runners[config.Default]
+		if !found {
+			return errors.New("default refers unknown runner " + config.Default)
+		}
+		r.dflt = c
+	}
+
+	r.config = config
+	return nil
+}
+
+func newRule(config RuleConfig) (*rule, error) {
+	r := &rule{
+		field:  config.Field,
+		exists: config.Exists,
+	}
+	if config.Metadata != "" {
+		r.field = config.Metadata
+		r.metadata = true
+	}
+	if r.field == "" || (config.Field != "" && config.Metadata != "") {
+		return nil, errors.New("exactly one of field or metadata is required")
+	}
+
+	if config.Equals != nil {
+		equals := fmt.Sprint(config.Equals)
+		r.equals = &equals
+	}
+	if config.Regex != "" {
+		var err error
+		r.regex, err = regexp.Compile(config.Regex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.equals == nil && r.regex == nil && r.exists == nil {
+		return nil, errors.New("one of equals, regex or exists is required")
+	}
+	return r, nil
+}
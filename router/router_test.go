@@ -0,0 +1,151 @@
+package router
+
+import (
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"os"
+	"testing"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func init() {
+	reprow.RegisterRunner("router_test", &TestRunnerBuilder{})
+}
+
+type TestRunnerBuilder struct{}
+
+func (b *TestRunnerBuilder) NewRunner(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Runner, error) {
+	return &TestRunner{name: config["name"].(string)}, nil
+}
+
+type TestRunner struct {
+	name string
+}
+
+func (r *TestRunner) MaximumConcurrency() int { return 2 }
+func (r *TestRunner) Run(job reprow.Job) error {
+	job.(*TestJob).runner = r.name
+	job.End()
+	return nil
+}
+
+type TestJob struct {
+	payload  map[string]interface{}
+	metadata map[string]interface{}
+	runner   string
+	status   string
+}
+
+func (j *TestJob) Payload() map[string]interface{}  { return j.payload }
+func (j *TestJob) Metadata() map[string]interface{} { return j.metadata }
+func (j *TestJob) Abort(retryAfter int)             { j.status = "aborted" }
+func (j *TestJob) End()                             { j.status = "completed" }
+func (j *TestJob) Reject(reason string)             { j.status = "rejected" }
+func (j *TestJob) WaitFinalize() bool               { return true }
+
+func newTestRouter(t *testing.T, extra map[string]interface{}) *Router {
+	config := map[string]interface{}{
+		"runners": map[string]interface{}{
+			"users":  map[string]interface{}{"type": "router_test", "name": "users"},
+			"orders": map[string]interface{}{"type": "router_test", "name": "orders"},
+		},
+		"routes": []interface{}{
+			map[string]interface{}{
+				"runner": "users",
+				"match": []interface{}{
+					map[string]interface{}{"field": "type", "equals": "user"},
+					map[string]interface{}{"field": "user.id", "exists": true},
+				},
+			},
+			map[string]interface{}{
+				"runner": "orders",
+				"match": []interface{}{
+					map[string]interface{}{"metadata": "MessageAttributes.kind", "regex": "^order"},
+				},
+			},
+		},
+	}
+	for k, v := range extra {
+		config[k] = v
+	}
+	router, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatalf("failed to make router e=%s", err.Error())
+	}
+	return router
+}
+
+func TestRun(t *testing.T) {
+	router := newTestRouter(t, nil)
+
+	if router.MaximumConcurrency() != 4 {
+		t.Errorf("concurrency should be sum of runners got=%d", router.MaximumConcurrency())
+	}
+
+	job := &TestJob{payload: map[string]interface{}{"type": "user", "user": map[string]interface{}{"id": 1}}}
+	router.Run(job)
+	if job.runner != "users" || job.status != "completed" {
+		t.Errorf("job not routed to users runner=%s status=%s", job.runner, job.status)
+	}
+
+	job = &TestJob{
+		payload:  map[string]interface{}{"type": "user"},
+		metadata: map[string]interface{}{"MessageAttributes": map[string]interface{}{"kind": "order.created"}},
+	}
+	router.Run(job)
+	if job.runner != "orders" || job.status != "completed" {
+		t.Errorf("job not routed to orders runner=%s status=%s", job.runner, job.status)
+	}
+
+	job = &TestJob{payload: map[string]interface{}{"type": "other"}}
+	err := router.Run(job)
+	if err == nil || job.status != "rejected" {
+		t.Errorf("unmatched job should be rejected status=%s", job.status)
+	}
+}
+
+func TestRunUnmatched(t *testing.T) {
+	router := newTestRouter(t, map[string]interface{}{"default": "orders"})
+	job := &TestJob{payload: map[string]interface{}{"type": "other"}}
+	router.Run(job)
+	if job.runner != "orders" {
+		t.Errorf("unmatched job should be routed to default runner=%s", job.runner)
+	}
+
+	router = newTestRouter(t, map[string]interface{}{"unmatched": "abort"})
+	job = &TestJob{payload: map[string]interface{}{"type": "other"}}
+	router.Run(job)
+	if job.status != "aborted" {
+		t.Errorf("unmatched job should be aborted status=%s", job.status)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	_, err := NewRouter(map[string]interface{}{
+		"runners": map[string]interface{}{
+			"users": map[string]interface{}{"type": "router_test", "name": "users"},
+		},
+		"routes": []interface{}{
+			map[string]interface{}{"runner": "unknown"},
+		},
+	}, logger)
+	if err == nil {
+		t.Errorf("unknown runner should be error")
+	}
+
+	_, err = NewRouter(map[string]interface{}{
+		"runners": map[string]interface{}{
+			"users": map[string]interface{}{"type": "router_test", "name": "users"},
+		},
+		"routes": []interface{}{
+			map[string]interface{}{
+				"runner": "users",
+				"match":  []interface{}{map[string]interface{}{"field": "type"}},
+			},
+		},
+	}, logger)
+	if err == nil {
+		t.Errorf("rule without condition should be error")
+	}
+}
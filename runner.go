@@ -1,6 +1,7 @@
 package reprow
 
 import (
+	"errors"
 	"github.com/cihub/seelog"
 )
 
@@ -31,3 +32,17 @@ func RegisterRunner(name string, runner RunnerBuilder) {
 	}
 	runners[name] = runner
 }
+
+// NewRunner builds runner registered with name config["type"].
+// It allows runners to be composed of other runners.
+func NewRunner(config map[string]interface{}, logger seelog.LoggerInterface) (Runner, error) {
+	runnerType, ok := config["type"].(string)
+	if !ok {
+		return nil, errors.New("runner type required")
+	}
+	runnerBuilder := runners[runnerType]
+	if runnerBuilder == nil {
+		return nil, errors.New("runner not registered")
+	}
+	return runnerBuilder.NewRunner(config, logger)
+}
@@ -0,0 +1,95 @@
+package reprow
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xeipuuv/gojsonschema"
+	"path/filepath"
+)
+
+// SchemaConfig describes json schemas that payloads are validated against before they are passed to runners.
+// Path is used for every job, unless TypeField is set and value of the field is found in Types.
+type SchemaConfig struct {
+	Path      string            `mapstructure:"path"`
+	TypeField string            `mapstructure:"type_field"`
+	Types     map[string]string `mapstructure:"types"`
+}
+
+// SchemaValidator validates job payloads with json schemas.
+type SchemaValidator struct {
+	typeField string
+	fallback  *gojsonschema.Schema
+	types     map[string]*gojsonschema.Schema
+}
+
+// NewSchemaValidator loads all schema files in config.
+func NewSchemaValidator(config SchemaConfig) (*SchemaValidator, error) {
+	if config.Path == "" && len(config.Types) == 0 {
+		return nil, errors.New("schema path or types required")
+	}
+	if len(config.Types) > 0 && config.TypeField == "" {
+		return nil, errors.New("type_field is required when types are specified")
+	}
+
+	v := &SchemaValidator{
+		typeField: config.TypeField,
+		types:     make(map[string]*gojsonschema.Schema),
+	}
+
+	var err error
+	if config.Path != "" {
+		v.fallback, err = loadSchema(config.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, path := range config.Types {
+		v.types[name], err = loadSchema(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Validate returns list of validation errors. Empty list is returned when payload is valid.
+func (v *SchemaValidator) Validate(payload map[string]interface{}) []string {
+	schema := v.fallback
+	if v.typeField != "" {
+		if value, found := LookupField(payload, v.typeField); found {
+			if s, found := v.types[fmt.Sprint(value)]; found {
+				schema = s
+			}
+		}
+	}
+	if schema == nil {
+		return []string{fmt.Sprintf("no schema found for %s", v.typeField)}
+	}
+
+	result, err := schema.Validate(gojsonschema.NewGoLoader(payload))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	messages := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		messages = append(messages, e.String())
+	}
+	return messages
+}
+
+func loadSchema(path string) (*gojsonschema.Schema, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(abs)))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to load schema path=%s e=%s", path, err.Error()))
+	}
+	return schema, nil
+}
@@ -0,0 +1,68 @@
+package reprow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchemaValidator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reprow-schema")
+	if err != nil {
+		t.Fatalf("failed to make temp dir e=%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	userSchema := writeSchema(t, dir, "user.json", `{"type":"object","required":["type","id"],"properties":{"id":{"type":"integer"}}}`)
+	anySchema := writeSchema(t, dir, "any.json", `{"type":"object","required":["type"]}`)
+
+	validator, err := NewSchemaValidator(SchemaConfig{
+		Path:      anySchema,
+		TypeField: "type",
+		Types:     map[string]string{"user": userSchema},
+	})
+	if err != nil {
+		t.Fatalf("failed to make validator e=%s", err.Error())
+	}
+
+	cases := []struct {
+		payload map[string]interface{}
+		valid   bool
+	}{
+		{map[string]interface{}{"type": "user", "id": 10}, true},
+		{map[string]interface{}{"type": "user", "id": "10"}, false},
+		{map[string]interface{}{"type": "user"}, false},
+		{map[string]interface{}{"type": "other"}, true},
+		{map[string]interface{}{"id": 10}, false},
+	}
+	for _, c := range cases {
+		errs := validator.Validate(c.payload)
+		if c.valid && len(errs) > 0 {
+			t.Errorf("payload expected to be valid payload=%v errors=%v", c.payload, errs)
+		}
+		if !c.valid && len(errs) == 0 {
+			t.Errorf("payload expected to be invalid payload=%v", c.payload)
+		}
+	}
+}
+
+func TestSchemaValidatorConfig(t *testing.T) {
+	_, err := NewSchemaValidator(SchemaConfig{})
+	if err == nil {
+		t.Errorf("empty config should be error")
+	}
+	_, err = NewSchemaValidator(SchemaConfig{Types: map[string]string{"user": "user.json"}})
+	if err == nil {
+		t.Errorf("types without type_field should be error")
+	}
+}
+
+func writeSchema(t *testing.T, dir string, name string, body string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(body), 0644)
+	if err != nil {
+		t.Fatalf("failed to write schema e=%s", err.Error())
+	}
+	return path
+}
@@ -1,26 +1,49 @@
 package reprow
 
 import (
+	"context"
 	"errors"
 	"github.com/cihub/seelog"
 	"github.com/mitchellh/mapstructure"
+	"io"
 	"os"
-	"os/signal"
+	"strings"
 	"sync"
-	"syscall"
 )
 
 type Config struct {
 	Queue    map[string]interface{}
 	Runner   map[string]interface{}
+	Schema   *SchemaConfig
 	LogLevel string `valid:"string" mapstructure:"log_level"`
 }
 
-// Server implements reprow server. It should be generated by NewServer function
+// Server implements reprow server. It should be generated by NewServer or NewServerFrom function
 type Server struct {
-	queue  Queue
-	runner Runner
-	logger seelog.LoggerInterface
+	queue     Queue
+	runner    Runner
+	validator *SchemaValidator
+	logger    seelog.LoggerInterface
+}
+
+// ServerOption configures Server made by NewServerFrom.
+type ServerOption func(*Server) error
+
+// WithLogger sets logger of server. Logs are disabled by default.
+func WithLogger(logger seelog.LoggerInterface) ServerOption {
+	return func(s *Server) error {
+		s.logger = logger
+		return nil
+	}
+}
+
+// WithSchema validates payloads with json schemas before they are passed to runner.
+func WithSchema(config SchemaConfig) ServerOption {
+	return func(s *Server) error {
+		var err error
+		s.validator, err = NewSchemaValidator(config)
+		return err
+	}
 }
 
 // New server makes and initialized Server with configurations.
@@ -35,69 +58,94 @@ func NewServer(configMap map[interface{}]interface{}) (*Server, error) {
 	}
 }
 
-// Run starts a server process until signals are trapped.
-func (s *Server) Run() int {
+// NewServerFrom makes Server from queue and runner instances.
+// It is intended for embedding reprow into other go programs and tests.
+func NewServerFrom(queue Queue, runner Runner, options ...ServerOption) (*Server, error) {
+	if queue == nil {
+		return nil, errors.New("queue is nil")
+	}
+	if runner == nil {
+		return nil, errors.New("runner is nil")
+	}
+	server := &Server{
+		queue:  queue,
+		runner: runner,
+		logger: seelog.Disabled,
+	}
+	for _, option := range options {
+		err := option(server)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+// Run starts a server process until ctx is done.
+// Queue is stopped and all running jobs are waited before it returns ctx.Err().
+// Queue implementing io.Closer, such as one listening for requests, is closed after that.
+func (s *Server) Run(ctx context.Context) error {
 	s.logger.Infof("runnig server.")
-	defer seelog.Flush()
+	defer s.logger.Flush()
 
 	jobChannel := make(chan Job)
 	semaphore := make(chan bool, s.runner.MaximumConcurrency())
-	exit := make(chan int)
+	dispatcherDone := make(chan bool)
 
 	var wait sync.WaitGroup
 	// Start dequeue.
-	wait.Add(1)
-	s.queue.Start(jobChannel)
+	err := s.queue.Start(jobChannel)
+	if err != nil {
+		return errors.New("failed to start queue: " + err.Error())
+	}
 
 	// Start runners
 	go func() {
-		wait.Add(1)
 		for job := range jobChannel {
 			semaphore <- true
 			wait.Add(1)
 			go func(job Job) {
+				defer wait.Done()
 				finalized := job.WaitFinalize()
 				if finalized == true {
-					_ = s.runner.Run(job)
+					s.dispatch(job)
 				}
 				<-semaphore
-				wait.Done()
 			}(job)
 		}
-		wait.Done()
+		close(dispatcherDone)
 	}()
 
-	// Start Signal handlers
-	go func() {
-		sigCh := make(chan os.Signal, 1)
-		var wantDown sync.Once
-		signal.Notify(
-			sigCh,
-			syscall.SIGHUP,
-			syscall.SIGINT,
-			syscall.SIGTERM,
-			syscall.SIGQUIT)
-
-		for {
-			sig := <-sigCh
-			switch sig {
-			default:
-				wantDown.Do(func() {
-					s.logger.Info("stopping dequeue, gracefully shutting down")
-					s.queue.Stop()
-					close(jobChannel)
-					wait.Done()
-				})
-			}
+	<-ctx.Done()
+	s.logger.Info("stopping dequeue, gracefully shutting down")
+	err = s.queue.Stop()
+	close(jobChannel)
+	<-dispatcherDone
+	wait.Wait()
+
+	if closer, ok := s.queue.(io.Closer); ok {
+		cerr := closer.Close()
+		if cerr != nil {
+			s.logger.Errorf("failed to close queue e=%s", cerr.Error())
 		}
-	}()
-
-	go func() {
-		wait.Wait()
-		exit <- 0
-	}()
+	}
+	if err != nil {
+		return errors.New("failed to stop queue: " + err.Error())
+	}
+	return ctx.Err()
+}
 
-	return <-exit
+func (s *Server) dispatch(job Job) {
+	if s.validator != nil {
+		errs := s.validator.Validate(job.Payload())
+		if len(errs) > 0 {
+			reason := strings.Join(errs, ", ")
+			s.logger.Errorf("payload failed schema validation. rejecting job errors=%s", reason)
+			RejectJob(job, reason)
+			return
+		}
+	}
+	_ = s.runner.Run(job)
 }
 
 func (s *Server) configure(c map[interface{}]interface{}) error {
@@ -123,6 +171,13 @@ func (s *Server) configure(c map[interface{}]interface{}) error {
 		return errors.New("failed to configure runner: " + err.Error())
 	}
 
+	if config.Schema != nil {
+		s.validator, err = NewSchemaValidator(*config.Schema)
+		if err != nil {
+			return errors.New("failed to configure schema: " + err.Error())
+		}
+	}
+
 	return nil
 }
 
@@ -142,21 +197,12 @@ func (s *Server) configureLogger(config Config) error {
 
 func (s *Server) configureQueue(config map[string]interface{}) error {
 
-	queueType := config["type"]
 	var err error
-	if queueType == nil {
-		return errors.New("queue type required")
-	}
-	queueBuilder := queues[queueType.(string)]
-	if queueBuilder == nil {
-		return errors.New("queue not registered")
-	}
-
-	s.queue, err = queueBuilder.NewQueue(config, s.logger)
+	s.queue, err = NewQueue(config, s.logger)
 	if err != nil {
 		return err
 	}
-	s.logger.Infof("Completed configuring queue=%s", queueType.(string))
+	s.logger.Infof("Completed configuring queue=%s", config["type"])
 
 	return nil
 }
@@ -164,20 +210,11 @@ func (s *Server) configureQueue(config map[string]interface{}) error {
 func (s *Server) configureRunner(config map[string]interface{}) error {
 
 	var err error
-	runnerType := config["type"]
-	if runnerType == nil {
-		return errors.New("runner type required")
-	}
-	runnerBuilder := runners[runnerType.(string)]
-	if runnerBuilder == nil {
-		return errors.New("runner not registered")
-	}
-
-	s.runner, err = runnerBuilder.NewRunner(config, s.logger)
+	s.runner, err = NewRunner(config, s.logger)
 	if err != nil {
 		return err
 	}
 
-	s.logger.Infof("Completed configuring runner=%s", runnerType.(string))
+	s.logger.Infof("Completed configuring runner=%s", config["type"])
 	return nil
 }
@@ -0,0 +1,140 @@
+package reprow
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testQueue struct {
+	payloads []map[string]interface{}
+	stop     chan bool
+	done     chan bool
+}
+
+func (q *testQueue) Start(out chan Job) error {
+	q.stop = make(chan bool)
+	q.done = make(chan bool)
+	go func() {
+		defer close(q.done)
+		for _, p := range q.payloads {
+			select {
+			case out <- &testJob{payload: p}:
+			case <-q.stop:
+				return
+			}
+		}
+		<-q.stop
+	}()
+	return nil
+}
+
+func (q *testQueue) Stop() error {
+	if q.stop == nil {
+		return errors.New("not running")
+	}
+	close(q.stop)
+	<-q.done
+	return nil
+}
+
+type testJob struct {
+	payload map[string]interface{}
+}
+
+func (j *testJob) Payload() map[string]interface{} { return j.payload }
+func (j *testJob) Abort(retryAfter int)            {}
+func (j *testJob) End()                            {}
+func (j *testJob) WaitFinalize() bool              { return true }
+
+type testRunner struct {
+	mu  sync.Mutex
+	ran []Job
+}
+
+func (r *testRunner) MaximumConcurrency() int { return 2 }
+func (r *testRunner) Run(job Job) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ran = append(r.ran, job)
+	job.End()
+	return nil
+}
+
+func (r *testRunner) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.ran)
+}
+
+func TestServerRun(t *testing.T) {
+	queue := &testQueue{payloads: []map[string]interface{}{{"id": 1}, {"id": 2}, {"id": 3}}}
+	runner := &testRunner{}
+	server, err := NewServerFrom(queue, runner)
+	if err != nil {
+		t.Fatalf("failed to make server e=%s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- server.Run(ctx)
+	}()
+
+	deadline := time.After(time.Second)
+	for runner.count() < 3 {
+		select {
+		case <-deadline:
+			t.Fatalf("jobs not run count=%d", runner.count())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("Run should return context.Canceled got=%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server did not stop")
+	}
+}
+
+type closingQueue struct {
+	testQueue
+	closed bool
+}
+
+func (q *closingQueue) Close() error {
+	q.closed = true
+	return nil
+}
+
+func TestServerRunClosesQueue(t *testing.T) {
+	queue := &closingQueue{}
+	server, err := NewServerFrom(queue, &testRunner{})
+	if err != nil {
+		t.Fatalf("failed to make server e=%s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	server.Run(ctx)
+	if !queue.closed {
+		t.Errorf("queue should be closed when server stops")
+	}
+}
+
+func TestNewServerFrom(t *testing.T) {
+	_, err := NewServerFrom(nil, &testRunner{})
+	if err == nil {
+		t.Errorf("nil queue should be error")
+	}
+	_, err = NewServerFrom(&testQueue{}, &testRunner{}, WithSchema(SchemaConfig{}))
+	if err == nil {
+		t.Errorf("invalid option should be error")
+	}
+}
@@ -0,0 +1,47 @@
+package sidekiq
+
+type Job struct {
+	payload map[string]interface{}
+	message string
+	queue   *Sidekiq
+	ready   chan bool
+}
+
+func (j *Job) Queue() *Sidekiq {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns class, jid and queue of the Sidekiq job and how many times it was retried
+func (j *Job) Metadata() map[string]interface{} {
+	retryCount, _ := intField(j.payload, "retry_count")
+	return map[string]interface{}{
+		"Class":      j.payload["class"],
+		"Jid":        j.payload["jid"],
+		"Queue":      queueName(j.payload),
+		"RetryCount": retryCount,
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	j.ready <- j.payload != nil
+}
@@ -0,0 +1,623 @@
+// sidekiq package implements Sidekiq redis layout as reprow.Queue, so that jobs enqueued by Sidekiq clients are processed by reprow runners.
+// Payload of a job is the Sidekiq job such as {"class": "HardWorker", "args": [1], "jid": "...", "queue": "default"},
+// so that http_proxy can route jobs by class.
+//
+// Queues are fetched in Sidekiq's order. Without weights they are fetched strictly in configured order,
+// and with weights like "critical,3" the order is shuffled by weight on every fetch.
+// Each job is moved atomically to per consumer processing list, and jobs left by dead consumers are pushed back in the same way redis package does.
+// A single queue is waited with BRPOPLPUSH, and multiple queues are polled every FetchInterval as BRPOPLPUSH can only wait on one list.
+//
+// Aborted jobs are scheduled in the retry set with Sidekiq's backoff and moved to the dead set when retries are exhausted.
+// Rejected jobs are moved to the dead set immediately. Due jobs in the schedule and retry sets are pushed to their queues.
+package sidekiq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BackoffSidekiq    = "sidekiq"
+	BackoffRetryAfter = "retry_after"
+)
+
+var (
+	FetchInterval = 100 * time.Millisecond
+
+	// fetchScript moves a job from the first non empty queue to processing list
+	fetchScript = redigo.NewScript(-1, `
+for i = 2, #KEYS do
+  local message = redis.call('RPOPLPUSH', KEYS[i], KEYS[1])
+  if message then
+    return {KEYS[i], message}
+  end
+end
+return false`)
+
+	// moveScript moves job from processing list to sorted set only when it is still owned by the consumer
+	moveScript = redigo.NewScript(2, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+  redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+  return 1
+end
+return 0`)
+
+	// killScript moves job from processing list to dead set and trims the dead set like Sidekiq does
+	killScript = redigo.NewScript(2, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+  redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+  redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[4])
+  redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -(tonumber(ARGV[5]) + 1))
+  return 1
+end
+return 0`)
+
+	// requeueScript pushes job from processing list back to its queue only when it is still owned by the consumer
+	requeueScript = redigo.NewScript(3, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+  redis.call('SADD', KEYS[3], ARGV[2])
+  redis.call('RPUSH', KEYS[2], ARGV[1])
+  return 1
+end
+return 0`)
+
+	// enqueueScript pushes job in schedule or retry set to its queue only when no one else has done it
+	enqueueScript = redigo.NewScript(3, `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+  redis.call('SADD', KEYS[3], ARGV[2])
+  redis.call('LPUSH', KEYS[2], ARGV[3])
+  return 1
+end
+return 0`)
+)
+
+func init() {
+	reprow.RegisterQueue("sidekiq", &SidekiqBuilder{})
+}
+
+type SidekiqBuilder struct{}
+
+func (b *SidekiqBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewSidekiq(config, logger)
+}
+
+func NewSidekiq(config map[string]interface{}, logger seelog.LoggerInterface) (*Sidekiq, error) {
+	s := Sidekiq{}
+	err := s.configure(config, logger)
+	return &s, err
+}
+
+// Sidekiq implements Sidekiq redis layout as reprow.Queue
+type Sidekiq struct {
+	Pool          *redigo.Pool
+	logger        seelog.LoggerInterface
+	config        Config
+	queues        []weightedQueue
+	weighted      bool
+	deadTimeout   time.Duration
+	blockTimeout  time.Duration
+	reapAfter     time.Duration
+	pollInterval  time.Duration
+	processingKey string
+	consumersKey  string
+	wantDown      chan bool
+	running       bool
+	wg            sync.WaitGroup
+}
+
+type Config struct {
+	Address      string   `valid:"required"`
+	Password     string   `valid:"-"`
+	Database     int      `valid:"-"`
+	Namespace    string   `valid:"-"`
+	Queues       []string `valid:"-"`
+	Consumer     string   `valid:"-"`
+	Backoff      string   `valid:"-"`
+	MaxRetries   int      `valid:"-" mapstructure:"max_retries"`
+	DeadMaxJobs  int      `valid:"-" mapstructure:"dead_max_jobs"`
+	DeadTimeout  string   `valid:"-" mapstructure:"dead_timeout"`
+	BlockTimeout string   `valid:"-" mapstructure:"block_timeout"`
+	ReapAfter    string   `valid:"-" mapstructure:"reap_after"`
+	PollInterval string   `valid:"-" mapstructure:"poll_interval"`
+}
+
+type weightedQueue struct {
+	name   string
+	weight int
+}
+
+func (s *Sidekiq) Start(outChannel chan reprow.Job) error {
+	if s.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		s.running = true
+		s.wantDown = make(chan bool)
+		s.wg.Add(2)
+		go s.maintain()
+		go s.run(outChannel)
+		return nil
+	}
+}
+
+func (s *Sidekiq) run(outChannel chan reprow.Job) {
+	defer s.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: s,
+		}
+		select {
+		case outChannel <- &job:
+		case <-s.wantDown:
+			return
+		}
+		s.wg.Add(1)
+		go func(job *Job) {
+			defer job.finalize()
+			defer s.wg.Done()
+			s.fetch(job)
+		}(&job)
+	}
+}
+
+func (s *Sidekiq) fetch(job *Job) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	order := s.order()
+	args := redigo.Args{}.Add(len(order) + 1).Add(s.processingKey)
+	for _, name := range order {
+		args = args.Add(s.queueKey(name))
+	}
+	reply, err := redigo.Strings(fetchScript.Do(conn, args...))
+	if err == redigo.ErrNil && len(order) == 1 {
+		var message string
+		message, err = redigo.String(conn.Do("BRPOPLPUSH", s.queueKey(order[0]), s.processingKey, int(s.blockTimeout.Seconds())))
+		reply = []string{s.queueKey(order[0]), message}
+	} else if err == redigo.ErrNil {
+		reply, err = s.poll(conn, args)
+	}
+	if err == redigo.ErrNil {
+		s.logger.Debugf("no queue retrieved")
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: failed to dequeue e=%s", err.Error())
+		time.Sleep(time.Second)
+		return
+	}
+
+	job.message = reply[1]
+	err = decode(job.message, &job.payload)
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: failed to deserialize job. rejecting message=%s err=%s", job.message, err.Error())
+		s.Reject(job, "failed to deserialize")
+		job.payload = nil
+	}
+}
+
+// poll runs fetch script every FetchInterval until a job is fetched or block timeout passes.
+// redigo.ErrNil is returned when no job is fetched.
+func (s *Sidekiq) poll(conn redigo.Conn, args redigo.Args) ([]string, error) {
+	deadline := time.After(s.blockTimeout)
+	for {
+		select {
+		case <-time.After(FetchInterval):
+		case <-deadline:
+			return nil, redigo.ErrNil
+		case <-s.wantDown:
+			return nil, redigo.ErrNil
+		}
+		reply, err := redigo.Strings(fetchScript.Do(conn, args...))
+		if err != redigo.ErrNil {
+			return reply, err
+		}
+	}
+}
+
+// order returns queue names in order to fetch.
+// Like Sidekiq, queues are expanded by their weights, shuffled and deduplicated when weighted.
+func (s *Sidekiq) order() []string {
+	var names []string
+	if !s.weighted {
+		for _, q := range s.queues {
+			names = append(names, q.name)
+		}
+		return names
+	}
+
+	for _, q := range s.queues {
+		for i := 0; i < q.weight; i++ {
+			names = append(names, q.name)
+		}
+	}
+	rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	seen := make(map[string]bool)
+	order := names[:0]
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// maintain records heartbeat, enqueues due jobs and reaps jobs of dead consumers until queue is stopped
+func (s *Sidekiq) maintain() {
+	defer s.wg.Done()
+	for {
+		s.heartbeat()
+		s.enqueueDue(s.key("schedule"))
+		s.enqueueDue(s.key("retry"))
+		s.reap()
+
+		select {
+		case <-s.wantDown:
+			return
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+func (s *Sidekiq) heartbeat() {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("ZADD", s.consumersKey, time.Now().Unix(), s.config.Consumer)
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: failed to record heartbeat e=%s", err.Error())
+	}
+}
+
+// enqueueDue pushes jobs in sorted set whose time has come to their queues in the same way Sidekiq's poller does
+func (s *Sidekiq) enqueueDue(set string) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	now := time.Now()
+	messages, err := redigo.Strings(conn.Do("ZRANGEBYSCORE", set, "-inf", unixTime(now), "LIMIT", 0, 100))
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: failed to find due jobs set=%s e=%s", set, err.Error())
+		return
+	}
+	for _, message := range messages {
+		var payload map[string]interface{}
+		err := decode(message, &payload)
+		if err != nil {
+			s.logger.Errorf("reprow/sidekiq: failed to deserialize due job. leaving message=%s err=%s", message, err.Error())
+			continue
+		}
+		name := queueName(payload)
+		payload["enqueued_at"] = unixTime(now)
+		b, err := json.Marshal(payload)
+		if err != nil {
+			s.logger.Errorf("reprow/sidekiq: failed to serialize due job e=%s", err.Error())
+			continue
+		}
+		_, err = enqueueScript.Do(conn, set, s.queueKey(name), s.key("queues"), message, name, b)
+		if err != nil {
+			s.logger.Errorf("reprow/sidekiq: failed to enqueue due job e=%s", err.Error())
+		}
+	}
+}
+
+func (s *Sidekiq) reap() {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	deadline := time.Now().Add(-s.reapAfter).Unix()
+	consumers, err := redigo.Strings(conn.Do("ZRANGEBYSCORE", s.consumersKey, "-inf", deadline))
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: failed to find dead consumers e=%s", err.Error())
+		return
+	}
+	for _, consumer := range consumers {
+		if consumer == s.config.Consumer {
+			continue
+		}
+		err := s.recover(conn, consumer)
+		if err != nil {
+			s.logger.Errorf("reprow/sidekiq: failed to reap jobs consumer=%s e=%s", consumer, err.Error())
+		}
+	}
+}
+
+// recover pushes jobs in processing list of consumer back to their queues
+func (s *Sidekiq) recover(conn redigo.Conn, consumer string) error {
+	key := s.processingKeyOf(consumer)
+	messages, err := redigo.Strings(conn.Do("LRANGE", key, 0, -1))
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		var payload map[string]interface{}
+		// Jobs failed to deserialize are never left in processing list
+		decode(message, &payload)
+		name := queueName(payload)
+		_, err = requeueScript.Do(conn, key, s.queueKey(name), s.key("queues"), message, name)
+		if err != nil {
+			return err
+		}
+	}
+	if len(messages) > 0 {
+		s.logger.Infof("reprow/sidekiq: recovered jobs consumer=%s count=%d", consumer, len(messages))
+	}
+	_, err = conn.Do("ZREM", s.consumersKey, consumer)
+	return err
+}
+
+func (s *Sidekiq) Stop() error {
+	s.logger.Infof("stopping queue")
+	if s.running == false {
+		return errors.New("not running")
+	} else {
+		close(s.wantDown)
+		s.wg.Wait()
+		s.running = false
+		return nil
+	}
+}
+
+// Abort schedules job in the retry set like Sidekiq's retry does, or moves it to the dead set when retries are exhausted.
+// Delay is Sidekiq's backoff unless backoff is retry_after.
+func (s *Sidekiq) Abort(job *Job, retryAfter int) {
+	payload := copyPayload(job.payload)
+	now := time.Now()
+	count := 0
+	if c, ok := intField(payload, "retry_count"); ok {
+		count = c + 1
+		payload["retried_at"] = unixTime(now)
+	} else {
+		payload["failed_at"] = unixTime(now)
+	}
+	payload["retry_count"] = count
+	payload["error_class"] = "Reprow::Aborted"
+	payload["error_message"] = "aborted by runner"
+
+	max := s.maxRetries(payload)
+	if count >= max {
+		s.logger.Infof("reprow/sidekiq: retries exhausted jid=%v retry_count=%d", payload["jid"], count)
+		s.kill(job, payload, now)
+		return
+	}
+
+	delay := time.Duration(retryAfter) * time.Second
+	if s.config.Backoff == BackoffSidekiq {
+		delay = backoff(count)
+	}
+	s.move(job, s.key("retry"), payload, now.Add(delay))
+}
+
+func (s *Sidekiq) End(job *Job) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("LREM", s.processingKey, 1, job.message)
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: end failed e=%s", err.Error())
+	}
+}
+
+func (s *Sidekiq) Reject(job *Job, reason string) {
+	s.logger.Errorf("reprow/sidekiq: job rejected reason=%s message=%s", reason, job.message)
+	payload := copyPayload(job.payload)
+	if payload == nil {
+		// not a Sidekiq job. kept as is so that it can be inspected in the dead set
+		payload = map[string]interface{}{"class": "", "args": []interface{}{job.message}}
+	}
+	payload["error_class"] = "Reprow::Rejected"
+	payload["error_message"] = reason
+	if _, ok := payload["failed_at"]; !ok {
+		payload["failed_at"] = unixTime(time.Now())
+	}
+	s.kill(job, payload, time.Now())
+}
+
+// kill moves job to the dead set unless the job disables it
+func (s *Sidekiq) kill(job *Job, payload map[string]interface{}, now time.Time) {
+	if payload["dead"] == false || payload["retry"] == false {
+		s.logger.Infof("reprow/sidekiq: job discarded jid=%v", payload["jid"])
+		s.End(job)
+		return
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: failed to serialize job e=%s", err.Error())
+		return
+	}
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err = killScript.Do(conn, s.processingKey, s.key("dead"), job.message, unixTime(now), b,
+		unixTime(now.Add(-s.deadTimeout)), s.config.DeadMaxJobs)
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: failed to move job to dead set e=%s", err.Error())
+	}
+}
+
+func (s *Sidekiq) move(job *Job, set string, payload map[string]interface{}, at time.Time) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: failed to serialize job e=%s", err.Error())
+		return
+	}
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err = moveScript.Do(conn, s.processingKey, set, job.message, unixTime(at), b)
+	if err != nil {
+		s.logger.Errorf("reprow/sidekiq: abort failed e=%s", err.Error())
+	}
+}
+
+// maxRetries returns number of retries of job. retry of the job is either boolean or number
+func (s *Sidekiq) maxRetries(payload map[string]interface{}) int {
+	if payload["retry"] == false {
+		return 0
+	}
+	if n, ok := intField(payload, "retry"); ok {
+		return n
+	}
+	return s.config.MaxRetries
+}
+
+// backoff returns Sidekiq's default delay before count th retry
+func backoff(count int) time.Duration {
+	seconds := count*count*count*count + 15 + rand.Intn(10)*(count+1)
+	return time.Duration(seconds) * time.Second
+}
+
+func (s *Sidekiq) key(name string) string {
+	return s.config.Namespace + name
+}
+
+func (s *Sidekiq) queueKey(name string) string {
+	return s.key("queue:" + name)
+}
+
+func (s *Sidekiq) processingKeyOf(consumer string) string {
+	return s.key("reprow:processing:" + consumer)
+}
+
+func (s *Sidekiq) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	s.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+	if len(config.Queues) == 0 {
+		return errors.New("queues is required")
+	}
+	for _, q := range config.Queues {
+		// same format as -q option of Sidekiq
+		parts := strings.SplitN(q, ",", 2)
+		weight := 1
+		if len(parts) == 2 {
+			s.weighted = true
+			weight, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil || weight <= 0 {
+				return errors.New("weight of queue should be positive integer queue=" + q)
+			}
+		}
+		s.queues = append(s.queues, weightedQueue{name: strings.TrimSpace(parts[0]), weight: weight})
+	}
+
+	if config.Namespace != "" && !strings.HasSuffix(config.Namespace, ":") {
+		config.Namespace += ":"
+	}
+	if config.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		config.Consumer = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if config.Backoff == "" {
+		config.Backoff = BackoffSidekiq
+	}
+	if config.Backoff != BackoffSidekiq && config.Backoff != BackoffRetryAfter {
+		return fmt.Errorf("backoff should be %s or %s", BackoffSidekiq, BackoffRetryAfter)
+	}
+	if _, ok := c["max_retries"]; !ok {
+		config.MaxRetries = 25
+	}
+	if config.DeadMaxJobs <= 0 {
+		config.DeadMaxJobs = 10000
+	}
+
+	s.deadTimeout, err = reprow.ParseDuration(config.DeadTimeout, "4320h")
+	if err != nil {
+		return errors.New("dead_timeout failed to parse: " + err.Error())
+	}
+	s.blockTimeout, err = reprow.ParseDuration(config.BlockTimeout, "1s")
+	if err != nil {
+		return errors.New("block_timeout failed to parse: " + err.Error())
+	}
+	if s.blockTimeout < time.Second {
+		return errors.New("block_timeout should be at least 1s")
+	}
+	s.reapAfter, err = reprow.ParseDuration(config.ReapAfter, "5m")
+	if err != nil {
+		return errors.New("reap_after failed to parse: " + err.Error())
+	}
+	s.pollInterval, err = reprow.ParseDuration(config.PollInterval, "1s")
+	if err != nil {
+		return errors.New("poll_interval failed to parse: " + err.Error())
+	}
+
+	s.config = config
+	s.processingKey = s.processingKeyOf(config.Consumer)
+	s.consumersKey = s.key("reprow:consumers")
+
+	s.Pool = &redigo.Pool{
+		MaxIdle:     10,
+		IdleTimeout: time.Minute,
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", config.Address,
+				redigo.DialPassword(config.Password),
+				redigo.DialDatabase(config.Database))
+		},
+	}
+
+	// Jobs left by previous process with the same consumer name are pushed back
+	conn := s.Pool.Get()
+	defer conn.Close()
+	return s.recover(conn, config.Consumer)
+}
+
+// decode decodes Sidekiq job keeping numbers as json.Number, so that args are not changed when job is written back
+func decode(message string, payload *map[string]interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(message)))
+	decoder.UseNumber()
+	return decoder.Decode(payload)
+}
+
+func copyPayload(payload map[string]interface{}) map[string]interface{} {
+	if payload == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(payload))
+	for key, value := range payload {
+		copied[key] = value
+	}
+	return copied
+}
+
+func intField(payload map[string]interface{}, field string) (int, bool) {
+	switch v := payload[field].(type) {
+	case json.Number:
+		n, err := v.Int64()
+		return int(n), err == nil
+	case int:
+		return v, true
+	}
+	return 0, false
+}
+
+func queueName(payload map[string]interface{}) string {
+	if name, ok := payload["queue"].(string); ok && name != "" {
+		return name
+	}
+	return "default"
+}
+
+// unixTime returns time as float seconds in the same way Sidekiq stores timestamps
+func unixTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
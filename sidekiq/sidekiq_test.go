@@ -0,0 +1,254 @@
+package sidekiq
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func newTestSidekiq(t *testing.T, server *miniredis.Miniredis, config map[string]interface{}) *Sidekiq {
+	c := map[string]interface{}{
+		"address":       server.Addr(),
+		"namespace":     "test",
+		"queues":        []string{"critical", "default"},
+		"consumer":      "test",
+		"poll_interval": "100ms",
+		"reap_after":    "1s",
+	}
+	for key, value := range config {
+		c[key] = value
+	}
+	queue, err := NewSidekiq(c, logger)
+	if err != nil {
+		t.Fatalf("failed to make sidekiq queue e=%s", err.Error())
+	}
+	return queue
+}
+
+var jid int
+
+// mustPush pushes job in the same way Sidekiq client does
+func mustPush(t *testing.T, server *miniredis.Miniredis, queue string, job map[string]interface{}) {
+	jid++
+	job["jid"] = strconv.Itoa(jid)
+	job["queue"] = queue
+	job["enqueued_at"] = float64(time.Now().UnixNano()) / float64(time.Second)
+	if _, ok := job["retry"]; !ok {
+		job["retry"] = true
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	server.SAdd("test:queues", queue)
+	_, err = server.Lpush("test:queue:"+queue, string(b))
+	if err != nil {
+		t.Fatalf("failed to push e=%s", err.Error())
+	}
+}
+
+func sortedSet(t *testing.T, server *miniredis.Miniredis, key string) []map[string]interface{} {
+	members, _ := server.ZMembers(key)
+	var jobs []map[string]interface{}
+	for _, member := range members {
+		var job map[string]interface{}
+		if err := json.Unmarshal([]byte(member), &job); err != nil {
+			t.Fatalf("failed to unmarshal e=%s", err.Error())
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func TestConformance(t *testing.T) {
+	var server *miniredis.Miniredis
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			if server != nil {
+				server.Close()
+			}
+			server = miniredis.RunT(t)
+			return newTestSidekiq(t, server, map[string]interface{}{"backoff": "retry_after"})
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustPush(t, server, "default", map[string]interface{}{"class": "TestWorker", "args": []interface{}{payload}})
+		},
+		Payload: func(job reprow.Job) map[string]interface{} {
+			return job.Payload()["args"].([]interface{})[0].(map[string]interface{})
+		},
+	}.Run(t)
+}
+
+func TestQueueOrder(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestSidekiq(t, server, nil)
+	stream := make(chan reprow.Job)
+
+	mustPush(t, server, "default", map[string]interface{}{"class": "DefaultWorker", "args": []interface{}{}})
+	mustPush(t, server, "critical", map[string]interface{}{"class": "CriticalWorker", "args": []interface{}{}})
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	metadata := reprow.JobMetadata(job)
+	if metadata["Class"] != "CriticalWorker" || metadata["Queue"] != "critical" {
+		t.Errorf("queues should be fetched in order without weights got=%v", metadata)
+	}
+	job.End()
+	mustReceive(t, stream).End()
+
+	weighted := newTestSidekiq(t, server, map[string]interface{}{"queues": []string{"critical,3", "default,1"}})
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		first[weighted.order()[0]]++
+	}
+	if first["critical"] < 650 || first["critical"] > 850 {
+		t.Errorf("queues should be ordered by weight got=%v", first)
+	}
+}
+
+func TestFetchLaterQueue(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestSidekiq(t, server, map[string]interface{}{"block_timeout": "5s"})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	// job is pushed to a queue other than the first one while waiting
+	time.Sleep(200 * time.Millisecond)
+	pushed := time.Now()
+	mustPush(t, server, "default", map[string]interface{}{"class": "DefaultWorker", "args": []interface{}{}})
+	job := mustReceive(t, stream)
+	if time.Since(pushed) > time.Second {
+		t.Errorf("job in later queue should not wait for block_timeout took=%s", time.Since(pushed))
+	}
+	job.End()
+}
+
+func TestRetry(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestSidekiq(t, server, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPush(t, server, "default", map[string]interface{}{"class": "TestWorker", "args": []interface{}{12345678901234567}, "retry": 1})
+	started := time.Now()
+	mustReceive(t, stream).Abort(5)
+
+	retries := sortedSet(t, server, "test:retry")
+	if len(retries) != 1 || retries[0]["retry_count"] != float64(0) || retries[0]["error_class"] != "Reprow::Aborted" {
+		t.Fatalf("aborted job should be in retry set got=%v", retries)
+	}
+	member, _ := server.ZMembers("test:retry")
+	score, _ := server.ZScore("test:retry", member[0])
+	if delay := score - float64(started.Unix()); delay < 15 || delay > 26 {
+		t.Errorf("retry should be delayed with sidekiq backoff got=%f", delay)
+	}
+
+	// retry time comes
+	server.ZAdd("test:retry", 0, member[0])
+	job := mustReceive(t, stream)
+	if args, _ := json.Marshal(job.Payload()["args"]); string(args) != "[12345678901234567]" {
+		t.Errorf("args should be kept as is got=%s", args)
+	}
+	if reprow.JobMetadata(job)["RetryCount"] != 0 {
+		t.Errorf("retry count should be in metadata got=%v", reprow.JobMetadata(job))
+	}
+
+	// retries exhausted
+	job.Abort(5)
+	dead := sortedSet(t, server, "test:dead")
+	if len(dead) != 1 || dead[0]["retry_count"] != float64(1) {
+		t.Errorf("job should be dead when retries are exhausted got=%v", dead)
+	}
+	if retries := sortedSet(t, server, "test:retry"); len(retries) != 0 {
+		t.Errorf("dead job should not be retried got=%v", retries)
+	}
+}
+
+func TestReject(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestSidekiq(t, server, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPush(t, server, "default", map[string]interface{}{"class": "TestWorker", "args": []interface{}{}})
+	mustReceive(t, stream).(reprow.Rejecter).Reject("invalid")
+	dead := sortedSet(t, server, "test:dead")
+	if len(dead) != 1 || dead[0]["error_message"] != "invalid" {
+		t.Errorf("rejected job should be dead got=%v", dead)
+	}
+
+	mustPush(t, server, "default", map[string]interface{}{"class": "TestWorker", "args": []interface{}{}, "retry": false})
+	mustReceive(t, stream).(reprow.Rejecter).Reject("invalid")
+	if dead := sortedSet(t, server, "test:dead"); len(dead) != 1 {
+		t.Errorf("job without retry should be discarded got=%v", dead)
+	}
+	if processing, _ := server.List("test:reprow:processing:test"); len(processing) != 0 {
+		t.Errorf("job should be removed from processing list got=%v", processing)
+	}
+}
+
+func TestScheduled(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestSidekiq(t, server, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	b, _ := json.Marshal(map[string]interface{}{"class": "ScheduledWorker", "args": []interface{}{}, "jid": "scheduled", "queue": "critical"})
+	server.ZAdd("test:schedule", float64(time.Now().Add(time.Second).Unix()), string(b))
+
+	job := mustReceive(t, stream)
+	if job.Payload()["jid"] != "scheduled" || job.Payload()["enqueued_at"] == nil {
+		t.Errorf("scheduled job should be enqueued got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func TestRecover(t *testing.T) {
+	server := miniredis.RunT(t)
+	queue := newTestSidekiq(t, server, map[string]interface{}{"consumer": "dead"})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+
+	mustPush(t, server, "critical", map[string]interface{}{"class": "TestWorker", "args": []interface{}{}})
+	mustReceive(t, stream)
+	queue.Stop()
+
+	// heartbeat of dead consumer stops
+	queue = newTestSidekiq(t, server, nil)
+	stream = make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	if reprow.JobMetadata(job)["Queue"] != "critical" {
+		t.Errorf("job of dead consumer should be pushed back to its queue got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
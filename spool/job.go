@@ -0,0 +1,46 @@
+package spool
+
+import (
+	"time"
+)
+
+type Job struct {
+	payload   map[string]interface{}
+	name      string
+	base      string
+	notBefore time.Time
+	attempts  int
+	queue     *Spool
+}
+
+func (j *Job) Queue() *Spool {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns name of the file without suffix added on abort and how many times it was aborted
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Name":     j.base,
+		"Attempts": j.attempts,
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return true
+}
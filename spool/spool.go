@@ -0,0 +1,312 @@
+// spool package implements directory of files as reprow.Queue in the same layout as maildir.
+// Producers should write a json encoded payload to a file in tmp/ and rename it into new/, so that half written files are never read.
+// Any tool that can write a file can produce jobs, and jobs survive restarts unlike fifo package.
+//
+// Files in new/ are claimed in order of not before time and name by renaming them into cur/. Ended files are deleted, or moved to archive_dir when it is given.
+// Names in new/ are kept in memory and read again only when none of them is due, so that claiming does not list the directory every time.
+// Aborted files are moved back to new/ with not before time and number of attempts appended to their names like "job.json,nb=1700000000,attempts=1".
+// Rejected files are moved to dead/. Files left in cur/ are moved back to new/ on startup,
+// so a directory should be consumed by a single reprow process.
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// suffixPattern matches suffix appended to name of aborted files
+	suffixPattern = regexp.MustCompile(`,nb=(\d+),attempts=(\d+)$`)
+)
+
+func init() {
+	reprow.RegisterQueue("spool", &SpoolBuilder{})
+}
+
+type SpoolBuilder struct{}
+
+func (b *SpoolBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewSpool(config, logger)
+}
+
+func NewSpool(config map[string]interface{}, logger seelog.LoggerInterface) (*Spool, error) {
+	s := Spool{}
+	err := s.configure(config, logger)
+	return &s, err
+}
+
+// Spool implements directory of files as reprow.Queue
+type Spool struct {
+	logger       seelog.LoggerInterface
+	config       Config
+	pollInterval time.Duration
+	seq          uint64
+	index        []*Job // files in new/ sorted by not before time and name, only used by run loop
+	wantDown     chan bool
+	done         chan bool
+}
+
+type Config struct {
+	Dir          string `valid:"required"`
+	ArchiveDir   string `valid:"-" mapstructure:"archive_dir"`
+	PollInterval string `valid:"-" mapstructure:"poll_interval"`
+}
+
+// Push writes payload to a new file in the same way producers should
+func (s *Spool) Push(payload map[string]interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%d-%d.json", time.Now().UnixNano(), os.Getpid(), atomic.AddUint64(&s.seq, 1))
+	tmp := filepath.Join(s.config.Dir, "tmp", name)
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.config.Dir, "new", name))
+}
+
+func (s *Spool) Start(outChannel chan reprow.Job) error {
+	if s.done != nil {
+		return errors.New("Start called twice")
+	} else {
+		s.wantDown = make(chan bool)
+		s.done = make(chan bool)
+		go func() {
+			s.run(outChannel)
+			close(s.done)
+		}()
+		return nil
+	}
+}
+
+func (s *Spool) run(outChannel chan reprow.Job) {
+	for {
+		job, err := s.claim(time.Now())
+		if err != nil {
+			s.logger.Errorf("reprow/spool: failed to claim e=%s", err.Error())
+		}
+		if job == nil {
+			select {
+			case <-time.After(s.pollInterval):
+			case <-s.wantDown:
+				return
+			}
+			continue
+		}
+
+		select {
+		case outChannel <- job:
+		case <-s.wantDown:
+			// claimed file is given back as it is not passed to runner
+			s.move(job, "new", job.name)
+			return
+		}
+	}
+}
+
+// claim renames the first ready file in new/ into cur/ and returns its job. nil is returned when there is no ready file
+func (s *Spool) claim(now time.Time) (*Job, error) {
+	for {
+		job, err := s.next(now)
+		if job == nil || err != nil {
+			return nil, err
+		}
+
+		b, err := os.ReadFile(filepath.Join(s.dir("cur"), job.name))
+		if err == nil {
+			err = json.Unmarshal(b, &job.payload)
+		}
+		if err != nil {
+			s.logger.Errorf("reprow/spool: failed to deserialize job. rejecting name=%s err=%s", job.name, err.Error())
+			s.Reject(job, "failed to deserialize")
+			continue
+		}
+		return job, nil
+	}
+}
+
+// next renames the first due file in index into cur/. Index is refreshed when it has no due file
+func (s *Spool) next(now time.Time) (*Job, error) {
+	refreshed := false
+	for {
+		// index is sorted by not before time, so no file is due once the first one is not
+		if len(s.index) == 0 || s.index[0].notBefore.After(now) {
+			if refreshed {
+				return nil, nil
+			}
+			err := s.refresh()
+			if err != nil {
+				return nil, err
+			}
+			refreshed = true
+			continue
+		}
+		job := s.index[0]
+		s.index = s.index[1:]
+
+		err := os.Rename(filepath.Join(s.dir("new"), job.name), filepath.Join(s.dir("cur"), job.name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+}
+
+// refresh reads files in new/ into index
+func (s *Spool) refresh() error {
+	entries, err := os.ReadDir(s.dir("new"))
+	if err != nil {
+		return err
+	}
+	index := make([]*Job, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		index = append(index, s.parseName(entry.Name()))
+	}
+	// ReadDir returns entries sorted by name, which is kept among files with the same not before time
+	sort.SliceStable(index, func(i, j int) bool {
+		return index[i].notBefore.Before(index[j].notBefore)
+	})
+	s.index = index
+	return nil
+}
+
+// parseName returns job of the file with not before time and attempts in its name
+func (s *Spool) parseName(name string) *Job {
+	job := &Job{name: name, base: name, queue: s}
+	if m := suffixPattern.FindStringSubmatch(name); m != nil {
+		job.base = name[:len(name)-len(m[0])]
+		notBefore, _ := strconv.ParseInt(m[1], 10, 64)
+		job.notBefore = time.Unix(notBefore, 0)
+		job.attempts, _ = strconv.Atoi(m[2])
+	}
+	return job
+}
+
+func (s *Spool) Stop() error {
+	if s.done == nil {
+		return errors.New("not running")
+	} else {
+		close(s.wantDown)
+		<-s.done
+		s.done = nil
+		return nil
+	}
+}
+
+func (s *Spool) Abort(job *Job, retryAfter int) {
+	at := time.Now().Add(time.Duration(retryAfter) * time.Second)
+	// rounded up so that the job is never claimed before retry after
+	notBefore := at.Unix()
+	if at.Nanosecond() > 0 {
+		notBefore++
+	}
+	s.move(job, "new", fmt.Sprintf("%s,nb=%d,attempts=%d", job.base, notBefore, job.attempts+1))
+}
+
+func (s *Spool) End(job *Job) {
+	if s.config.ArchiveDir != "" {
+		err := os.Rename(filepath.Join(s.dir("cur"), job.name), filepath.Join(s.config.ArchiveDir, job.base))
+		if err != nil {
+			s.logger.Errorf("reprow/spool: failed to archive name=%s e=%s", job.name, err.Error())
+		}
+		return
+	}
+	err := os.Remove(filepath.Join(s.dir("cur"), job.name))
+	if err != nil {
+		s.logger.Errorf("reprow/spool: end failed name=%s e=%s", job.name, err.Error())
+	}
+}
+
+func (s *Spool) Reject(job *Job, reason string) {
+	s.logger.Errorf("reprow/spool: job rejected name=%s reason=%s", job.name, reason)
+	s.move(job, "dead", job.base)
+}
+
+// move renames file of job in cur/ into sub directory
+func (s *Spool) move(job *Job, sub string, name string) {
+	err := os.Rename(filepath.Join(s.dir("cur"), job.name), filepath.Join(s.dir(sub), name))
+	if err != nil {
+		s.logger.Errorf("reprow/spool: failed to move name=%s to=%s e=%s", job.name, sub, err.Error())
+	}
+}
+
+// recover moves files left in cur/ by previous process back to new/
+func (s *Spool) recover() error {
+	entries, err := os.ReadDir(s.dir("cur"))
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	for _, name := range names {
+		err := os.Rename(filepath.Join(s.dir("cur"), name), filepath.Join(s.dir("new"), name))
+		if err != nil {
+			return err
+		}
+	}
+	if len(names) > 0 {
+		s.logger.Infof("recovered files count=%d", len(names))
+	}
+	return nil
+}
+
+func (s *Spool) dir(sub string) string {
+	return filepath.Join(s.config.Dir, sub)
+}
+
+func (s *Spool) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	s.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+	s.pollInterval, err = reprow.ParseDuration(config.PollInterval, "1s")
+	if err != nil {
+		return errors.New("poll_interval failed to parse: " + err.Error())
+	}
+	s.config = config
+
+	for _, sub := range []string{"tmp", "new", "cur", "dead"} {
+		err = os.MkdirAll(s.dir(sub), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if config.ArchiveDir != "" {
+		err = os.MkdirAll(config.ArchiveDir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return s.recover()
+}
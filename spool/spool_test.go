@@ -0,0 +1,185 @@
+package spool
+
+import (
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func newTestSpool(t *testing.T, dir string, config map[string]interface{}) *Spool {
+	c := map[string]interface{}{
+		"dir":           dir,
+		"poll_interval": "100ms",
+	}
+	for key, value := range config {
+		c[key] = value
+	}
+	queue, err := NewSpool(c, logger)
+	if err != nil {
+		t.Fatalf("failed to make spool queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func mustPush(t *testing.T, queue *Spool, payload map[string]interface{}) {
+	err := queue.Push(payload)
+	if err != nil {
+		t.Fatalf("failed to push e=%s", err.Error())
+	}
+}
+
+func files(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir e=%s", err.Error())
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestConformance(t *testing.T) {
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			return newTestSpool(t, t.TempDir(), nil)
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			mustPush(t, queue.(*Spool), payload)
+		},
+	}.Run(t)
+}
+
+func TestRetryAfter(t *testing.T) {
+	dir := t.TempDir()
+	queue := newTestSpool(t, dir, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPush(t, queue, map[string]interface{}{"id": "delayed"})
+	started := time.Now()
+	job := mustReceive(t, stream)
+	name := reprow.JobMetadata(job)["Name"]
+	job.Abort(1)
+
+	job = mustReceive(t, stream)
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	metadata := reprow.JobMetadata(job)
+	if metadata["Name"] != name || metadata["Attempts"] != 1 {
+		t.Errorf("attempts should be kept in name got=%v", metadata)
+	}
+	job.(reprow.Rejecter).Reject("invalid")
+
+	if dead := files(t, filepath.Join(dir, "dead")); len(dead) != 1 || dead[0] != name {
+		t.Errorf("rejected file should be moved to dead got=%v", dead)
+	}
+}
+
+func TestClaimIndex(t *testing.T) {
+	dir := t.TempDir()
+	queue := newTestSpool(t, dir, nil)
+	mustPush(t, queue, map[string]interface{}{"id": 1})
+	mustPush(t, queue, map[string]interface{}{"id": 2})
+	// not yet due file sorts first by name but is claimed last
+	err := os.WriteFile(filepath.Join(dir, "new", "0.json,nb=9999999999,attempts=1"), []byte(`{"id": 0}`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write e=%s", err.Error())
+	}
+
+	now := time.Now()
+	job, err := queue.claim(now)
+	if err != nil || job == nil || job.Payload()["id"] != float64(1) {
+		t.Fatalf("first file should be claimed got=%v e=%v", job, err)
+	}
+	if len(queue.index) != 2 {
+		t.Errorf("remaining files should be kept in index got=%d", len(queue.index))
+	}
+
+	// file pushed meanwhile is read once indexed files are claimed
+	mustPush(t, queue, map[string]interface{}{"id": 3})
+	for _, id := range []float64{2, 3} {
+		job, err = queue.claim(now)
+		if err != nil || job == nil || job.Payload()["id"] != id {
+			t.Fatalf("files should be claimed in order expect=%v got=%v e=%v", id, job, err)
+		}
+	}
+	job, err = queue.claim(now)
+	if err != nil || job != nil {
+		t.Errorf("file not yet due should not be claimed got=%v e=%v", job, err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "done")
+	queue := newTestSpool(t, dir, map[string]interface{}{"archive_dir": archive})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	mustPush(t, queue, map[string]interface{}{"id": "archived"})
+	mustReceive(t, stream).End()
+	if archived := files(t, archive); len(archived) != 1 {
+		t.Errorf("ended file should be archived got=%v", archived)
+	}
+	if cur := files(t, filepath.Join(dir, "cur")); len(cur) != 0 {
+		t.Errorf("ended file should be removed from cur got=%v", cur)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	queue := newTestSpool(t, dir, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	mustPush(t, queue, map[string]interface{}{"id": "crashed"})
+	mustReceive(t, stream)
+	// process crashes while the job is running
+	queue.Stop()
+
+	queue = newTestSpool(t, dir, nil)
+	stream = make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "crashed" {
+		t.Errorf("file left in cur should be recovered got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func TestInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	queue := newTestSpool(t, dir, nil)
+	err := os.WriteFile(filepath.Join(dir, "new", "invalid.json"), []byte("{"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write e=%s", err.Error())
+	}
+	job, err := queue.claim(time.Now())
+	if job != nil || err != nil {
+		t.Errorf("invalid file should not be claimed got=%v,%v", job, err)
+	}
+	if dead := files(t, filepath.Join(dir, "dead")); len(dead) != 1 {
+		t.Errorf("invalid file should be moved to dead got=%v", dead)
+	}
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	select {
+	case job := <-stream:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout reading stream")
+	}
+	return nil
+}
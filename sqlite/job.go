@@ -0,0 +1,45 @@
+package sqlite
+
+type Job struct {
+	payload  map[string]interface{}
+	id       int64
+	attempts int
+	queue    *SQLite
+	ready    chan bool
+}
+
+func (j *Job) Queue() *SQLite {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns id of the job and how many times the job was claimed including this time
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"Id":       j.id,
+		"Attempts": j.attempts,
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return <-j.ready
+}
+
+func (j *Job) finalize() {
+	j.ready <- j.payload != nil
+}
@@ -0,0 +1,237 @@
+// sqlite package implements durable local queue backed by a sqlite file as reprow.Queue.
+// It is targeted for development and small single host deployments, where fifo loses jobs on restart.
+//
+// The table is created when it does not exist. Producers can INSERT json encoded payloads to it, or call Push.
+//
+//	sqlite3 /tmp/reprow.db "INSERT INTO queue (payload) VALUES ('{\"id\":1}')"
+//
+// Jobs are claimed by marking claimed_at, deleted when they end, and released with run_at moved by retry after when they are aborted.
+// Rejected jobs, and jobs whose payload fails to deserialize, are kept with run_at set to the maximum integer,
+// so they are never claimed again and can be inspected later.
+// Jobs claimed by a process that exited before finishing them are released when the queue is made again.
+// Thus only one process should consume a file at a time.
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mitchellh/mapstructure"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	reprow.RegisterQueue("sqlite", &SQLiteBuilder{})
+}
+
+type SQLiteBuilder struct{}
+
+func (b *SQLiteBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewSQLite(config, logger)
+}
+
+func NewSQLite(config map[string]interface{}, logger seelog.LoggerInterface) (*SQLite, error) {
+	s := SQLite{}
+	err := s.configure(config, logger)
+	return &s, err
+}
+
+// SQLite implements sqlite table as reprow.Queue
+type SQLite struct {
+	DB           *sql.DB
+	logger       seelog.LoggerInterface
+	config       Config
+	pollInterval time.Duration
+	table        string
+	wantDown     chan bool
+	running      bool
+	wg           sync.WaitGroup
+}
+
+type Config struct {
+	Path         string `valid:"required"`
+	Table        string `valid:"-"`
+	PollInterval string `valid:"-" mapstructure:"poll_interval"`
+}
+
+// Push adds payload to the queue
+func (s *SQLite) Push(payload map[string]interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(fmt.Sprintf("INSERT INTO %s (payload) VALUES (?)", s.table), string(b))
+	return err
+}
+
+func (s *SQLite) Start(outChannel chan reprow.Job) error {
+	if s.running == true {
+		return errors.New("Dequeue already called")
+	} else {
+		s.running = true
+		s.wantDown = make(chan bool)
+		s.wg.Add(1)
+		go s.run(outChannel)
+		return nil
+	}
+}
+
+func (s *SQLite) run(outChannel chan reprow.Job) {
+	defer s.wg.Done()
+
+	for {
+		job := Job{
+			ready: make(chan bool),
+			queue: s,
+		}
+		select {
+		case outChannel <- &job:
+		case <-s.wantDown:
+			return
+		}
+		s.wg.Add(1)
+		go func(job *Job) {
+			defer job.finalize()
+			defer s.wg.Done()
+
+			found, err := s.claim(job)
+			if err != nil {
+				s.logger.Errorf("reprow/sqlite: failed to claim job e=%s", err.Error())
+				time.Sleep(time.Second)
+				return
+			}
+			if !found {
+				s.logger.Debugf("no queue retrieved")
+				select {
+				case <-s.wantDown:
+				case <-time.After(s.pollInterval):
+				}
+			}
+		}(&job)
+	}
+}
+
+// claim marks a job whose run_at has come as claimed. false is returned when no job is available
+func (s *SQLite) claim(job *Job) (bool, error) {
+	now := time.Now().Unix()
+	var payload string
+	err := s.DB.QueryRow(fmt.Sprintf(`UPDATE %s SET claimed_at = ?, attempts = attempts + 1
+WHERE id = (SELECT id FROM %s WHERE claimed_at IS NULL AND run_at <= ? ORDER BY run_at, id LIMIT 1)
+RETURNING id, payload, attempts`, s.table, s.table), now, now).Scan(&job.id, &payload, &job.attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = json.Unmarshal([]byte(payload), &job.payload)
+	if err != nil {
+		s.Reject(job, "failed to deserialize payload: "+err.Error())
+		job.payload = nil
+	}
+	return true, nil
+}
+
+func (s *SQLite) Stop() error {
+	s.logger.Infof("stopping queue")
+	if s.running == false {
+		return errors.New("not running")
+	} else {
+		close(s.wantDown)
+		s.wg.Wait()
+		s.running = false
+		return nil
+	}
+}
+
+func (s *SQLite) Abort(job *Job, retryAfter int) {
+	runAt := time.Now().Add(time.Duration(retryAfter) * time.Second).Unix()
+	_, err := s.DB.Exec(fmt.Sprintf("UPDATE %s SET claimed_at = NULL, run_at = ? WHERE id = ?", s.table), runAt, job.id)
+	if err != nil {
+		s.logger.Errorf("reprow/sqlite: abort failed id=%d e=%s", job.id, err.Error())
+	}
+}
+
+func (s *SQLite) End(job *Job) {
+	_, err := s.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table), job.id)
+	if err != nil {
+		s.logger.Errorf("reprow/sqlite: end failed id=%d e=%s", job.id, err.Error())
+	}
+}
+
+// Reject releases job with run_at set to the maximum integer so that it is never claimed again
+func (s *SQLite) Reject(job *Job, reason string) {
+	s.logger.Errorf("reprow/sqlite: job rejected id=%d reason=%s", job.id, reason)
+	_, err := s.DB.Exec(fmt.Sprintf("UPDATE %s SET claimed_at = NULL, run_at = ? WHERE id = ?", s.table), int64(math.MaxInt64), job.id)
+	if err != nil {
+		s.logger.Errorf("reprow/sqlite: reject failed id=%d e=%s", job.id, err.Error())
+	}
+}
+
+// recover releases jobs left claimed by previous process
+func (s *SQLite) recover() error {
+	res, err := s.DB.Exec(fmt.Sprintf("UPDATE %s SET claimed_at = NULL WHERE claimed_at IS NOT NULL", s.table))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n > 0 {
+		s.logger.Infof("reprow/sqlite: recovered jobs count=%d", n)
+	}
+	return nil
+}
+
+func (s *SQLite) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	s.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if config.Table == "" {
+		config.Table = "queue"
+	}
+	s.pollInterval, err = reprow.ParseDuration(config.PollInterval, "500ms")
+	if err != nil {
+		return errors.New("poll_interval failed to parse: " + err.Error())
+	}
+
+	s.config = config
+	s.table = `"` + strings.Replace(config.Table, `"`, `""`, -1) + `"`
+
+	db, err := sql.Open("sqlite3", "file:"+config.Path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return err
+	}
+	// Writes are serialized by sqlite anyway, and single connection avoids busy errors
+	db.SetMaxOpenConns(1)
+	s.DB = db
+
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  payload TEXT NOT NULL,
+  run_at INTEGER NOT NULL DEFAULT (strftime('%%s', 'now')),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  claimed_at INTEGER
+)`, s.table))
+	if err != nil {
+		return errors.New("failed to create table: " + err.Error())
+	}
+
+	return s.recover()
+}
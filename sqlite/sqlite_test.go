@@ -0,0 +1,128 @@
+package sqlite
+
+import (
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func newTestSQLite(t *testing.T, path string) *SQLite {
+	queue, err := NewSQLite(map[string]interface{}{
+		"path":          path,
+		"poll_interval": "50ms",
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make sqlite queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func TestConformance(t *testing.T) {
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			return newTestSQLite(t, filepath.Join(t.TempDir(), "reprow.db"))
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			err := queue.(*SQLite).Push(payload)
+			if err != nil {
+				t.Fatalf("failed to push e=%s", err.Error())
+			}
+		},
+	}.Run(t)
+}
+
+func TestRetryAfter(t *testing.T) {
+	queue := newTestSQLite(t, filepath.Join(t.TempDir(), "reprow.db"))
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	queue.Push(map[string]interface{}{"id": "delayed"})
+	mustReceive(t, stream).Abort(2)
+
+	started := time.Now()
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "delayed" {
+		t.Errorf("delayed job not delivered got=%v", job.Payload())
+	}
+	// run_at has second precision
+	if time.Since(started) < time.Second {
+		t.Errorf("job delivered before retry after")
+	}
+	if attempts := reprow.JobMetadata(job)["Attempts"]; attempts != 2 {
+		t.Errorf("attempts should be 2 got=%v", attempts)
+	}
+	job.End()
+}
+
+func TestRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reprow.db")
+	crashed := newTestSQLite(t, path)
+	crashed.Push(map[string]interface{}{"id": "orphan"})
+
+	// Process exits while the job is claimed
+	found, err := crashed.claim(&Job{queue: crashed})
+	if !found || err != nil {
+		t.Fatalf("failed to claim job e=%v", err)
+	}
+	crashed.DB.Close()
+
+	queue := newTestSQLite(t, path)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "orphan" {
+		t.Errorf("orphan job not recovered got=%v", job.Payload())
+	}
+	job.End()
+}
+
+func TestInvalidPayload(t *testing.T) {
+	queue := newTestSQLite(t, filepath.Join(t.TempDir(), "reprow.db"))
+	_, err := queue.DB.Exec(`INSERT INTO queue (payload) VALUES ('{')`)
+	if err != nil {
+		t.Fatalf("failed to insert e=%s", err.Error())
+	}
+	queue.Push(map[string]interface{}{"id": "valid"})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	if job.Payload()["id"] != "valid" {
+		t.Errorf("job with invalid payload should be skipped got=%v", job.Payload())
+	}
+	job.End()
+
+	var count int
+	err = queue.DB.QueryRow("SELECT COUNT(*) FROM queue WHERE run_at = ?", int64(math.MaxInt64)).Scan(&count)
+	if err != nil {
+		t.Fatalf("failed to count e=%s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("job with invalid payload should be kept with maximum run_at count=%d", count)
+	}
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case job := <-stream:
+			if job.WaitFinalize() {
+				return job
+			}
+		case <-deadline:
+			t.Fatalf("timeout reading stream")
+		}
+	}
+}
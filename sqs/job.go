@@ -24,6 +24,19 @@ func (j *Job) Payload() map[string]interface{} {
 		"MD5OfMessageAttributes": j.message.MD5OfMessageAttributes,
 	}
 }
+
+// Metadata returns message id and string values of message attributes
+func (j *Job) Metadata() map[string]interface{} {
+	attributes := make(map[string]interface{})
+	for _, a := range j.message.MessageAttribute {
+		attributes[a.Name] = a.Value.StringValue
+	}
+	return map[string]interface{}{
+		"MessageId":         j.message.MessageId,
+		"MessageAttributes": attributes,
+	}
+}
+
 func (j *Job) Abort(retryAfter int) {
 	j.queue.Abort(j, retryAfter)
 }
@@ -31,6 +44,10 @@ func (j *Job) End() {
 	j.queue.End(j)
 }
 
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
 func (j *Job) WaitFinalize() bool {
 	return <-j.finalized
 }
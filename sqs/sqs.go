@@ -58,6 +58,7 @@ func (s *SQS) Start(outChannel chan reprow.Job) error {
 	if s.done != nil {
 		return errors.New("Start called twice")
 	} else {
+		s.wantDown = false
 		s.done = make(chan bool)
 		go func() {
 			s.run(outChannel)
@@ -117,15 +118,20 @@ func (s *SQS) run(outChannel chan reprow.Job) {
 	wg.Wait()
 }
 
-func (s *SQS) finalizeJobs(jobs []*Job) {
-
-	params := map[string]string{
-		"MaxNumberOfMessages": strconv.Itoa(len(jobs)),
-		"VisibilityTimeout":   strconv.Itoa(s.config.VisibilityTimeout),
-		"WaitTimeSeconds":     "10", //TODO
+// receiveParams returns parameters of ReceiveMessage for n messages.
+// Message attributes are not returned by SQS unless they are asked for, so all of them are requested for Metadata.
+func (s *SQS) receiveParams(n int) map[string]string {
+	return map[string]string{
+		"MaxNumberOfMessages":    strconv.Itoa(n),
+		"VisibilityTimeout":      strconv.Itoa(s.config.VisibilityTimeout),
+		"WaitTimeSeconds":        "10", //TODO
+		"MessageAttributeName.1": "All",
 	}
+}
 
-	resp, err := s.queue.ReceiveMessageWithParameters(params)
+func (s *SQS) finalizeJobs(jobs []*Job) {
+
+	resp, err := s.queue.ReceiveMessageWithParameters(s.receiveParams(len(jobs)))
 	for i, job := range jobs {
 		if err != nil || i >= len(resp.Messages) {
 			job.finalized <- false
@@ -152,6 +158,7 @@ func (s *SQS) Stop() error {
 		s.logger.Infof("Waiting for all alive long polling request to finish. It will take arround 10 seconds")
 		s.wantDown = true
 		<-s.done
+		s.done = nil
 		return nil
 	}
 }
@@ -172,6 +179,11 @@ func (s *SQS) End(job *Job) {
 	s.logger.Debugf("reprow/sqs: ending job Id=%s", job.message.MessageId)
 }
 
+// Reject leaves message undeleted, so that it is moved to dead letter queue by redrive policy of the queue
+func (s *SQS) Reject(job *Job, reason string) {
+	s.logger.Errorf("reprow/sqs: job rejected Id=%s reason=%s", job.message.MessageId, reason)
+}
+
 func (s *SQS) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
 	s.wantDown = false
 
@@ -0,0 +1,106 @@
+package sqs
+
+import (
+	"encoding/json"
+	"github.com/cihub/seelog"
+	"github.com/goamz/goamz/sqs"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+// newTestSQS connects to the queue given by REPROW_TEST_SQS_URL, which should be dedicated to the test and empty.
+// Region is given by REPROW_TEST_SQS_REGION and credentials by AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func newTestSQS(t *testing.T) *SQS {
+	url := os.Getenv("REPROW_TEST_SQS_URL")
+	if url == "" {
+		t.Skip("REPROW_TEST_SQS_URL is not set")
+	}
+	queue, err := NewSQS(map[string]interface{}{
+		"access_key_id":      os.Getenv("AWS_ACCESS_KEY_ID"),
+		"secret_access_key":  os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		"region":             os.Getenv("REPROW_TEST_SQS_REGION"),
+		"url":                url,
+		"visibility_timeout": 30,
+		"max_concurrency":    2,
+		"buffer_timeout":     "100ms",
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to make sqs queue e=%s", err.Error())
+	}
+	return queue
+}
+
+func TestConformance(t *testing.T) {
+	reprowtest.QueueSuite{
+		NewQueue: func(t *testing.T) reprow.Queue {
+			return newTestSQS(t)
+		},
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			b, err := json.Marshal(payload)
+			if err != nil {
+				t.Fatalf("failed to marshal e=%s", err.Error())
+			}
+			_, err = queue.(*SQS).queue.SendMessage(string(b))
+			if err != nil {
+				t.Fatalf("failed to send message e=%s", err.Error())
+			}
+		},
+		Payload: func(job reprow.Job) map[string]interface{} {
+			var payload map[string]interface{}
+			body, _ := job.Payload()["Body"].(string)
+			json.Unmarshal([]byte(body), &payload)
+			return payload
+		},
+		// long polling of receive takes up to 10 seconds
+		Timeout: 30 * time.Second,
+	}.Run(t)
+}
+
+func TestReceiveParams(t *testing.T) {
+	s := &SQS{config: Config{VisibilityTimeout: 30}}
+	params := s.receiveParams(3)
+	if params["MaxNumberOfMessages"] != "3" || params["VisibilityTimeout"] != "30" {
+		t.Errorf("params should have number of messages and visibility timeout params=%v", params)
+	}
+	if params["MessageAttributeName.1"] != "All" {
+		t.Errorf("message attributes should be requested params=%v", params)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	job := &Job{
+		message: &sqs.Message{
+			MessageId: "message-1",
+			Body:      "body",
+			MessageAttribute: []sqs.MessageAttribute{
+				{Name: "type", Value: sqs.MessageAttributeValue{DataType: "String", StringValue: "mail"}},
+				{Name: "priority", Value: sqs.MessageAttributeValue{DataType: "Number", StringValue: "1"}},
+			},
+		},
+	}
+	metadata := job.Metadata()
+	if metadata["MessageId"] != "message-1" {
+		t.Errorf("metadata should have message id metadata=%v", metadata)
+	}
+	attributes, ok := metadata["MessageAttributes"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("metadata should have message attributes metadata=%v", metadata)
+	}
+	if attributes["type"] != "mail" || attributes["priority"] != "1" {
+		t.Errorf("message attributes do not match attributes=%v", attributes)
+	}
+}
+
+func TestRejectLeavesMessage(t *testing.T) {
+	// queue is not set so that deleting or changing visibility of message panics
+	job := &Job{
+		queue:   &SQS{logger: logger},
+		message: &sqs.Message{MessageId: "message-1"},
+	}
+	reprow.RejectJob(job, "invalid payload")
+}
@@ -0,0 +1,48 @@
+package webhook
+
+import (
+	"time"
+)
+
+type Job struct {
+	payload    map[string]interface{}
+	remoteAddr string
+	receivedAt time.Time
+	attempts   int
+	spoolPath  string
+	result     chan result
+	queue      *Webhook
+}
+
+func (j *Job) Queue() *Webhook {
+	return j.queue
+}
+
+func (j *Job) Payload() map[string]interface{} {
+	return j.payload
+}
+
+// Metadata returns address of the caller, time the request was received and how many times the job was aborted
+func (j *Job) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"RemoteAddr": j.remoteAddr,
+		"ReceivedAt": j.receivedAt,
+		"Attempts":   j.attempts,
+	}
+}
+
+func (j *Job) Abort(retryAfter int) {
+	j.queue.Abort(j, retryAfter)
+}
+
+func (j *Job) End() {
+	j.queue.End(j)
+}
+
+func (j *Job) Reject(reason string) {
+	j.queue.Reject(j, reason)
+}
+
+func (j *Job) WaitFinalize() bool {
+	return true
+}
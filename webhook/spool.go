@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// spool keeps accepted requests as files until their jobs are finished.
+// Files are named by time they are received, so they are recovered in order.
+type spool struct {
+	dir string
+	seq uint64
+}
+
+// spooled is content of a spool file
+type spooled struct {
+	Payload    map[string]interface{} `json:"payload"`
+	RemoteAddr string                 `json:"remote_addr"`
+	ReceivedAt time.Time              `json:"received_at"`
+}
+
+func newSpool(dir string) (*spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir}, nil
+}
+
+// write writes job to a new file and returns its path. It returns after the file is synced
+func (s *spool) write(job *Job) (string, error) {
+	b, err := json.Marshal(spooled{Payload: job.payload, RemoteAddr: job.remoteAddr, ReceivedAt: job.receivedAt})
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%020d-%010d.json", job.receivedAt.UnixNano(), atomic.AddUint64(&s.seq, 1))
+	// written to a temporary file first so that partially written file is never recovered
+	tmp := filepath.Join(s.dir, "."+name)
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	path := filepath.Join(s.dir, name)
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, s.syncDir()
+}
+
+func (s *spool) remove(path string) error {
+	return os.Remove(path)
+}
+
+// load returns jobs of spooled requests in order they were received
+func (s *spool) load(w *Webhook) ([]*Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	for _, entry := range entries {
+		path := filepath.Join(s.dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), ".") {
+			// left by a crash while writing, and never responded
+			os.Remove(path)
+			continue
+		}
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var record spooled
+		err = json.Unmarshal(b, &record)
+		if err != nil {
+			w.logger.Errorf("reprow/webhook: failed to deserialize spooled request. skipping path=%s err=%s", path, err.Error())
+			continue
+		}
+		jobs = append(jobs, &Job{
+			payload:    record.Payload,
+			remoteAddr: record.RemoteAddr,
+			receivedAt: record.ReceivedAt,
+			spoolPath:  path,
+			queue:      w,
+		})
+	}
+	return jobs, nil
+}
+
+// syncDir makes renamed file durable
+func (s *spool) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,375 @@
+// webhook package implements http endpoint receiving webhooks as reprow.Queue.
+// Each request is turned into a job whose payload holds method, path, query, headers and body of the request,
+// so that webhooks are processed with concurrency and retries of runner instead of hitting application directly.
+//
+// In immediate mode, request is responded with 202 as soon as it is queued.
+// Queued requests are kept in memory, or written to spool_dir before responding so that they survive restarts.
+// In wait mode, response is held until the job is finished so that the caller can retry on failure.
+// Ended jobs are responded with 200, aborted jobs with 503 and Retry-After, and rejected jobs with 422.
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ModeImmediate = "immediate"
+	ModeWait      = "wait"
+)
+
+func init() {
+	reprow.RegisterQueue("webhook", &WebhookBuilder{})
+}
+
+type WebhookBuilder struct{}
+
+func (b *WebhookBuilder) NewQueue(config map[string]interface{}, logger seelog.LoggerInterface) (reprow.Queue, error) {
+	return NewWebhook(config, logger)
+}
+
+func NewWebhook(config map[string]interface{}, logger seelog.LoggerInterface) (*Webhook, error) {
+	w := Webhook{}
+	err := w.configure(config, logger)
+	return &w, err
+}
+
+// Webhook implements http endpoint as reprow.Queue.
+// Requests are accepted from when it is created until Close is called, regardless of whether it is started.
+// Server.Run calls Close once the queue is stopped and running jobs are finished.
+type Webhook struct {
+	logger          seelog.LoggerInterface
+	config          Config
+	responseTimeout time.Duration
+	listener        net.Listener
+	server          *http.Server
+	spool           *spool
+	mu              sync.Mutex
+	ready           []*Job
+	delayed         int
+	notify          chan bool
+	wantDown        chan bool
+	done            chan bool
+}
+
+type Config struct {
+	Address         string `valid:"required"`
+	Mode            string `valid:"-"`
+	SpoolDir        string `valid:"-" mapstructure:"spool_dir"`
+	Capacity        int    `valid:"-"`
+	MaxBodySize     int64  `valid:"-" mapstructure:"max_body_size"`
+	ResponseTimeout string `valid:"-" mapstructure:"response_timeout"`
+}
+
+// result is response of a request in wait mode
+type result struct {
+	status     int
+	retryAfter int
+	body       string
+}
+
+// Addr returns address the endpoint is listening on
+func (w *Webhook) Addr() net.Addr {
+	return w.listener.Addr()
+}
+
+// Close stops accepting requests
+func (w *Webhook) Close() error {
+	return w.server.Close()
+}
+
+func (w *Webhook) Start(outChannel chan reprow.Job) error {
+	if w.done != nil {
+		return errors.New("Start called twice")
+	} else {
+		w.wantDown = make(chan bool)
+		w.done = make(chan bool)
+		go func() {
+			w.run(outChannel)
+			close(w.done)
+		}()
+		return nil
+	}
+}
+
+func (w *Webhook) run(outChannel chan reprow.Job) {
+	for {
+		w.mu.Lock()
+		var job *Job
+		if len(w.ready) > 0 {
+			job = w.ready[0]
+		}
+		w.mu.Unlock()
+
+		if job != nil {
+			select {
+			case outChannel <- job:
+				w.mu.Lock()
+				// Request waiting for the job might have timed out meanwhile, so job is looked up again
+				w.remove(job)
+				w.mu.Unlock()
+			case <-w.notify:
+			case <-w.wantDown:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-w.notify:
+		case <-w.wantDown:
+			return
+		}
+	}
+}
+
+func (w *Webhook) Stop() error {
+	if w.done == nil {
+		return errors.New("not running")
+	} else {
+		close(w.wantDown)
+		<-w.done
+		w.done = nil
+		return nil
+	}
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, w.config.MaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(rw, "body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(rw, "failed to read body", http.StatusBadRequest)
+		}
+		return
+	}
+	job := &Job{
+		payload:    requestPayload(r, body),
+		remoteAddr: r.RemoteAddr,
+		receivedAt: time.Now(),
+		queue:      w,
+	}
+
+	if w.spool != nil {
+		job.spoolPath, err = w.spool.write(job)
+		if err != nil {
+			w.logger.Errorf("reprow/webhook: failed to spool request e=%s", err.Error())
+			http.Error(rw, "failed to spool request", http.StatusInternalServerError)
+			return
+		}
+	}
+	if w.config.Mode == ModeWait {
+		job.result = make(chan result, 1)
+	}
+
+	if !w.push(job) {
+		if job.spoolPath != "" {
+			w.spool.remove(job.spoolPath)
+		}
+		http.Error(rw, "queue is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	if job.result == nil {
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	timer := time.NewTimer(w.responseTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-job.result:
+		if res.retryAfter > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(res.retryAfter))
+		}
+		rw.WriteHeader(res.status)
+		io.WriteString(rw, res.body)
+	case <-timer.C:
+		w.cancel(job)
+		http.Error(rw, "job did not finish in time", http.StatusGatewayTimeout)
+	case <-r.Context().Done():
+		w.cancel(job)
+	}
+}
+
+// push adds job to ready unless queue has reached its capacity
+func (w *Webhook) push(job *Job) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.config.Capacity > 0 && len(w.ready)+w.delayed >= w.config.Capacity {
+		return false
+	}
+	w.ready = append(w.ready, job)
+	w.wakeup()
+	return true
+}
+
+// cancel removes job whose request is no longer waiting for it, unless it is already passed to runner
+func (w *Webhook) cancel(job *Job) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.remove(job) {
+		w.wakeup()
+	}
+}
+
+// remove removes job from ready. It should be called with lock held.
+func (w *Webhook) remove(job *Job) bool {
+	for i, j := range w.ready {
+		if j == job {
+			w.ready = append(w.ready[:i], w.ready[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// wakeup notifies run loop that ready jobs have changed. It should be called with lock held.
+func (w *Webhook) wakeup() {
+	select {
+	case w.notify <- true:
+	default:
+	}
+}
+
+func (w *Webhook) Abort(job *Job, retryAfter int) {
+	if job.result != nil {
+		job.result <- result{
+			status:     http.StatusServiceUnavailable,
+			retryAfter: retryAfter,
+			body:       "job aborted",
+		}
+		return
+	}
+
+	requeued := *job
+	requeued.attempts++
+	w.mu.Lock()
+	w.delayed++
+	w.mu.Unlock()
+	time.AfterFunc(time.Duration(retryAfter)*time.Second, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.delayed--
+		w.ready = append(w.ready, &requeued)
+		w.wakeup()
+	})
+}
+
+func (w *Webhook) End(job *Job) {
+	if job.result != nil {
+		job.result <- result{status: http.StatusOK}
+		return
+	}
+	w.finish(job)
+}
+
+func (w *Webhook) Reject(job *Job, reason string) {
+	w.logger.Errorf("reprow/webhook: job rejected path=%s reason=%s", job.payload["path"], reason)
+	if job.result != nil {
+		job.result <- result{status: http.StatusUnprocessableEntity, body: reason}
+		return
+	}
+	w.finish(job)
+}
+
+func (w *Webhook) finish(job *Job) {
+	if job.spoolPath == "" {
+		return
+	}
+	err := w.spool.remove(job.spoolPath)
+	if err != nil {
+		w.logger.Errorf("reprow/webhook: failed to remove spooled request e=%s", err.Error())
+	}
+}
+
+// requestPayload returns payload of request. Multiple values of a header are joined with comma
+func requestPayload(r *http.Request, body []byte) map[string]interface{} {
+	headers := make(map[string]interface{}, len(r.Header))
+	for name, values := range r.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	return map[string]interface{}{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"query":   r.URL.RawQuery,
+		"headers": headers,
+		"body":    string(body),
+	}
+}
+
+func (w *Webhook) configure(c map[string]interface{}, logger seelog.LoggerInterface) error {
+	w.logger = logger
+
+	var config Config
+	err := mapstructure.Decode(c, &config)
+	if err != nil {
+		return err
+	}
+	_, err = govalidator.ValidateStruct(config)
+	if err != nil {
+		return err
+	}
+
+	if config.Mode == "" {
+		config.Mode = ModeImmediate
+	}
+	if config.Mode != ModeImmediate && config.Mode != ModeWait {
+		return fmt.Errorf("mode should be %s or %s", ModeImmediate, ModeWait)
+	}
+	if config.Mode == ModeWait && config.SpoolDir != "" {
+		return errors.New("spool_dir can not be used in wait mode")
+	}
+	if config.Capacity == 0 {
+		config.Capacity = 1000
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 1 << 20
+	}
+	w.responseTimeout, err = reprow.ParseDuration(config.ResponseTimeout, "30s")
+	if err != nil {
+		return errors.New("response_timeout failed to parse: " + err.Error())
+	}
+	w.config = config
+	w.notify = make(chan bool, 1)
+
+	if config.SpoolDir != "" {
+		w.spool, err = newSpool(config.SpoolDir)
+		if err != nil {
+			return err
+		}
+		w.ready, err = w.spool.load(w)
+		if err != nil {
+			return err
+		}
+		if len(w.ready) > 0 {
+			w.logger.Infof("recovered spooled requests count=%d", len(w.ready))
+		}
+	}
+
+	w.listener, err = net.Listen("tcp", config.Address)
+	if err != nil {
+		return err
+	}
+	w.server = &http.Server{Handler: w}
+	go func() {
+		err := w.server.Serve(w.listener)
+		if err != nil && err != http.ErrServerClosed {
+			w.logger.Errorf("reprow/webhook: failed to serve e=%s", err.Error())
+		}
+	}()
+	return nil
+}
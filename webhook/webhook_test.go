@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/cihub/seelog"
+	"github.com/maedama/reprow"
+	"github.com/maedama/reprow/reprowtest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger, _ = seelog.LoggerFromWriterWithMinLevel(os.Stdout, seelog.DebugLvl)
+
+func newTestWebhook(t *testing.T, config map[string]interface{}) *Webhook {
+	c := map[string]interface{}{
+		"address": "127.0.0.1:0",
+	}
+	for key, value := range config {
+		c[key] = value
+	}
+	queue, err := NewWebhook(c, logger)
+	if err != nil {
+		t.Fatalf("failed to make webhook queue e=%s", err.Error())
+	}
+	t.Cleanup(func() { queue.Close() })
+	return queue
+}
+
+func post(t *testing.T, queue *Webhook, payload map[string]interface{}) *http.Response {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal e=%s", err.Error())
+	}
+	res, err := http.Post("http://"+queue.Addr().String()+"/hooks/test?source=test", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed to post e=%s", err.Error())
+	}
+	res.Body.Close()
+	return res
+}
+
+func body(job reprow.Job) map[string]interface{} {
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(job.Payload()["body"].(string)), &payload)
+	return payload
+}
+
+func TestConformance(t *testing.T) {
+	suite := reprowtest.QueueSuite{
+		Push: func(t *testing.T, queue reprow.Queue, payload map[string]interface{}) {
+			if res := post(t, queue.(*Webhook), payload); res.StatusCode != http.StatusAccepted {
+				t.Fatalf("request should be accepted got=%d", res.StatusCode)
+			}
+		},
+		Payload: body,
+	}
+
+	t.Run("Memory", func(t *testing.T) {
+		suite.NewQueue = func(t *testing.T) reprow.Queue {
+			return newTestWebhook(t, nil)
+		}
+		suite.Run(t)
+	})
+	t.Run("Spool", func(t *testing.T) {
+		suite.NewQueue = func(t *testing.T) reprow.Queue {
+			return newTestWebhook(t, map[string]interface{}{"spool_dir": t.TempDir()})
+		}
+		suite.Run(t)
+	})
+}
+
+func TestPayload(t *testing.T) {
+	queue := newTestWebhook(t, nil)
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	post(t, queue, map[string]interface{}{"id": 1})
+	job := mustReceive(t, stream)
+	payload := job.Payload()
+	if payload["method"] != "POST" || payload["path"] != "/hooks/test" || payload["query"] != "source=test" {
+		t.Errorf("request should be in payload got=%v", payload)
+	}
+	if headers := payload["headers"].(map[string]interface{}); headers["Content-Type"] != "application/json" {
+		t.Errorf("headers should be in payload got=%v", headers)
+	}
+	if body(job)["id"] != float64(1) {
+		t.Errorf("body should be in payload got=%v", payload["body"])
+	}
+	job.End()
+}
+
+func TestSpoolRecovered(t *testing.T) {
+	dir := t.TempDir()
+	queue := newTestWebhook(t, map[string]interface{}{"spool_dir": dir})
+	post(t, queue, map[string]interface{}{"id": "spooled"})
+	queue.Close()
+
+	queue = newTestWebhook(t, map[string]interface{}{"spool_dir": dir})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	job := mustReceive(t, stream)
+	if body(job)["id"] != "spooled" {
+		t.Errorf("spooled request should be recovered got=%v", job.Payload())
+	}
+	job.End()
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("spool file should be removed on end got=%d", len(entries))
+	}
+}
+
+func TestWait(t *testing.T) {
+	queue := newTestWebhook(t, map[string]interface{}{"mode": "wait"})
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+
+	cases := []struct {
+		name       string
+		finish     func(job reprow.Job)
+		status     int
+		retryAfter string
+	}{
+		{"End", func(job reprow.Job) { job.End() }, http.StatusOK, ""},
+		{"Abort", func(job reprow.Job) { job.Abort(3) }, http.StatusServiceUnavailable, "3"},
+		{"Reject", func(job reprow.Job) { job.(reprow.Rejecter).Reject("invalid") }, http.StatusUnprocessableEntity, ""},
+	}
+	for _, c := range cases {
+		responses := make(chan *http.Response, 1)
+		go func() {
+			responses <- post(t, queue, map[string]interface{}{"id": c.name})
+		}()
+		c.finish(mustReceive(t, stream))
+
+		res := <-responses
+		if res.StatusCode != c.status || res.Header.Get("Retry-After") != c.retryAfter {
+			t.Errorf("%s should be responded with status=%d retry_after=%s got=%d,%s", c.name, c.status, c.retryAfter, res.StatusCode, res.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	queue := newTestWebhook(t, map[string]interface{}{"mode": "wait", "response_timeout": "100ms"})
+	if res := post(t, queue, map[string]interface{}{"id": 1}); res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("request should time out got=%d", res.StatusCode)
+	}
+
+	stream := make(chan reprow.Job)
+	queue.Start(stream)
+	defer queue.Stop()
+	select {
+	case job := <-stream:
+		t.Errorf("timed out request should not be delivered got=%v", job.Payload())
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	queue := newTestWebhook(t, map[string]interface{}{"capacity": 1})
+	post(t, queue, map[string]interface{}{"id": 1})
+	if res := post(t, queue, map[string]interface{}{"id": 2}); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request over capacity should be refused got=%d", res.StatusCode)
+	}
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestBodyErrors(t *testing.T) {
+	queue := newTestWebhook(t, map[string]interface{}{"max_body_size": 8})
+	if res := post(t, queue, map[string]interface{}{"id": "too large"}); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over max_body_size should be refused with 413 got=%d", res.StatusCode)
+	}
+
+	rw := httptest.NewRecorder()
+	queue.ServeHTTP(rw, httptest.NewRequest("POST", "/hooks/test", io.NopCloser(brokenReader{})))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("failure to read body should be 400 got=%d", rw.Code)
+	}
+}
+
+func mustReceive(t *testing.T, stream chan reprow.Job) reprow.Job {
+	select {
+	case job := <-stream:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout reading stream")
+	}
+	return nil
+}